@@ -0,0 +1,215 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// addrIndex lists the main chain transactions paying to or spending from every
+// public key hash. It holds two kinds of keys:
+//
+//	'h' len(pkh) pkh height position -> AddressTx, one per transaction and address
+//	'o' txid vout                     -> the output, for outputs paying to an address
+//
+// The outputs let a spending input be attributed to an address and valued without
+// looking the previous transaction up.
+const addrIndex = "addrindex"
+
+var ErrAddrIndexDisabled = errors.New("address index is disabled, build it with reindexaddr")
+
+// AddressTx is a transaction in the history of an address
+type AddressTx struct {
+	TxID     []byte
+	Height   int
+	Position int // of the transaction in its block
+	Received int // sum of the outputs paying to the address
+	Sent     int // sum of the outputs of the address spent by the inputs
+}
+
+// Net is the change of the balance of the address made by the transaction
+func (a AddressTx) Net() int {
+	return a.Received - a.Sent
+}
+
+// addrHistoryPrefix is the prefix of the history keys of a public key hash
+func addrHistoryPrefix(pubKeyHash []byte) []byte {
+	return append([]byte{'h', byte(len(pubKeyHash))}, pubKeyHash...)
+}
+
+func addrHistoryKey(pubKeyHash []byte, height, position int) []byte {
+	key := append(addrHistoryPrefix(pubKeyHash), heightKey(height)...)
+	return binary.BigEndian.AppendUint32(key, uint32(position))
+}
+
+func addrOutputKey(txID []byte, vout int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{'o'}, txID...), uint32(vout))
+}
+
+// addressEntries sums what every transaction of a block received and spent per
+// public key hash, resolving spent outputs from the index or earlier in the block
+func addressEntries(tx StoreTx, block *Block) (map[string]*AddressTx, []string, error) {
+	entries := make(map[string]*AddressTx)
+	var keys []string // in the order of the transactions, for deterministic writes
+	created := make(map[string]TXOutput)
+
+	entry := func(pubKeyHash []byte, pos int, txID []byte) *AddressTx {
+		key := string(addrHistoryKey(pubKeyHash, block.Height, pos))
+		if entries[key] == nil {
+			entries[key] = &AddressTx{TxID: txID, Height: block.Height, Position: pos}
+			keys = append(keys, key)
+		}
+		return entries[key]
+	}
+
+	for pos, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			for _, in := range transaction.Vin {
+				out, ok := created[string(addrOutputKey(in.TxID, in.Vout))]
+				if !ok {
+					data := tx.Index(addrIndex).Get(addrOutputKey(in.TxID, in.Vout))
+					if data == nil {
+						continue // not paying to an address
+					}
+					outs, err := DecodeOutputs(data)
+					if err != nil || len(outs.Outputs) != 1 {
+						return nil, nil, fmt.Errorf("address index output %x:%d is corrupt", in.TxID, in.Vout)
+					}
+					out = outs.Outputs[0]
+				}
+				entry(out.PubKeyHash, pos, transaction.ID).Sent += out.Value
+			}
+		}
+
+		for vout, out := range transaction.Vout {
+			if len(out.PubKeyHash) == 0 {
+				continue
+			}
+			created[string(addrOutputKey(transaction.ID, vout))] = out
+			entry(out.PubKeyHash, pos, transaction.ID).Received += out.Value
+		}
+	}
+
+	return entries, keys, nil
+}
+
+func connectAddrIndex(tx StoreTx, block *Block) error {
+	index := tx.Index(addrIndex)
+	entries, keys, err := addressEntries(tx, block)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := index.Put([]byte(key), encodeAddressTx(*entries[key])); err != nil {
+			return err
+		}
+	}
+
+	for _, transaction := range block.Transactions {
+		for vout, out := range transaction.Vout {
+			if len(out.PubKeyHash) == 0 {
+				continue
+			}
+			data := EncodeOutputs(TXOutputs{Outputs: []TXOutput{out}, Indexes: []int{vout}})
+			if err := index.Put(addrOutputKey(transaction.ID, vout), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func disconnectAddrIndex(tx StoreTx, block *Block) error {
+	index := tx.Index(addrIndex)
+
+	// entries are computed before the outputs they rely on are removed
+	_, keys, err := addressEntries(tx, block)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := index.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	for _, transaction := range block.Transactions {
+		for vout := range transaction.Vout {
+			if err := index.Delete(addrOutputKey(transaction.ID, vout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddrIndexEnabled reports whether the address index is kept
+func (bc *Blockchain) AddrIndexEnabled() bool {
+	enabled := false
+	_ = bc.store.View(func(tx StoreTx) error {
+		enabled = indexEnabled(tx, addrIndex)
+		return nil
+	})
+
+	return enabled
+}
+
+// ReindexAddresses builds the address index from the main chain and keeps it up
+// to date from then on. It returns the number of blocks indexed.
+func (bc *Blockchain) ReindexAddresses() (int, error) {
+	var count int
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		var err error
+		count, err = rebuildIndex(tx, addrIndex)
+		return err
+	})
+
+	return count, err
+}
+
+// AddressHistory returns the transactions of pubKeyHash from the address index,
+// latest first, skipping the first skip of them and returning at most count. The
+// returned total sums every transaction of the address, not only those returned.
+func (bc *Blockchain) AddressHistory(pubKeyHash []byte, skip, count int) ([]AddressTx, AddressTx, error) {
+	var page []AddressTx
+	var total AddressTx
+
+	err := bc.store.View(func(tx StoreTx) error {
+		if !indexEnabled(tx, addrIndex) {
+			return ErrAddrIndexDisabled
+		}
+
+		var history []AddressTx
+		err := tx.Index(addrIndex).ForEachPrefix(addrHistoryPrefix(pubKeyHash), func(k, v []byte) error {
+			entry, err := decodeAddressTx(v)
+			if err != nil {
+				return err
+			}
+
+			n := len(k)
+			entry.Height = int(binary.BigEndian.Uint64(k[n-12 : n-4]))
+			entry.Position = int(binary.BigEndian.Uint32(k[n-4:]))
+			history = append(history, entry)
+
+			total.Received += entry.Received
+			total.Sent += entry.Sent
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := len(history) - 1 - skip; i >= 0 && len(page) < count; i-- {
+			page = append(page, history[i])
+		}
+
+		return nil
+	})
+
+	return page, total, err
+}
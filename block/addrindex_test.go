@@ -0,0 +1,174 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// addTestBlock adds a block of txs on top of prev, or a genesis block when prev is nil
+func addTestBlock(tb testing.TB, bc *Blockchain, prev *Block, txs ...*Transaction) *Block {
+	prevHash, height := []byte{}, 0
+	if prev != nil {
+		prevHash, height = prev.Hash, prev.Height+1
+	}
+
+	block := testBlock(prevHash, height, "")
+	block.Transactions = txs
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	if prev != nil {
+		if err := bc.AddBlock(block); err != nil {
+			tb.Fatal(err)
+		}
+		return block
+	}
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
+		return setTip(tx, block.Hash, 0)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bc.tip = block.Hash
+
+	return block
+}
+
+// signTestTx signs every input of tx, spending outputs of prev owned by owner, and sets its ID
+func signTestTx(tb testing.TB, tx *Transaction, owner *Wallet, prev *Transaction) {
+	if err := tx.Sign(owner, map[string]Transaction{hex.EncodeToString(prev.ID): *prev}, SigHashAll); err != nil {
+		tb.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+}
+
+// formatHistory renders a history as txid:height:position:received:sent entries
+func formatHistory(history []AddressTx) string {
+	var s string
+	for _, entry := range history {
+		s += fmt.Sprintf("%x:%d:%d:%d:%d ", entry.TxID[:4], entry.Height, entry.Position, entry.Received, entry.Sent)
+	}
+
+	return s
+}
+
+func TestAddressHistory(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	aliceHash, bobHash := HashPubKey(alice.PublicKey), HashPubKey(bob.PublicKey)
+
+	bc := newTestChain(t)
+	if _, _, err := bc.AddressHistory(aliceHash, 0, 10); !errors.Is(err, ErrAddrIndexDisabled) {
+		t.Fatalf("history without the index returned %v", err)
+	}
+	if _, err := bc.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	genesis := addTestBlock(t, bc, nil, cbAlice)
+
+	cbBob := NewCoinbaseTX(string(bob.GetAddress()), "bob")
+	pay := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(3, string(bob.GetAddress())), *NewTXOutput(subsidy-3, string(alice.GetAddress()))}, txVersion}
+	signTestTx(t, pay, alice, cbAlice)
+	addTestBlock(t, bc, genesis, cbBob, pay)
+
+	aliceWant := fmt.Sprintf("%x:1:1:7:10 %x:0:0:10:0 ", pay.ID[:4], cbAlice.ID[:4])
+	history, total, err := bc.AddressHistory(aliceHash, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatHistory(history); got != aliceWant {
+		t.Fatalf("history of alice %s, want %s", got, aliceWant)
+	}
+	if total.Received != 17 || total.Sent != 10 || total.Net() != 7 {
+		t.Fatalf("alice received %d and sent %d", total.Received, total.Sent)
+	}
+
+	history, total, err = bc.AddressHistory(bobHash, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobWant := fmt.Sprintf("%x:1:1:3:0 %x:1:0:10:0 ", pay.ID[:4], cbBob.ID[:4])
+	if got := formatHistory(history); got != bobWant || total.Net() != 13 {
+		t.Fatalf("history of bob %s with net %d, want %s with 13", got, total.Net(), bobWant)
+	}
+
+	// pages
+	for _, page := range []struct {
+		skip, count int
+		want        string
+	}{
+		{0, 1, fmt.Sprintf("%x:1:1:7:10 ", pay.ID[:4])},
+		{1, 1, fmt.Sprintf("%x:0:0:10:0 ", cbAlice.ID[:4])},
+		{2, 1, ""},
+	} {
+		history, total, err := bc.AddressHistory(aliceHash, page.skip, page.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatHistory(history); got != page.want || total.Net() != 7 {
+			t.Fatalf("skip %d count %d: %s with net %d, want %s", page.skip, page.count, got, total.Net(), page.want)
+		}
+	}
+
+	// a rebuilt index is the same as the one kept up to date
+	if _, err := bc.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+	history, _, _ = bc.AddressHistory(aliceHash, 0, 10)
+	if got := formatHistory(history); got != aliceWant {
+		t.Fatalf("history of alice after reindexing %s, want %s", got, aliceWant)
+	}
+}
+
+func TestAddressIndexFollowsReorg(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+
+	bc := newTestChain(t)
+	if _, err := bc.ReindexAddresses(); err != nil {
+		t.Fatal(err)
+	}
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	genesis := addTestBlock(t, bc, nil, cbAlice)
+
+	pay := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(bob.GetAddress()))}, txVersion}
+	signTestTx(t, pay, alice, cbAlice)
+	addTestBlock(t, bc, genesis, NewCoinbaseTX(string(NewWallet().GetAddress()), "1"), pay)
+
+	// a longer branch without the payment replaces the block holding it
+	fork := addTestBlock(t, bc, genesis, NewCoinbaseTX(string(NewWallet().GetAddress()), "fork 1"))
+	fork = addTestBlock(t, bc, fork, NewCoinbaseTX(string(NewWallet().GetAddress()), "fork 2"))
+	if !bytes.Equal(bc.tip, fork.Hash) {
+		t.Fatal("the fork did not become the main chain")
+	}
+
+	history, total, err := bc.AddressHistory(HashPubKey(alice.PublicKey), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x:0:0:10:0 ", cbAlice.ID[:4]); formatHistory(history) != want || total.Net() != subsidy {
+		t.Fatalf("history of alice %s with net %d, want %s", formatHistory(history), total.Net(), want)
+	}
+
+	history, _, _ = bc.AddressHistory(HashPubKey(bob.PublicKey), 0, 10)
+	if len(history) != 0 {
+		t.Fatalf("bob keeps a payment of a block off the main chain: %s", formatHistory(history))
+	}
+
+	// the payment is confirmed again on top of the fork
+	addTestBlock(t, bc, fork, NewCoinbaseTX(string(NewWallet().GetAddress()), "fork 3"), pay)
+	history, total, _ = bc.AddressHistory(HashPubKey(alice.PublicKey), 0, 10)
+	if want := fmt.Sprintf("%x:3:1:0:10 %x:0:0:10:0 ", pay.ID[:4], cbAlice.ID[:4]); formatHistory(history) != want || total.Net() != 0 {
+		t.Fatalf("history of alice %s with net %d, want %s", formatHistory(history), total.Net(), want)
+	}
+}
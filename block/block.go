@@ -3,15 +3,28 @@ package block
 import (
 	"bytes"
 	"encoding/gob"
+	"log"
 	"time"
 )
 
+// blockVersion is the version of new blocks. The Merkle root of version 0 blocks
+// is computed over the legacy gob encoding of their transactions.
+const blockVersion = 1
+
 type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+	Hash         []byte // hash of the header
+	Height       int
+}
+
+// legacyBlock is the layout of blocks stored with gob
+type legacyBlock struct {
 	Timestamp     int64
 	Transactions  []*Transaction
 	PrevBlockHash []byte
 	Hash          []byte
-	Nonce         int // 'number once', arbitrary number that's only used once
+	Nonce         int
 	Height        int
 }
 
@@ -23,14 +36,19 @@ func NewGenesisBlock(coinbase *Transaction) *Block {
 // NewBlock creates and returns Block
 func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Block {
 	block := &Block{
-		Timestamp:     time.Now().Unix(),
-		Transactions:  transactions,
-		PrevBlockHash: prevBlockHash,
-		Hash:          []byte{},
-		Nonce:         0,
-		Height:        height,
+		BlockHeader: BlockHeader{
+			Version:       blockVersion,
+			PrevBlockHash: prevBlockHash,
+			Timestamp:     time.Now().Unix(),
+			Bits:          targetBits,
+			Nonce:         0,
+		},
+		Transactions: transactions,
+		Hash:         []byte{},
+		Height:       height,
 	}
-	pow := NewProofOfWork(block)
+	block.MerkleRoot = block.HashTransactions()
+	pow := NewProofOfWork(&block.BlockHeader)
 	nonce, hash := pow.Run()
 
 	block.Hash = hash[:]
@@ -39,31 +57,70 @@ func NewBlock(transactions []*Transaction, prevBlockHash []byte, height int) *Bl
 	return block
 }
 
-// serialization
+// Serialize returns the canonical encoding of the block
 func (b *Block) Serialize() []byte {
-	var buf bytes.Buffer // store the serialized data
-	encoder := gob.NewEncoder(&buf)
-	_ = encoder.Encode(b)
-
-	return buf.Bytes()
+	return EncodeBlock(b)
 }
 
+// DeserializeBlock deserializes a block in the canonical or the legacy gob encoding.
+// It is meant for data read from the database of the node and panics on malformed
+// data, blocks received from peers are decoded with DecodeBlock.
 func DeserializeBlock(d []byte) *Block {
-	var block Block
+	if isCanonical(d) {
+		block, err := DecodeBlock(d)
+		if err != nil {
+			log.Panic(err)
+		}
+		return block
+	}
+
+	var legacy legacyBlock
 	buf := bytes.NewReader(d)
 	decoder := gob.NewDecoder(buf)
-	_ = decoder.Decode(&block)
-	return &block
+	_ = decoder.Decode(&legacy)
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			PrevBlockHash: legacy.PrevBlockHash,
+			Timestamp:     legacy.Timestamp,
+			Bits:          targetBits,
+			Nonce:         legacy.Nonce,
+		},
+		Transactions: legacy.Transactions,
+		Hash:         legacy.Hash,
+		Height:       legacy.Height,
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	return block
 }
 
+// HashTransactions computes the Merkle root of the block's transactions
 func (b *Block) HashTransactions() []byte {
+	if len(b.Transactions) == 0 {
+		return nil
+	}
+
+	// The root of the tree will serve as the unique identifier of block’s transactions
+	return b.merkleTree().RootNode.Data
+}
+
+// merkleTree builds the Merkle tree of the block's transactions
+func (b *Block) merkleTree() *MerkleTree {
 	var transactions [][]byte
 
 	for _, tx := range b.Transactions {
-		transactions = append(transactions, tx.Serialize())
+		transactions = append(transactions, merkleLeafData(tx, b.Version))
 	}
 
-	// The root of the tree will serve as the unique identifier of block’s transactions
-	mTree := NewMerkleTree(transactions)
-	return mTree.RootNode.Data
+	return NewMerkleTree(transactions)
+}
+
+// merkleLeafData returns the data hashed into the Merkle leaf of tx in a block of the given version
+func merkleLeafData(tx *Transaction, version int) []byte {
+	if version == 0 {
+		return tx.legacySerialize()
+	}
+
+	return tx.Serialize()
 }
@@ -1,189 +1,205 @@
 package block
 
 import (
-	"bytes"
-	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"log"
 	"os"
 )
 
-const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const latestKey = "latest" // specify the latest block's hash
 const genesisCoinbaseData = "genesis_coinbase"
 
+var (
+	ErrOrphanBlock = errors.New("previous block is unknown")
+	ErrBadHeight   = errors.New("block height does not follow its parent")
+)
+
 // A blockchain can have multiple branches, and it’s the longest of them that’s considered main
 type Blockchain struct {
-	tip []byte   // latest block's hash
-	db  *bolt.DB // store the blocks
+	tip      []byte                  // latest block's hash
+	store    ChainStore              // store the blocks
+	sigCache *SigCache               // successful signature checks, shared by mempool and block validation
+	blocks   *lruCache[*Block]       // recently read blocks, by hash
+	headers  *lruCache[cachedHeader] // recently read headers, by hash
+}
+
+// cachedHeader is a header with the height of its block
+type cachedHeader struct {
+	header BlockHeader
+	height int
+}
+
+func newBlockchain(tip []byte, store ChainStore) *Blockchain {
+	return &Blockchain{
+		tip:      tip,
+		store:    store,
+		sigCache: NewSigCache(defaultSigCacheSize),
+		blocks:   newLRUCache[*Block](defaultBlockCacheSize),
+		headers:  newLRUCache[cachedHeader](defaultBlockCacheSize),
+	}
 }
 
 func (bc *Blockchain) CloseDB() {
-	_ = bc.db.Close()
+	_ = bc.store.Close()
 }
 
 // CreateBlockchain creates a new blockchain DB
 func CreateBlockchain(address, nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := chainFile.path(nodeID)
 	if dbExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 
-	var tip []byte
-
 	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
 	genesis := NewGenesisBlock(cbtx)
 
-	db, err := bolt.Open(dbFile, 0600, nil)
+	store, err := openChainStore(dbFile)
 	if err != nil {
 		log.Panic(err)
 	}
+	if _, err := migrateSchema(store); err != nil {
+		log.Panic(err)
+	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put(genesis.Hash, genesis.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put([]byte("l"), genesis.Hash)
-		if err != nil {
-			log.Panic(err)
+	err = store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, genesis); err != nil {
+			return err
 		}
-		tip = genesis.Hash
 
-		return nil
+		return setTip(tx, genesis.Hash, genesis.Height)
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
-
-	return &bc
+	return newBlockchain(genesis.Hash, store)
 }
 
 // NewBlockchain creates a new Blockchain with genesis Block
 func NewBlockchain(nodeID string) *Blockchain {
-	dbFile := fmt.Sprintf(dbFile, nodeID)
+	dbFile := chainFile.path(nodeID)
 	if dbExists(dbFile) == false {
 		fmt.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
 
-	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	store, err := openChainStore(dbFile)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-
-		return nil
-	})
+	bc, err := OpenBlockchain(store)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	bc := Blockchain{tip, db}
+	return bc
+}
+
+// openChainStore opens the chain database at path, with a write-back cache of its chain state
+func openChainStore(path string) (ChainStore, error) {
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCachedStore(store, defaultUTXOCacheSize), nil
+}
+
+// OpenBlockchain returns the Blockchain kept in store, which may be empty. The store
+// is upgraded to the latest schema and must belong to the network of the node.
+func OpenBlockchain(store ChainStore) (*Blockchain, error) {
+	var tip []byte
+
+	if _, err := migrateSchema(store); err != nil {
+		return nil, err
+	}
+
+	err := store.Update(func(tx StoreTx) error {
+		tip = tx.Tip()
+		return recoverChainState(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return &bc
+	return newBlockchain(tip, store), nil
 }
 
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
+// AddBlock stores a block whose parent is known and makes it the tip when it makes
+// its branch the longest. The height of the block must follow that of its parent.
+// The blocks joining the main chain are verified against the UTXO set as they are
+// connected, and the tip is left as it was if one of them is invalid.
+func (bc *Blockchain) AddBlock(block *Block) error {
+	var newTip []byte
 
-		if blockInDb != nil {
+	err := bc.store.Update(func(tx StoreTx) error {
+		if tx.Blocks().Get(block.Hash) != nil {
 			return nil
 		}
 
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		height, err := blockHeight(tx, block)
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+		if err := putBlock(tx, block); err != nil {
+			return err
 		}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		lastHeight := -1
+		if lastHash := tx.Tip(); lastHash != nil {
+			if _, lastHeight, err = getHeader(tx, lastHash); err != nil {
+				return err
+			}
+		}
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
+		if height > lastHeight {
+			if err := moveTip(tx, block.Hash, height, bc.verifyConnecting); err != nil {
+				return err
 			}
-			bc.tip = block.Hash
+			newTip = block.Hash
 		}
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if newTip != nil {
+		bc.tip = newTip
 	}
-}
 
-func (bc *Blockchain) Iterator() *BlockchainIterator {
-	bi := &BlockchainIterator{currentHash: bc.tip, db: bc.db}
-	return bi
+	return nil
 }
 
-// FindUnspentTransactions finds transactions with unspent outputs
-func (bc *Blockchain) FindUnspentTransactions(address string) []Transaction {
-	var unspentTXs []Transaction
-	spentTXOutputs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				// Was the out spent?
-				if spentTXOutputs[txID] != nil {
-					for _, spendOut := range spentTXOutputs[txID] {
-						if spendOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				if out.IsLockedWithKey([]byte(address)) {
-					unspentTXs = append(unspentTXs, *tx)
-				}
-			}
-
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Vin {
-					if in.UsesKey([]byte(address)) {
-						inTxID := hex.EncodeToString(in.TxID)
-						spentTXOutputs[inTxID] = append(spentTXOutputs[inTxID], in.Vout)
-					}
-				}
-			}
-
+// blockHeight returns the height of a block, one above its stored parent header, and
+// checks it against the height the block claims
+func blockHeight(tx StoreTx, block *Block) (int, error) {
+	height := 0
+	if len(block.PrevBlockHash) > 0 {
+		_, prevHeight, err := getHeader(tx, block.PrevBlockHash)
+		if errors.Is(err, ErrHeaderNotFound) {
+			return 0, fmt.Errorf("%w: %x", ErrOrphanBlock, block.PrevBlockHash)
 		}
-
-		if len(block.PrevBlockHash) == 0 {
-			break
+		if err != nil {
+			return 0, err
 		}
+		height = prevHeight + 1
 	}
 
-	return unspentTXs
+	if block.Height != height {
+		return 0, fmt.Errorf("%w: block %x claims height %d, its parent is at %d", ErrBadHeight, block.Hash, block.Height, height-1)
+	}
+
+	return height, nil
+}
+
+func (bc *Blockchain) Iterator() *BlockchainIterator {
+	bi := &BlockchainIterator{currentHash: bc.tip, bc: bc}
+	return bi
 }
 
 // returns a list of transactions containing unspent outputs
@@ -211,6 +227,7 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 
@@ -230,133 +247,91 @@ func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
 	return UTXO
 }
 
-/*
-address: receiver's address
-amount: amount of sending coins
-The method iterates over all unspent transactions and accumulates their values,
-return balance and valid outputs
-*/
-func (bc *Blockchain) FindSpendableOutputs(address string, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	unspentTXs := bc.FindUnspentTransactions(address)
-	accumulated := 0
-
-Work:
-	for _, tx := range unspentTXs {
-		txID := hex.EncodeToString(tx.ID)
-
-		for outIdx, output := range tx.Vout {
-			if output.IsLockedWithKey([]byte(address)) && accumulated < amount {
-				accumulated += output.Value
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-
-				if accumulated >= amount {
-					break Work
-				}
-			}
-		}
-	}
-
-	return accumulated, unspentOutputs
-}
-
-// MineBlock mines a new block with the provided transactions
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
+// MineBlock mines a new block with the provided transactions and connects it to the
+// tip and the UTXO set in one transaction
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		// TODO: ignore transaction if it's not valid
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
-		}
+	if err := bc.verifyTransactions(transactions); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
 	}
 
-	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+	err := bc.store.View(func(tx StoreTx) error {
+		lastHash = tx.Tip()
 
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
+		var err error
+		_, lastHeight, err = getHeader(tx, lastHash)
 
-		lastHeight = block.Height
-
-		return nil
+		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
 
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panic(err)
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, newBlock); err != nil {
+			return err
 		}
 
-		bc.tip = newBlock.Hash
-
-		return nil
+		return setTip(tx, newBlock.Hash, newBlock.Height)
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	bc.tip = newBlock.Hash
 
-	return newBlock
+	return newBlock, nil
 }
 
+// FindTransaction finds a main chain transaction by its ID
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	bci := bc.Iterator()
-	for {
-		block := bci.Next()
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
-
-		// genesis block
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	block, pos, err := bc.findTransactionBlock(ID)
+	if err != nil {
+		return Transaction{}, err
 	}
 
-	return Transaction{}, errors.New("transaction is not found")
+	return *block.Transactions[pos], nil
 }
 
-func (bc *Blockchain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// SignTransaction signs the inputs of a Transaction, looking up the outputs they spend
+func (bc *Blockchain) SignTransaction(tx *Transaction, wallet *Wallet, hashType SigHashType) error {
+	prevTXs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
+	}
 
-	for _, input := range tx.Vin {
-		prevTX, err := bc.FindTransaction(input.TxID)
-		if err != nil {
-			log.Fatal(err)
-		}
-		prevTXs[hex.EncodeToString(input.TxID)] = prevTX
+	return tx.Sign(wallet, prevTXs, hashType)
+}
+
+// VerifyTransaction verifies the input signatures of a Transaction spending outputs of the UTXO set
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
 	}
 
-	tx.Sign(privateKey, prevTXs)
+	return bc.verifyTransactions([]*Transaction{tx})
 }
 
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+// findPrevTransactions finds the transactions referenced by the inputs of tx
+func (bc *Blockchain) findPrevTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
-	for _, input := range tx.Vin {
+	for inID, input := range tx.Vin {
 		prevTX, err := bc.FindTransaction(input.TxID)
 		if err != nil {
-			log.Fatal(err)
+			// the block may be pruned, and the unspent outputs are enough to sign
+			prevTX, err = UTXOSet{bc}.transaction(input.TxID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w: %x", inID, ErrMissingPrevTx, input.TxID)
 		}
 		prevTXs[hex.EncodeToString(input.TxID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	return prevTXs, nil
 }
 
 func dbExists(dbFile string) bool {
@@ -369,37 +344,38 @@ func dbExists(dbFile string) bool {
 
 // GetBestHeight returns the height of the latest block
 func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+	if entry, ok := bc.headers.Get(bc.tip); ok && bc.tip != nil {
+		return entry.height
+	}
 
-	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+	var lastHeight int
 
-		return nil
+	err := bc.store.View(func(tx StoreTx) error {
+		lastHash := tx.Tip()
+
+		var err error
+		_, lastHeight, err = bc.readHeader(tx, lastHash)
+
+		return err
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return lastBlock.Height
+	return lastHeight
 }
 
 // GetBlock finds a block by its hash and returns it
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-
-		blockData := b.Get(blockHash)
-
-		if blockData == nil {
-			return errors.New("Block is not found.")
+	err := bc.store.View(func(tx StoreTx) error {
+		b, err := bc.readBlock(tx, blockHash)
+		if err != nil {
+			return err
 		}
 
-		block = *DeserializeBlock(blockData)
+		block = *b
 
 		return nil
 	})
@@ -410,20 +386,32 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes returns a list of hashes of all the blocks in the chain
-func (bc *Blockchain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-	bci := bc.Iterator()
+// readBlock reads a stored block through the block cache. The block is shared with
+// the cache and must not be modified.
+func (bc *Blockchain) readBlock(tx StoreTx, hash []byte) (*Block, error) {
+	if block, ok := bc.blocks.Get(hash); ok {
+		return block, nil
+	}
 
-	for {
-		block := bci.Next()
+	block, err := getBlock(tx, hash)
+	if err != nil {
+		return nil, err
+	}
+	bc.blocks.Add(hash, block)
+
+	return block, nil
+}
 
-		blocks = append(blocks, block.Hash)
+// GetBlockHashes returns a list of hashes of all the blocks in the chain, latest first
+func (bc *Blockchain) GetBlockHashes() [][]byte {
+	hashes, err := bc.GetBlockHashRange(0, bc.GetBestHeight())
+	if err != nil {
+		log.Panic(err)
+	}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
 	}
 
-	return blocks
+	return hashes
 }
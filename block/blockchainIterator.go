@@ -1,20 +1,24 @@
 package block
 
-import "github.com/boltdb/bolt"
-
 type BlockchainIterator struct {
-	currentHash []byte   // current block's hash
-	db          *bolt.DB // the whole blockchain
+	currentHash []byte      // current block's hash
+	bc          *Blockchain // the whole blockchain
 }
 
+// Next returns the current block and moves to its parent. It returns nil when the
+// body of the block is not stored, as below the pruned height. The block may be
+// shared with the block cache and must not be modified.
 func (bi *BlockchainIterator) Next() *Block {
-	var block *Block
-	_ = bi.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		data := b.Get(bi.currentHash)
-		block = DeserializeBlock(data)
+	block, ok := bi.bc.blocks.Get(bi.currentHash)
+	if !ok {
+		_ = bi.bc.store.View(func(tx StoreTx) error {
+			block, _ = bi.bc.readBlock(tx, bi.currentHash)
+			return nil
+		})
+	}
+	if block == nil {
 		return nil
-	})
+	}
 
 	bi.currentHash = block.PrevBlockHash // reverse order (from new to old blocks)
 
@@ -0,0 +1,169 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Limits from BIP37, bounding the work a peer can make a node do per transaction
+const (
+	maxBloomFilterSize = 36000 // bytes
+	maxBloomHashFuncs  = 50
+	maxFilterAddSize   = 520 // bytes
+)
+
+// BloomUpdate tells a filter what to add when a transaction output matches
+type BloomUpdate byte
+
+const (
+	BloomUpdateNone BloomUpdate = 0 // the filter is never changed by matches
+	BloomUpdateAll  BloomUpdate = 1 // the outpoint of a matched output is added, so that its spend matches too
+)
+
+var ErrInvalidFilter = errors.New("invalid bloom filter")
+
+// BloomFilter is a BIP37 filter a light client loads into a peer. The peer only
+// relays the transactions matching it, and since a filter also matches unrelated
+// data with a chosen probability, it does not reveal exactly which keys the client
+// owns.
+type BloomFilter struct {
+	Bits      []byte
+	HashFuncs uint32
+	Tweak     uint32
+	Flags     BloomUpdate
+}
+
+// NewBloomFilter sizes a filter for the given number of elements and false positive
+// rate, within the BIP37 limits
+func NewBloomFilter(elements int, fpRate float64, tweak uint32, flags BloomUpdate) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	size = max(1, min(size, maxBloomFilterSize))
+
+	hashFuncs := int(float64(size*8) / float64(elements) * math.Ln2)
+	hashFuncs = max(1, min(hashFuncs, maxBloomHashFuncs))
+
+	return &BloomFilter{make([]byte, size), uint32(hashFuncs), tweak, flags}
+}
+
+// Validate checks that a filter received from a peer is within the BIP37 limits
+func (f *BloomFilter) Validate() error {
+	if len(f.Bits) == 0 || len(f.Bits) > maxBloomFilterSize || f.HashFuncs == 0 || f.HashFuncs > maxBloomHashFuncs {
+		return ErrInvalidFilter
+	}
+	if f.Flags != BloomUpdateNone && f.Flags != BloomUpdateAll {
+		return ErrInvalidFilter
+	}
+
+	return nil
+}
+
+// bitIndex returns the bit set by the n-th hash function for data
+func (f *BloomFilter) bitIndex(n uint32, data []byte) uint32 {
+	return murmur3(n*0xFBA4C795+f.Tweak, data) % uint32(len(f.Bits)*8)
+}
+
+// Add inserts data into the filter
+func (f *BloomFilter) Add(data []byte) {
+	for n := uint32(0); n < f.HashFuncs; n++ {
+		i := f.bitIndex(n, data)
+		f.Bits[i>>3] |= 1 << (i & 7)
+	}
+}
+
+// Contains reports whether data may have been added to the filter
+func (f *BloomFilter) Contains(data []byte) bool {
+	for n := uint32(0); n < f.HashFuncs; n++ {
+		i := f.bitIndex(n, data)
+		if f.Bits[i>>3]&(1<<(i&7)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// outpointKey is the form an outpoint takes in a filter: the transaction ID followed
+// by the output index as a little-endian 32-bit integer
+func outpointKey(txID []byte, vout int) []byte {
+	key := make([]byte, len(txID)+4)
+	copy(key, txID)
+	binary.LittleEndian.PutUint32(key[len(txID):], uint32(vout))
+
+	return key
+}
+
+// MatchTransaction reports whether tx is relevant to the filter: its ID, the key hash
+// of one of its outputs, an outpoint it spends, or the public key or signature of one
+// of its inputs was added. With BloomUpdateAll, matched outputs are added to the filter.
+func (f *BloomFilter) MatchTransaction(tx *Transaction) bool {
+	matched := f.Contains(tx.ID)
+
+	for i := range tx.Vout {
+		if len(tx.Vout[i].PubKeyHash) > 0 && f.Contains(tx.Vout[i].PubKeyHash) {
+			matched = true
+			if f.Flags == BloomUpdateAll {
+				f.Add(outpointKey(tx.ID, i))
+			}
+		}
+	}
+	if matched || tx.IsCoinbase() {
+		return matched
+	}
+
+	for _, in := range tx.Vin {
+		if f.Contains(outpointKey(in.TxID, in.Vout)) || f.Contains(in.PubKey) || f.Contains(in.Signature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// murmur3 is the 32-bit MurmurHash3 used by BIP37
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
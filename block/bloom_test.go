@@ -0,0 +1,109 @@
+package block
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from Bitcoin Core
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		seed   uint32
+		data   string
+		expect uint32
+	}{
+		{0x00000000, "", 0x00000000},
+		{0xFBA4C795, "", 0x6a396f08},
+		{0xffffffff, "", 0x81f16f39},
+		{0x00000000, "00", 0x514e28b7},
+		{0xFBA4C795, "00", 0xea3f0b17},
+		{0x00000000, "ff", 0xfd6cf10d},
+		{0x00000000, "0011", 0x16c6b7ab},
+		{0x00000000, "001122", 0x8eb51c3d},
+		{0x00000000, "00112233", 0xb4471bf8},
+		{0x00000000, "0011223344", 0xe2301fa8},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+		if h := murmur3(test.seed, data); h != test.expect {
+			t.Errorf("murmur3(%08x, %s) = %08x, want %08x", test.seed, test.data, h, test.expect)
+		}
+	}
+}
+
+// Same filter as the bloom_create_insert_serialize test of Bitcoin Core
+func TestBloomFilterBIP37(t *testing.T) {
+	filter := NewBloomFilter(3, 0.01, 0, BloomUpdateAll)
+
+	for _, element := range []string{
+		"99108ad8ed9bb6274d3980bab5a85c048f0950c8",
+		"b5a2c786d9ef4658287ced5914b37a1b4aa32eee",
+		"b9300670b4c5366e95b2699e8b18bc75e5f729c5",
+	} {
+		data, _ := hex.DecodeString(element)
+		filter.Add(data)
+		if !filter.Contains(data) {
+			t.Fatalf("%s not in filter after Add", element)
+		}
+	}
+
+	if bits := hex.EncodeToString(filter.Bits); bits != "614e9b" || filter.HashFuncs != 5 {
+		t.Fatalf("filter %s with %d hash functions", bits, filter.HashFuncs)
+	}
+
+	other, _ := hex.DecodeString("19108ad8ed9bb6274d3980bab5a85c048f0950c8")
+	if filter.Contains(other) {
+		t.Fatal("unexpected match")
+	}
+}
+
+func TestBloomFilterMatchTransaction(t *testing.T) {
+	owner, other := NewWallet(), NewWallet()
+	funding := NewCoinbaseTX(string(owner.GetAddress()), "funding")
+	spend := &Transaction{nil, []TXInput{{funding.ID, 0, []byte{1, 2, 3}, other.PublicKey}}, []TXOutput{*NewTXOutput(1, string(other.GetAddress()))}, txVersion}
+	spend.ID = spend.Hash()
+	unrelated := NewCoinbaseTX(string(other.GetAddress()), "unrelated")
+
+	filter := NewBloomFilter(10, 0.0001, 7, BloomUpdateAll)
+	filter.Add(HashPubKey(owner.PublicKey))
+
+	if filter.MatchTransaction(spend) {
+		t.Fatal("spend matched before its funding transaction")
+	}
+	if !filter.MatchTransaction(funding) {
+		t.Fatal("funding transaction did not match")
+	}
+	// the matched output was added, so the transaction spending it matches now
+	if !filter.MatchTransaction(spend) {
+		t.Fatal("spend did not match")
+	}
+	if filter.MatchTransaction(unrelated) {
+		t.Fatal("unrelated transaction matched")
+	}
+
+	none := NewBloomFilter(10, 0.0001, 7, BloomUpdateNone)
+	none.Add(HashPubKey(owner.PublicKey))
+	if !none.MatchTransaction(funding) || none.MatchTransaction(spend) {
+		t.Fatal("a BloomUpdateNone filter changed")
+	}
+}
+
+func TestBloomFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter BloomFilter
+		valid  bool
+	}{
+		{*NewBloomFilter(100, 0.001, 0, BloomUpdateAll), true},
+		{BloomFilter{nil, 1, 0, BloomUpdateNone}, false},
+		{BloomFilter{make([]byte, maxBloomFilterSize+1), 1, 0, BloomUpdateNone}, false},
+		{BloomFilter{make([]byte, 10), maxBloomHashFuncs + 1, 0, BloomUpdateNone}, false},
+		{BloomFilter{make([]byte, 10), 3, 0, 7}, false},
+	}
+
+	for i, test := range tests {
+		if err := test.filter.Validate(); (err == nil) != test.valid {
+			t.Errorf("filter %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bootstrapMagic starts every record of a bootstrap file
+var bootstrapMagic = []byte{0xB1, 'B', 'L', 'K'}
+
+// maxBootstrapRecord bounds the length of a record, as the decoder bounds lengths
+const maxBootstrapRecord = 1 << 24
+
+var (
+	ErrBadBootstrap    = errors.New("corrupt bootstrap record")
+	ErrNotConnectable  = errors.New("block does not extend the main chain")
+	ErrBootstrapPruned = errors.New("cannot export pruned blocks")
+)
+
+// ExportChain writes the main chain blocks from height from to height to included
+// to w, lowest first. A negative to stops at the tip. Every block is framed as
+//
+//	magic (4 bytes) | length (4 bytes, big-endian) | checksum (4 bytes) | block
+//
+// where the block is in the canonical encoding and the checksum is the first bytes
+// of its double SHA-256. It returns the number of blocks written.
+func (bc *Blockchain) ExportChain(w io.Writer, from, to int) (int, error) {
+	if to < 0 {
+		to = bc.GetBestHeight()
+	}
+	hashes, err := bc.GetBlockHashRange(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	for i, hash := range hashes {
+		block, err := bc.GetBlock(hash)
+		if errors.Is(err, ErrBlockPruned) {
+			return i, fmt.Errorf("%w: height %d", ErrBootstrapPruned, from+i)
+		}
+		if err != nil {
+			return i, err
+		}
+
+		if err := writeBootstrapRecord(bw, block.Serialize()); err != nil {
+			return i, err
+		}
+	}
+
+	return len(hashes), bw.Flush()
+}
+
+func writeBootstrapRecord(w io.Writer, data []byte) error {
+	header := make([]byte, 0, 12)
+	header = append(header, bootstrapMagic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+	header = append(header, checksum(data)...)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readBootstrapRecord reads the next block of a bootstrap file, io.EOF after the last one
+func readBootstrapRecord(r io.Reader) (*Block, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: truncated header", ErrBadBootstrap)
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], bootstrapMagic) {
+		return nil, fmt.Errorf("%w: bad magic %x", ErrBadBootstrap, header[:4])
+	}
+
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > maxBootstrapRecord {
+		return nil, fmt.Errorf("%w: length %d", ErrBadBootstrap, length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: truncated block", ErrBadBootstrap)
+	}
+	if !bytes.Equal(checksum(data), header[8:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBadBootstrap)
+	}
+
+	block, err := DecodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadBootstrap, err)
+	}
+
+	return block, nil
+}
+
+// ImportChain reads a file written by ExportChain and connects its blocks to the
+// main chain, checking their proof of work, their link to the tip and their input
+// signatures. Each block is stored with the tip and the UTXO set in a single
+// transaction, so an interrupted import is resumed by importing the file again:
+// blocks already on the main chain are skipped. progress, when not nil, is called
+// with the height of every block connected. It returns the number of blocks connected.
+func (bc *Blockchain) ImportChain(r io.Reader, progress func(height int)) (int, error) {
+	br := bufio.NewReader(r)
+	imported := 0
+
+	for {
+		block, err := readBootstrapRecord(br)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		connected, err := bc.importBlock(block)
+		if err != nil {
+			return imported, err
+		}
+		if connected {
+			imported++
+			if progress != nil {
+				progress(block.Height)
+			}
+		}
+	}
+}
+
+// importBlock connects block on top of the tip. It returns false for a block already
+// on the main chain.
+func (bc *Blockchain) importBlock(block *Block) (bool, error) {
+	if !NewProofOfWork(&block.BlockHeader).Validate() {
+		return false, fmt.Errorf("%w: %x", ErrInvalidPoW, block.Hash)
+	}
+
+	tipHeight := -1
+	onMain := false
+	err := bc.store.View(func(tx StoreTx) error {
+		if tip := tx.Tip(); tip != nil {
+			_, height, err := getHeader(tx, tip)
+			if err != nil {
+				return err
+			}
+			tipHeight = height
+		}
+
+		hash, err := getHashAtHeight(tx, block.Height)
+		onMain = err == nil && bytes.Equal(hash, block.Hash)
+		return nil
+	})
+	if err != nil || onMain {
+		return false, err
+	}
+
+	if block.Height != tipHeight+1 || !bytes.Equal(block.PrevBlockHash, bc.tip) {
+		return false, fmt.Errorf("%w: block %x at height %d, next height %d", ErrNotConnectable, block.Hash, block.Height, tipHeight+1)
+	}
+	if err := bc.VerifyBlock(block); err != nil {
+		return false, fmt.Errorf("block %x: %w", block.Hash, err)
+	}
+
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := putBlock(tx, block); err != nil {
+			return err
+		}
+		return setTip(tx, block.Hash, block.Height)
+	})
+	if err != nil {
+		return false, err
+	}
+	bc.tip = block.Hash
+
+	return true, nil
+}
@@ -0,0 +1,129 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testdata/chain.dat holds a mined chain of three blocks: a genesis block and two
+// blocks each paying between the two addresses of the chain
+func readTestChain(t *testing.T) []byte {
+	data, err := os.ReadFile("testdata/chain.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestImportChain(t *testing.T) {
+	data := readTestChain(t)
+
+	bc := newTestChain(t)
+	var heights []int
+	imported, err := bc.ImportChain(bytes.NewReader(data), func(height int) {
+		heights = append(heights, height)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 3 || !reflect.DeepEqual(heights, []int{0, 1, 2}) || bc.GetBestHeight() != 2 {
+		t.Fatalf("imported %d blocks at heights %v, tip at %d", imported, heights, bc.GetBestHeight())
+	}
+	if got, want := utxoValues(t, bc), chainUTXOValues(bc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after the import %v, want %v", got, want)
+	}
+
+	// exporting the imported chain gives back the same file
+	var exported bytes.Buffer
+	if count, err := bc.ExportChain(&exported, 0, -1); err != nil || count != 3 {
+		t.Fatalf("exported %d blocks: %v", count, err)
+	}
+	if !bytes.Equal(exported.Bytes(), data) {
+		t.Fatal("the export differs from the imported file")
+	}
+
+	exported.Reset()
+	if count, err := bc.ExportChain(&exported, 1, 1); err != nil || count != 1 {
+		t.Fatalf("exported %d blocks from height 1 to 1: %v", count, err)
+	}
+	block, err := readBootstrapRecord(&exported)
+	if err != nil || block.Height != 1 {
+		t.Fatalf("read block at height %d: %v", block.Height, err)
+	}
+	if _, err := readBootstrapRecord(&exported); err != io.EOF {
+		t.Fatalf("reading after the last block returned %v", err)
+	}
+}
+
+func TestImportChainResumes(t *testing.T) {
+	data := readTestChain(t)
+
+	bc := newTestChain(t)
+	imported, err := bc.ImportChain(bytes.NewReader(data[:len(data)-10]), nil)
+	if !errors.Is(err, ErrBadBootstrap) || imported != 2 {
+		t.Fatalf("imported %d blocks of a truncated file: %v", imported, err)
+	}
+
+	imported, err = bc.ImportChain(bytes.NewReader(data), nil)
+	if err != nil || imported != 1 || bc.GetBestHeight() != 2 {
+		t.Fatalf("resuming imported %d blocks to height %d: %v", imported, bc.GetBestHeight(), err)
+	}
+	if got, want := utxoValues(t, bc), chainUTXOValues(bc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after resuming %v, want %v", got, want)
+	}
+}
+
+func TestImportChainRejects(t *testing.T) {
+	data := readTestChain(t)
+	first := 12 + int(binary.BigEndian.Uint32(data[4:8]))
+
+	corrupt := append([]byte{}, data...)
+	corrupt[first-1] ^= 1
+
+	var unmined bytes.Buffer
+	if err := writeBootstrapRecord(&unmined, testBlock([]byte{}, 0, "").Serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"checksum", corrupt, ErrBadBootstrap},
+		{"magic", append([]byte("junk"), data[4:]...), ErrBadBootstrap},
+		{"proof of work", unmined.Bytes(), ErrInvalidPoW},
+		{"gap", data[first:], ErrNotConnectable},
+	}
+
+	for _, test := range tests {
+		bc := newTestChain(t)
+		if _, err := bc.ImportChain(bytes.NewReader(test.data), nil); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if bc.tip != nil {
+			t.Errorf("%s: a block was connected", test.name)
+		}
+	}
+}
+
+func TestExportPrunedChain(t *testing.T) {
+	bc := newTestChain(t)
+	storeTestChain(t, bc, 20)
+	if _, err := bc.Prune(PruneTarget{Blocks: minPruneBlocks}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bc.ExportChain(io.Discard, 0, -1); !errors.Is(err, ErrBootstrapPruned) {
+		t.Fatalf("exporting pruned blocks returned %v", err)
+	}
+	if count, err := bc.ExportChain(io.Discard, 10, -1); err != nil || count != 10 {
+		t.Fatalf("exported %d unpruned blocks: %v", count, err)
+	}
+}
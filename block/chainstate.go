@@ -0,0 +1,132 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// utxoTipKey is the meta key of the block the UTXO set was last brought to. It is
+// written in the transaction that changes the UTXO set, so it differs from the tip
+// only when an operation was interrupted, and the chain state is then recovered on
+// startup. Databases written before it are given one by migrateChainState.
+const utxoTipKey = "utxotip"
+
+// getUTXOTip returns the hash of the block the UTXO set is at, nil when it is unknown
+func getUTXOTip(tx StoreTx) []byte {
+	hash := tx.Index(metaBucket).Get([]byte(utxoTipKey))
+	if hash == nil {
+		return nil
+	}
+
+	return append([]byte{}, hash...)
+}
+
+// syncUTXO brings the UTXO set from the block from, nil for an empty set, to the tip.
+// The blocks of the branch of from are disconnected with their undo data down to the
+// last block it shares with the main chain, then the main chain blocks above it are
+// connected, each checked by verify first when it is not nil. The height index must
+// already lead to the tip.
+func syncUTXO(tx StoreTx, from []byte, verify blockVerifier) error {
+	tip := tx.Tip()
+	_, tipHeight, err := getHeader(tx, tip)
+	if err != nil {
+		return err
+	}
+
+	forkHeight := -1
+	for hash := from; len(hash) > 0; {
+		header, height, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		if onMain, err := getHashAtHeight(tx, height); err == nil && bytes.Equal(onMain, hash) {
+			forkHeight = height
+			break
+		}
+
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		if err := disconnectUTXO(tx, block); err != nil {
+			return err
+		}
+		hash = header.PrevBlockHash
+	}
+
+	for height := forkHeight + 1; height <= tipHeight; height++ {
+		hash, err := getHashAtHeight(tx, height)
+		if err != nil {
+			return err
+		}
+		block, err := getBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		if verify != nil {
+			if err := verify(tx, block); err != nil {
+				return err
+			}
+		}
+		if err := connectUTXO(tx, block); err != nil {
+			return err
+		}
+	}
+
+	return tx.Index(metaBucket).Put([]byte(utxoTipKey), tip)
+}
+
+// rebuildUTXO replaces the UTXO set and its undo data by connecting every main chain
+// block from genesis, which needs all of them
+func rebuildUTXO(tx StoreTx) error {
+	if err := tx.ClearUTXO(); err != nil {
+		return err
+	}
+	if err := tx.DeleteIndex(undoIndex); err != nil {
+		return err
+	}
+	if err := tx.Index(metaBucket).Delete([]byte(utxoTipKey)); err != nil {
+		return err
+	}
+	if tx.Tip() == nil {
+		return nil
+	}
+
+	return syncUTXO(tx, nil, nil)
+}
+
+// recoverChainState brings the UTXO set to the tip when they differ on startup. A
+// chain whose UTXO set was never written, as when a new chain stopped before its
+// cached chain state was, has it rebuilt.
+func recoverChainState(tx StoreTx) error {
+	tip := tx.Tip()
+	utxoTip := getUTXOTip(tx)
+	if tip == nil || bytes.Equal(utxoTip, tip) {
+		return nil
+	}
+	if utxoTip == nil {
+		return migrateChainState(tx)
+	}
+
+	if err := syncUTXO(tx, utxoTip, nil); err != nil {
+		return fmt.Errorf("recovering the UTXO set at %x: %w", utxoTip, err)
+	}
+
+	return nil
+}
+
+// migrateChainState records the block the UTXO set of a database written before the
+// marker is at. Its UTXO set is rebuilt from the blocks, with their undo data, unless
+// some are pruned or were never downloaded, in which case it is trusted.
+func migrateChainState(tx StoreTx) error {
+	tip := tx.Tip()
+	if tip == nil || getUTXOTip(tx) != nil {
+		return nil
+	}
+
+	if _, _, _, pending := getSnapshotState(tx); pending || getPrunedHeight(tx) > 0 {
+		return tx.Index(metaBucket).Put([]byte(utxoTipKey), tip)
+	}
+
+	return rebuildUTXO(tx)
+}
@@ -0,0 +1,120 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConnectBlockIsAtomic(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+	before := utxoValues(t, bc)
+
+	// without the undo data of the old tip the longer branch cannot be connected
+	err := bc.store.Update(func(tx StoreTx) error {
+		return tx.Index(undoIndex).Delete(blocks[2].Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := testBlock(blocks[1].Hash, 2, "fork")
+	next := testBlock(fork.Hash, 3, "fork")
+	err = bc.store.Update(func(tx StoreTx) error {
+		for _, block := range []*Block{fork, next} {
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+		}
+		return setTip(tx, next.Hash, 3)
+	})
+	if !errors.Is(err, ErrNoUndoData) {
+		t.Fatalf("switching to the branch returned %v", err)
+	}
+
+	reopened, err := OpenBlockchain(bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.tip, blocks[2].Hash) {
+		t.Fatalf("tip %x, want the old tip %x", reopened.tip, blocks[2].Hash)
+	}
+	if _, err := reopened.GetBlock(fork.Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("the branch was stored: %v", err)
+	}
+	if got := utxoValues(t, reopened); !reflect.DeepEqual(got, before) {
+		t.Fatalf("UTXO set %v, want %v", got, before)
+	}
+}
+
+func TestOpenBlockchainRecoversChainState(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+	want := utxoValues(t, bc)
+
+	// the UTXO set was left on a block of a branch that is not the main chain
+	side := testBlock(blocks[0].Hash, 1, "side")
+	err := bc.store.Update(func(tx StoreTx) error {
+		for _, block := range []*Block{blocks[2], blocks[1]} {
+			if err := disconnectUTXO(tx, block); err != nil {
+				return err
+			}
+		}
+		if err := putBlock(tx, side); err != nil {
+			return err
+		}
+		if err := connectUTXO(tx, side); err != nil {
+			return err
+		}
+		return tx.Index(metaBucket).Put([]byte(utxoTipKey), side.Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenBlockchain(bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := utxoValues(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after recovering from a branch %v, want %v", got, want)
+	}
+
+	// a database written before the marker has its UTXO set rebuilt
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := tx.Index(metaBucket).Put([]byte(schemaVersionKey), encodeSchemaVersion(3)); err != nil {
+			return err
+		}
+		if err := tx.ClearUTXO(); err != nil {
+			return err
+		}
+		if err := tx.DeleteIndex(undoIndex); err != nil {
+			return err
+		}
+		return tx.Index(metaBucket).Delete([]byte(utxoTipKey))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err = OpenBlockchain(bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := utxoValues(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after rebuilding %v, want %v", got, want)
+	}
+	err = bc.store.View(func(tx StoreTx) error {
+		if !bytes.Equal(getUTXOTip(tx), blocks[2].Hash) {
+			t.Errorf("the UTXO set is at %x, want the tip", getUTXOTip(tx))
+		}
+		if tx.Index(undoIndex).Get(blocks[2].Hash) == nil {
+			t.Error("the undo data was not rebuilt")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"strings"
 
 	"os"
 )
@@ -13,14 +14,36 @@ type CLI struct{}
 
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
+	fmt.Println("  addnode -node ADDRESS - Make the running node keep a connection to ADDRESS, reconnecting when it drops")
+	fmt.Println("  connect -node ADDRESS - Make the running node connect to ADDRESS once")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
-	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
+	fmt.Println("  createwallet -scheme SCHEME - Generates a new key-pair and saves it into the wallet file. SCHEME is p256 (default), secp256k1 or schnorr")
+	fmt.Println("  disconnect -node ADDRESS - Make the running node disconnect from ADDRESS and stop keeping it connected. It may connect to it again like to any address it knows")
+	fmt.Println("  dumputxo -file FILE -height HEIGHT - Write the UTXO set at HEIGHT (default the tip) and its hash to a snapshot FILE")
+	fmt.Println("  exportchain -file FILE -from HEIGHT -to HEIGHT - Write the main chain blocks from HEIGHT to HEIGHT (default the tip) to a bootstrap FILE")
 	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getblock -height HEIGHT - Print the block of the main chain at HEIGHT")
+	fmt.Println("  getpeerinfo - List the peers of the running node")
+	fmt.Println("  gettransaction -txid TXID - Print transaction TXID and the block containing it, using the transaction index")
+	fmt.Println("  gettxproof -txid TXID - Print a proof that transaction TXID is included in a block")
+	fmt.Println("  history -address ADDRESS -skip N -count N - List the transactions of ADDRESS, latest first, using the address index")
+	fmt.Println("  importchain -file FILE - Check and connect the blocks of a bootstrap FILE written by exportchain. Run it again to resume an interrupted import")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  loadutxo -file FILE - Initialize a node without a chain from a snapshot FILE written by dumputxo. Older blocks are validated in the background by startnode")
+	fmt.Println("  migratedb - Upgrades the database to the latest schema, rewriting chain data stored in the legacy gob encoding in the canonical binary format. Other commands upgrade it too")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  reindexaddr - Builds the address index and keeps it up to date from then on")
+	fmt.Println("  reindextx - Builds the transaction index and keeps it up to date from then on")
+	fmt.Println("  reindexutxo - Rebuilds the UTXO set and prints its hash")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine -sighash TYPE -node ADDRESS - Send AMOUNT of coins from FROM address to TO through the node at ADDRESS. Mine on the same node, when -mine is set. Sign with TYPE (ALL, NONE, SINGLE, optionally |ANYONECANPAY).")
+	fmt.Println("  spvbalance -address ADDRESS - Get balance of ADDRESS from the transactions proven to the light client")
+	fmt.Println("  spvsync -peer ADDRESS - Sync block headers and proofs of the wallet's transactions from the full node at ADDRESS, without storing the chain")
+	fmt.Println("  startnode -miner ADDRESS -prune TARGET -maxinbound N -maxoutbound N -addnode ADDRESSES -connect ADDRESSES - Start a node with ID specified in NODE_ID env. var. -miner enables mining. -prune deletes old blocks, keeping TARGET blocks or megabytes (such as 550MB). The node accepts up to -maxinbound peers and connects to up to -maxoutbound peers of its address book, always keeping the comma-separated -addnode peers, or only the -connect peers when set")
+	fmt.Println("  verifychain -level LEVEL -depth DEPTH -repair - Check the last DEPTH blocks (0 for all) of the main chain at LEVEL: 0 stored data, 1 proof of work, Merkle roots and links, 2 the UTXO set, 3 signatures. -repair rebuilds the data derived from the blocks")
+	fmt.Println("  verifytxproof -txid TXID -proof PROOF - Check a proof printed by gettxproof, without a blockchain")
+	fmt.Println("Commands use the network named by the NETWORK env. var., main (default) or test. A database of another network is refused.")
+	fmt.Println("addnode, connect, disconnect and getpeerinfo talk to the node with ID specified in NODE_ID env. var. running on this machine, over one of its inbound connections. They send the token of the cookie file the node writes when it starts, readable only by its user.")
+	fmt.Println("Every command but verifytxproof takes -datadir DIR, by default the DATADIR env. var., to keep the chain, wallet, peers and light client files of the node in DIR rather than in the working directory. One process at a time uses the databases of a node, createwallet and listaddresses also work while it runs.")
 }
 
 func (cli *CLI) validateArgs() {
@@ -41,29 +64,138 @@ func (cli *CLI) Run() {
 		nodeID = "1"
 	}
 
+	network, err := ParseNetwork(os.Getenv("NETWORK"))
+	if err != nil {
+		log.Panic(err)
+	}
+	SetNetwork(network)
+
+	addNodeCmd := flag.NewFlagSet("addnode", flag.ExitOnError)
+	connectCmd := flag.NewFlagSet("connect", flag.ExitOnError)
+	disconnectCmd := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	reindexAddrCmd := flag.NewFlagSet("reindexaddr", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	spvBalanceCmd := flag.NewFlagSet("spvbalance", flag.ExitOnError)
+	spvSyncCmd := flag.NewFlagSet("spvsync", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	verifyTxProofCmd := flag.NewFlagSet("verifytxproof", flag.ExitOnError)
 
+	var dataDirFlag string
+	for _, cmd := range []*flag.FlagSet{dumpUTXOCmd, exportChainCmd, getBalanceCmd, getBlockCmd, getTransactionCmd, getTxProofCmd,
+		createBlockchainCmd, createWalletCmd, historyCmd, importChainCmd, listAddressesCmd, loadUTXOCmd, migrateDBCmd, printChainCmd,
+		reindexAddrCmd, reindexTxCmd, reindexUTXOCmd, sendCmd, spvBalanceCmd, spvSyncCmd, startNodeCmd, verifyChainCmd,
+		addNodeCmd, connectCmd, disconnectCmd, getPeerInfoCmd} {
+		cmd.StringVar(&dataDirFlag, "datadir", os.Getenv("DATADIR"), "Directory of the node files, the working directory by default")
+	}
+
+	addNodeCmd.String("node", "", "Address of the peer to keep connected")
+	connectCmd.String("node", "", "Address of the peer to connect to")
+	disconnectCmd.String("node", "", "Address of the peer to disconnect")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "The snapshot file to write")
+	dumpUTXOHeight := dumpUTXOCmd.Int("height", -1, "Height of the UTXO set, the tip by default")
+	exportChainFile := exportChainCmd.String("file", "", "The bootstrap file to write")
+	exportChainFrom := exportChainCmd.Int("from", 0, "Height of the first block to export")
+	exportChainTo := exportChainCmd.Int("to", -1, "Height of the last block to export, the tip by default")
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block")
+	getTransactionID := getTransactionCmd.String("txid", "", "ID of the transaction")
+	getTxProofID := getTxProofCmd.String("txid", "", "ID of the transaction to prove")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createWalletScheme := createWalletCmd.String("scheme", "p256", "Signature scheme of the new key: p256, secp256k1 or schnorr")
+	historyAddress := historyCmd.String("address", "", "The address to list the transactions of")
+	historySkip := historyCmd.Int("skip", 0, "Number of latest transactions to skip")
+	historyCount := historyCmd.Int("count", 20, "Maximum number of transactions to list")
+	importChainFile := importChainCmd.String("file", "", "The bootstrap file to import")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "The snapshot file to load")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendSigHash := sendCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE, SINGLE, optionally combined with |ANYONECANPAY")
+	sendNode := sendCmd.String("node", defaultSeeds[0], "Address of the node to send the transaction to")
+	spvBalanceAddress := spvBalanceCmd.String("address", "", "The address to get balance for")
+	spvSyncPeer := spvSyncCmd.String("peer", defaultSeeds[0], "Address of the full node to sync from")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodePrune := startNodeCmd.String("prune", "", "Keep only the last N blocks, or the last blocks fitting in a size such as 550MB")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", defaultMaxInbound, "Maximum number of peers connecting to the node")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", defaultMaxOutbound, "Maximum number of peers of the address book the node connects to")
+	startNodeAddNodes := startNodeCmd.String("addnode", "", "Comma-separated addresses of peers to stay connected to")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma-separated addresses of the only peers to connect to")
+	verifyChainLevel := verifyChainCmd.Int("level", VerifySignatures, "How thorough the checks are, from 0 to 3")
+	verifyChainDepth := verifyChainCmd.Int("depth", 6, "Number of blocks to check from the tip, 0 for the whole chain")
+	verifyChainRepair := verifyChainCmd.Bool("repair", false, "Rebuild the data derived from the blocks when inconsistencies are found")
+	verifyTxProofID := verifyTxProofCmd.String("txid", "", "ID of the transaction the proof is for")
+	verifyTxProofData := verifyTxProofCmd.String("proof", "", "Proof printed by gettxproof")
 
 	switch os.Args[1] {
+	case "addnode":
+		err := addNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "connect":
+		err := connectCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "disconnect":
+		err := disconnectCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "exportchain":
+		err := exportChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxproof":
+		err := getTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -74,16 +206,46 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "history":
+		err := historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importchain":
+		err := importChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "reindexaddr":
+		err := reindexAddrCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -94,16 +256,86 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "spvbalance":
+		err := spvBalanceCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "spvsync":
+		err := spvSyncCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "startnode":
 		err := startNodeCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifytxproof":
+		err := verifyTxProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
+	// every command but verifytxproof works on the files of the node
+	if !verifyTxProofCmd.Parsed() {
+		if err := SetDataDir(dataDirFlag); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// the commands of a running node go to it, which holds its files
+	nodeCommands := []*flag.FlagSet{addNodeCmd, connectCmd, disconnectCmd, getPeerInfoCmd}
+	for _, cmd := range nodeCommands {
+		if !cmd.Parsed() {
+			continue
+		}
+		var addr string
+		if node := cmd.Lookup("node"); node != nil {
+			if addr = node.Value.String(); addr == "" {
+				cmd.Usage()
+				os.Exit(1)
+			}
+		}
+		cli.nodeCommand(cmd.Name(), addr, nodeID)
+		return
+	}
+
+	// the commands opening the databases of the node hold them alone. The wallet is not
+	// kept open, so a running node does not stop commands using only the wallet.
+	if !verifyTxProofCmd.Parsed() && !createWalletCmd.Parsed() && !listAddressesCmd.Parsed() {
+		unlock, err := LockNode(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer unlock()
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpUTXO(*dumpUTXOFile, *dumpUTXOHeight, nodeID)
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" || *exportChainFrom < 0 {
+			exportChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.exportChain(*exportChainFile, *exportChainFrom, *exportChainTo, nodeID)
+	}
+
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
@@ -112,6 +344,30 @@ func (cli *CLI) Run() {
 		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
+	if getBlockCmd.Parsed() {
+		if *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getBlock(*getBlockHeight, nodeID)
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTransaction(*getTransactionID, nodeID)
+	}
+
+	if getTxProofCmd.Parsed() {
+		if *getTxProofID == "" {
+			getTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTxProof(*getTxProofID, nodeID)
+	}
+
 	if createBlockchainCmd.Parsed() {
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
@@ -121,17 +377,53 @@ func (cli *CLI) Run() {
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(nodeID, *createWalletScheme)
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" || *historySkip < 0 || *historyCount < 1 {
+			historyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.history(*historyAddress, *historySkip, *historyCount, nodeID)
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			importChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.importChain(*importChainFile, nodeID)
 	}
 
 	if listAddressesCmd.Parsed() {
 		cli.listAddresses(nodeID)
 	}
 
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" {
+			loadUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadUTXO(*loadUTXOFile, nodeID)
+	}
+
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB(nodeID)
+	}
+
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
 
+	if reindexAddrCmd.Parsed() {
+		cli.reindexAddr(nodeID)
+	}
+
+	if reindexTxCmd.Parsed() {
+		cli.reindexTx(nodeID)
+	}
+
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
@@ -142,7 +434,19 @@ func (cli *CLI) Run() {
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine, *sendSigHash, *sendNode)
+	}
+
+	if spvBalanceCmd.Parsed() {
+		if *spvBalanceAddress == "" {
+			spvBalanceCmd.Usage()
+			os.Exit(1)
+		}
+		cli.spvBalance(*spvBalanceAddress, nodeID)
+	}
+
+	if spvSyncCmd.Parsed() {
+		cli.spvSync(*spvSyncPeer, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -151,6 +455,44 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		if *startNodeMaxInbound < 0 || *startNodeMaxOutbound < 0 {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		config := PeerConfig{
+			MaxInbound:  *startNodeMaxInbound,
+			MaxOutbound: *startNodeMaxOutbound,
+			AddNodes:    splitAddrs(*startNodeAddNodes),
+			Connect:     splitAddrs(*startNodeConnect),
+		}
+		cli.startNode(nodeID, *startNodeMiner, *startNodePrune, config)
+	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyChainLevel < VerifyStored || *verifyChainLevel > VerifySignatures || *verifyChainDepth < 0 {
+			verifyChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyChain(*verifyChainLevel, *verifyChainDepth, *verifyChainRepair, nodeID)
+	}
+
+	if verifyTxProofCmd.Parsed() {
+		if *verifyTxProofID == "" || *verifyTxProofData == "" {
+			verifyTxProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyTxProof(*verifyTxProofID, *verifyTxProofData)
+	}
+}
+
+// splitAddrs returns the addresses of a comma-separated list
+func splitAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
 	}
+
+	return addrs
 }
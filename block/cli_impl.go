@@ -1,9 +1,13 @@
 package block
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
+	"strings"
 )
 
 func (cli *CLI) getBalance(address, nodeID string) {
@@ -31,20 +35,25 @@ func (cli *CLI) createBlockchain(address, nodeID string) {
 		log.Panic("ERROR: Address is not valid")
 	}
 	bc := CreateBlockchain(address, nodeID)
-	defer bc.db.Close()
-
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.Reindex()
+	defer bc.CloseDB()
 
 	fmt.Println("Done!")
 }
 
-func (cli *CLI) createWallet(nodeID string) {
+func (cli *CLI) createWallet(nodeID, schemeName string) {
+	scheme, err := ParseSigScheme(schemeName)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	wallets, _ := NewWallets(nodeID)
-	address := wallets.CreateWallet()
+	address, err := wallets.CreateWallet(scheme)
+	if err != nil {
+		log.Panic(err)
+	}
 	wallets.SaveToFile(nodeID)
 
-	fmt.Printf("Your new address: %s\n", address)
+	fmt.Printf("Your new %s address: %s\n", scheme, address)
 }
 
 func (cli *CLI) listAddresses(nodeID string) {
@@ -59,6 +68,130 @@ func (cli *CLI) listAddresses(nodeID string) {
 	}
 }
 
+// migrateDB upgrades the database to the latest schema, which every command also
+// does when it opens the chain
+func (cli *CLI) migrateDB(nodeID string) {
+	dbFile := chainFile.path(nodeID)
+	if !dbExists(dbFile) {
+		fmt.Println("No existing blockchain found. Create one first.")
+		os.Exit(1)
+	}
+
+	store, err := OpenBoltStore(dbFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer store.Close()
+
+	from, err := migrateSchema(store)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if from == schemaVersion {
+		fmt.Printf("The database is already at schema version %d.\n", schemaVersion)
+		return
+	}
+	fmt.Printf("Done! Upgraded the database from schema version %d to %d.\n", from, schemaVersion)
+}
+
+func (cli *CLI) exportChain(file string, from, to int, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	f, err := os.Create(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	count, err := bc.ExportChain(f, from, to)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Done! Exported %d blocks to %s.\n", count, file)
+}
+
+// importChain connects the blocks of a bootstrap file, creating the chain when the
+// node has none. Running it again after an interruption resumes the import.
+func (cli *CLI) importChain(file, nodeID string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	store, err := openChainStore(chainFile.path(nodeID))
+	if err != nil {
+		log.Panic(err)
+	}
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer bc.CloseDB()
+
+	count, err := bc.ImportChain(f, func(height int) {
+		if height%100 == 0 {
+			fmt.Printf("Imported block at height %d\n", height)
+		}
+	})
+	if err != nil {
+		fmt.Printf("Imported %d blocks before failing, import again to resume.\n", count)
+		log.Panic(err)
+	}
+	fmt.Printf("Done! Imported %d blocks, the tip is at height %d.\n", count, bc.GetBestHeight())
+}
+
+func (cli *CLI) dumpUTXO(file string, height int, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	if height < 0 {
+		height = bc.GetBestHeight()
+	}
+	snapshot, err := UTXOSet{bc}.Snapshot(height)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := os.WriteFile(file, snapshot.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Done! Wrote the UTXO set of %d transactions at height %d, block %x.\n", len(snapshot.Entries), height, snapshot.BlockHash())
+	fmt.Printf("UTXO hash: %x\n", snapshot.Hash)
+}
+
+// loadUTXO initializes a node without a chain from a UTXO snapshot
+func (cli *CLI) loadUTXO(file, nodeID string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	snapshot, err := DecodeUTXOSnapshot(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	store, err := openChainStore(chainFile.path(nodeID))
+	if err != nil {
+		log.Panic(err)
+	}
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer bc.CloseDB()
+
+	if err := bc.LoadUTXOSnapshot(snapshot); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Done! Loaded the UTXO set of %d transactions at height %d, block %x.\n", len(snapshot.Entries), snapshot.Height, snapshot.BlockHash())
+	fmt.Printf("UTXO hash: %x\n", snapshot.Hash)
+	fmt.Println("The node validates the older blocks in the background once started.")
+}
+
 func (cli *CLI) printChain(nodeID string) {
 	bc := NewBlockchain(nodeID)
 	defer bc.CloseDB()
@@ -67,16 +200,16 @@ func (cli *CLI) printChain(nodeID string) {
 
 	for {
 		block := bci.Next()
-
-		fmt.Printf("============ Block %x ============\n", block.Hash)
-		fmt.Printf("Height: %d\n", block.Height)
-		fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
-		pow := NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+		if block == nil {
+			if height, pending := bc.SnapshotPending(); pending {
+				fmt.Printf("The chain was loaded from a UTXO snapshot at height %d, older blocks are not all downloaded.\n", height)
+			} else {
+				fmt.Printf("Blocks below height %d are pruned.\n", bc.PrunedHeight())
+			}
+			break
 		}
-		fmt.Printf("\n\n")
+
+		printBlock(block)
 
 		if len(block.PrevBlockHash) == 0 {
 			break
@@ -84,16 +217,127 @@ func (cli *CLI) printChain(nodeID string) {
 	}
 }
 
+func (cli *CLI) getBlock(height int, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	block, err := bc.GetBlockByHeight(height)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printBlock(&block)
+}
+
+func printBlock(block *Block) {
+	fmt.Printf("============ Block %x ============\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Prev. block: %x\n", block.PrevBlockHash)
+	pow := NewProofOfWork(&block.BlockHeader)
+	fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Printf("\n\n")
+}
+
 func (cli *CLI) reindexUTXO(nodeID string) {
 	bc := NewBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
 	UTXOSet.Reindex()
 
-	count := UTXOSet.CountTransactions()
+	hash, count, err := UTXOSet.Hash()
+	if err != nil {
+		log.Panic(err)
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+	fmt.Printf("UTXO hash: %x\n", hash)
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CLI) reindexTx(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	count, err := bc.ReindexTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Done! Indexed the transactions of %d blocks.\n", count)
+}
+
+func (cli *CLI) getTransaction(txID, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	tx, loc, err := bc.GetTransaction(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	_, height, err := bc.GetBlockHeader(loc.BlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", loc.BlockHash)
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Position: %d\n", loc.Position)
+	fmt.Printf("Confirmations: %d\n\n", bc.GetBestHeight()-height+1)
+	fmt.Println(&tx)
+}
+
+func (cli *CLI) reindexAddr(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	count, err := bc.ReindexAddresses()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Done! Indexed the addresses of %d blocks.\n", count)
+}
+
+func (cli *CLI) history(address string, skip, count int, nodeID string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	page, total, err := bc.AddressHistory(pubKeyHash, skip, count)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	bestHeight := bc.GetBestHeight()
+
+	fmt.Printf("History of '%s'\n", address)
+	fmt.Printf("Received: %d\n", total.Received)
+	fmt.Printf("Sent: %d\n", total.Sent)
+	fmt.Printf("Net: %d\n\n", total.Net())
+	for _, entry := range page {
+		fmt.Printf("%x height %d, %d confirmations: received %d, sent %d, net %+d\n",
+			entry.TxID, entry.Height, bestHeight-entry.Height+1, entry.Received, entry.Sent, entry.Net())
+	}
+	if len(page) == 0 {
+		fmt.Println("No transactions.")
+	}
+}
+
+func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool, sigHash, node string) {
+	hashType, err := ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
 	if !ValidateAddress(from) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -103,7 +347,7 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 
 	bc := NewBlockchain(nodeID)
 	UTXOSet := UTXOSet{bc}
-	defer bc.db.Close()
+	defer bc.CloseDB()
 
 	wallets, err := NewWallets(nodeID)
 	if err != nil {
@@ -111,22 +355,29 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx := NewUTXOTransaction(&wallet, to, amount, &UTXOSet, hashType)
 
 	if mineNow {
 		cbTx := NewCoinbaseTX(from, "")
 		txs := []*Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		if _, err := bc.MineBlock(txs); err != nil {
+			log.Panic(err)
+		}
 	} else {
-		sendTx(knownNodes[0], tx)
+		sendTx(node, tx)
+		closePeers()
 	}
 
 	fmt.Println("Success!")
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress, prune string, config PeerConfig) {
+	target, err := ParsePruneTarget(prune)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if ValidateAddress(minerAddress) {
@@ -135,5 +386,167 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeID, minerAddress)
+	if target.Enabled() {
+		fmt.Printf("Pruning is on, keeping the last %s of blocks\n", prune)
+	}
+	if len(config.Connect) > 0 {
+		fmt.Printf("Connecting only to %s\n", strings.Join(config.Connect, ", "))
+	}
+	StartServer(nodeID, minerAddress, target, config)
+}
+
+// nodeCommand runs addnode, connect, disconnect or getpeerinfo for addr on the running
+// node with ID nodeID
+func (cli *CLI) nodeCommand(command, addr, nodeID string) {
+	cookie, err := readCookie(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	result, err := runNodeCommand(fmt.Sprintf("localhost:%s", nodeID), command, addr, cookie)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if command != "getpeerinfo" {
+		fmt.Println("Success!")
+		return
+	}
+	for _, info := range result.Peers {
+		direction := "outbound"
+		if info.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("%s %s %s services=%s height=%d features=%s\n", info.Addr, direction, info.UserAgent,
+			info.Services, info.BestHeight, strings.Join(info.Features, ","))
+	}
+	if len(result.Peers) == 0 {
+		fmt.Println("No peers.")
+	}
+}
+
+func (cli *CLI) verifyChain(level, depth int, repair bool, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	issues := reportChainIssues(bc, level, depth)
+	if len(issues) > 0 && repair {
+		fmt.Println("Rebuilding the headers, height index, UTXO set and optional indexes...")
+		if err := bc.RepairChain(); errors.Is(err, ErrBlockNotFound) {
+			fmt.Printf("Partly repaired: %s\n", err)
+		} else if err != nil {
+			log.Panic(err)
+		}
+		issues = reportChainIssues(bc, level, depth)
+	}
+
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+// reportChainIssues verifies the chain and prints the inconsistencies found
+func reportChainIssues(bc *Blockchain, level, depth int) []ChainIssue {
+	issues, err := bc.VerifyChain(level, depth)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if errors.Is(err, ErrUTXONotVerifiable) {
+		fmt.Printf("Skipped: %s\n", err)
+	} else if err != nil {
+		log.Panic(err)
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("No inconsistency found.")
+	} else {
+		fmt.Printf("Found %d inconsistencies.\n", len(issues))
+	}
+
+	return issues
+}
+
+func (cli *CLI) getTxProof(txID, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockchain(nodeID)
+	defer bc.CloseDB()
+
+	proof, err := bc.GetTxProof(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", proof.Header.Hash())
+	fmt.Printf("Merkle root: %x\n", proof.Header.MerkleRoot)
+	fmt.Printf("Proof: %x\n", proof.Serialize())
+}
+
+func (cli *CLI) verifyTxProof(txID, proofData string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+	data, err := hex.DecodeString(proofData)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	proof, err := DecodeTxProof(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := proof.Verify(id); err != nil {
+		fmt.Printf("Invalid proof: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Transaction %s is included in block %x\n", txID, proof.Header.Hash())
+	fmt.Println("Check that this block is on the main chain, for example with the block headers of a light client.")
+}
+
+func (cli *CLI) spvSync(peer, nodeID string) {
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	addresses := wallets.GetAddresses()
+	var pubKeys [][]byte
+	for _, address := range addresses {
+		wallet := wallets.GetWallet(address)
+		pubKeys = append(pubKeys, wallet.PublicKey)
+	}
+
+	lc, err := NewLightClient(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer lc.Close()
+
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	if err := lc.Sync(peer, pubKeys); err != nil {
+		log.Panic(err)
+	}
+
+	for i, address := range addresses {
+		fmt.Printf("Balance of '%s': %d\n", address, lc.Balance(HashPubKey(pubKeys[i])))
+	}
+}
+
+func (cli *CLI) spvBalance(address, nodeID string) {
+	if !ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	lc, err := NewLightClient(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer lc.Close()
+
+	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+
+	fmt.Printf("Balance of '%s': %d (best header at height %d)\n", address, lc.Balance(pubKeyHash), lc.BestHeight())
 }
@@ -0,0 +1,77 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dataDir is the directory holding the files of the node, set by the -datadir option
+// or the DATADIR env. var. Without one, the files are kept in the working directory
+// and named after the node ID, as in earlier versions.
+var dataDir string
+
+var ErrDataDirLocked = errors.New("the node files are used by another process")
+
+// nodeFile is a file of the node: its name in a data directory, and the format of
+// its name, taking the node ID, in the working directory
+type nodeFile struct {
+	name   string
+	legacy string
+}
+
+var (
+	chainFile   = nodeFile{"chain.db", "blockchain_%s.db"}
+	walletsFile = nodeFile{"wallet.dat", "wallet_%s.dat"}
+	spvFile     = nodeFile{"spv.db", "spv_%s.db"}
+	peersFile   = nodeFile{"peers.dat", "peers_%s.dat"}
+	lockFile    = nodeFile{".lock", "node_%s.lock"}
+	cookieFile  = nodeFile{".cookie", "node_%s.cookie"}
+)
+
+// path returns where the file of the node nodeID is
+func (f nodeFile) path(nodeID string) string {
+	if dataDir == "" {
+		return fmt.Sprintf(f.legacy, nodeID)
+	}
+
+	return filepath.Join(dataDir, f.name)
+}
+
+// SetDataDir keeps the files of the node in dir, creating it if needed. An empty dir
+// keeps them in the working directory.
+func SetDataDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	dataDir = dir
+
+	return nil
+}
+
+// LockNode takes the lock file of the node nodeID, so that no other process opens its
+// files until unlock is called or the process exits
+func LockNode(nodeID string) (unlock func(), err error) {
+	path := lockFile.path(nodeID)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFileExclusive(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrDataDirLocked, path, err)
+	}
+
+	// the process holding the lock, for whoever finds it taken
+	_ = f.Truncate(0)
+	_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
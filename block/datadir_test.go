@@ -0,0 +1,51 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataDirLayout(t *testing.T) {
+	if got := chainFile.path("3000"); got != "blockchain_3000.db" {
+		t.Fatalf("chain file without a data directory at %s", got)
+	}
+
+	dir := filepath.Join(t.TempDir(), "node")
+	if err := SetDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDataDir("")
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("the data directory was not created: %v", err)
+	}
+	for _, f := range []nodeFile{chainFile, walletsFile, spvFile, peersFile, lockFile, cookieFile} {
+		if got := f.path("3000"); filepath.Dir(got) != dir {
+			t.Errorf("%s is outside the data directory", got)
+		}
+	}
+}
+
+func TestLockNode(t *testing.T) {
+	if err := SetDataDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDataDir("")
+
+	unlock, err := LockNode("3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockNode("3000"); !errors.Is(err, ErrDataDirLocked) {
+		t.Fatalf("locking the node twice returned %v", err)
+	}
+
+	unlock()
+	unlock, err = LockNode("3000")
+	if err != nil {
+		t.Fatalf("locking the node after unlocking: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,622 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// encodingV1 is the first byte of every object in the canonical binary format.
+// A gob stream never starts with it, which lets decoders tell legacy data apart.
+// The format is specified in docs/wire-format.md.
+const encodingV1 = 0xB1
+
+// maxEncodedItems bounds every count and length prefix to keep decoders from
+// allocating arbitrarily large buffers for malformed input. Every item takes at
+// least one byte, so counts are also bounded by the remaining data.
+const maxEncodedItems = 1 << 24
+
+var (
+	ErrUnknownEncoding  = errors.New("unknown encoding")
+	ErrMalformedData    = errors.New("malformed encoded data")
+	ErrNonCanonicalData = errors.New("non-canonical encoding")
+	ErrUnknownVersion   = errors.New("unknown version")
+	ErrBadTxID          = errors.New("transaction ID does not match its contents")
+)
+
+// isCanonical reports whether data uses the canonical binary format rather than legacy gob
+func isCanonical(data []byte) bool {
+	return len(data) > 0 && data[0] == encodingV1
+}
+
+// encoder appends canonical primitives to a buffer
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf.WriteByte(b)
+}
+
+// uvarint writes an unsigned LEB128 integer
+func (e *encoder) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+// varint writes a zigzag-encoded signed integer
+func (e *encoder) varint(v int64) {
+	e.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+// bytes writes a length-prefixed byte string
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// decoder reads canonical primitives, remembering the first error
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrMalformedData))
+		return 0
+	}
+
+	b := d.data[0]
+	d.data = d.data[1:]
+
+	return b
+}
+
+// uvarint reads an unsigned LEB128 integer and rejects overlong encodings
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(fmt.Errorf("%w: bad varint", ErrMalformedData))
+		return 0
+	}
+	if n > 1 && d.data[n-1] == 0 {
+		d.fail(fmt.Errorf("%w: overlong varint", ErrNonCanonicalData))
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	u := d.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// count reads a length or item count
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > maxEncodedItems || n > uint64(len(d.data)) {
+		d.fail(fmt.Errorf("%w: count %d too large", ErrMalformedData, n))
+		return 0
+	}
+
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrMalformedData))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+
+	b := make([]byte, n)
+	copy(b, d.data[:n])
+	d.data = d.data[n:]
+
+	return b
+}
+
+// marker checks the format marker
+func (d *decoder) marker() {
+	if marker := d.byte(); d.err == nil && marker != encodingV1 {
+		d.fail(fmt.Errorf("%w: marker 0x%02x", ErrUnknownEncoding, marker))
+	}
+}
+
+// finish reports the first error, or trailing bytes after a complete object
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.fail(fmt.Errorf("%w: %d trailing bytes", ErrMalformedData, len(d.data)))
+	}
+
+	return d.err
+}
+
+func (e *encoder) input(in *TXInput) {
+	e.bytes(in.TxID)
+	e.varint(int64(in.Vout))
+	e.bytes(in.Signature)
+	e.bytes(in.PubKey)
+}
+
+func (d *decoder) input() TXInput {
+	return TXInput{
+		TxID:      d.bytes(),
+		Vout:      int(d.varint()),
+		Signature: d.bytes(),
+		PubKey:    d.bytes(),
+	}
+}
+
+func (e *encoder) output(out *TXOutput) {
+	e.varint(int64(out.Value))
+	e.bytes(out.PubKeyHash)
+}
+
+func (d *decoder) output() TXOutput {
+	return TXOutput{
+		Value:      int(d.varint()),
+		PubKeyHash: d.bytes(),
+	}
+}
+
+// transaction writes a transaction without the format marker. Version 0 transactions
+// carry their ID explicitly since it was derived from the legacy gob encoding.
+func (e *encoder) transaction(tx *Transaction) {
+	e.uvarint(uint64(tx.Version))
+	if tx.Version == 0 {
+		e.bytes(tx.ID)
+	}
+
+	e.uvarint(uint64(len(tx.Vin)))
+	for i := range tx.Vin {
+		e.input(&tx.Vin[i])
+	}
+
+	e.uvarint(uint64(len(tx.Vout)))
+	for i := range tx.Vout {
+		e.output(&tx.Vout[i])
+	}
+}
+
+func (d *decoder) transaction() Transaction {
+	var tx Transaction
+
+	tx.Version = int(d.uvarint())
+	if tx.Version == 0 {
+		tx.ID = d.bytes()
+	}
+
+	if n := d.count(); d.err == nil {
+		tx.Vin = make([]TXInput, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			tx.Vin = append(tx.Vin, d.input())
+		}
+	}
+
+	if n := d.count(); d.err == nil {
+		tx.Vout = make([]TXOutput, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			tx.Vout = append(tx.Vout, d.output())
+		}
+	}
+
+	return tx
+}
+
+// EncodeTransaction returns the canonical encoding of a transaction
+func EncodeTransaction(tx *Transaction) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.transaction(tx)
+
+	return e.Bytes()
+}
+
+// DecodeTransaction parses a canonically encoded transaction and derives its ID
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := decoder{data: data}
+	d.marker()
+	tx := d.transaction()
+	if err := d.finish(); err != nil {
+		return Transaction{}, err
+	}
+
+	if err := deriveID(&tx); err != nil {
+		return Transaction{}, err
+	}
+
+	return tx, nil
+}
+
+// deriveID sets the ID of a decoded transaction. The ID of a version 0 transaction
+// is carried in the encoding, so it is checked against the legacy hash instead.
+func deriveID(tx *Transaction) error {
+	if tx.Version > txVersion {
+		return fmt.Errorf("%w: transaction version %d", ErrUnknownVersion, tx.Version)
+	}
+
+	id := tx.Hash()
+	if tx.Version == 0 && !bytes.Equal(id, tx.ID) {
+		return fmt.Errorf("%w: %x", ErrBadTxID, tx.ID)
+	}
+	tx.ID = id
+
+	return nil
+}
+
+// EncodeBlock returns the canonical encoding of a block. The Merkle root, the
+// difficulty bits and the block hash are not included, they are derived from
+// the other fields.
+func EncodeBlock(b *Block) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.uvarint(uint64(b.Version))
+	e.varint(b.Timestamp)
+	e.bytes(b.PrevBlockHash)
+	e.varint(int64(b.Nonce))
+	e.uvarint(uint64(b.Height))
+
+	e.uvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.transaction(tx)
+	}
+
+	return e.Bytes()
+}
+
+// DecodeBlock parses a canonically encoded block and derives the IDs of the block and its transactions
+func DecodeBlock(data []byte) (*Block, error) {
+	d := decoder{data: data}
+	d.marker()
+
+	block := &Block{}
+	block.Version = int(d.uvarint())
+	block.Bits = targetBits
+	block.Timestamp = d.varint()
+	block.PrevBlockHash = d.bytes()
+	block.Nonce = int(d.varint())
+	block.Height = int(d.uvarint())
+
+	if n := d.count(); d.err == nil {
+		block.Transactions = make([]*Transaction, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			tx := d.transaction()
+			block.Transactions = append(block.Transactions, &tx)
+		}
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if block.Version > blockVersion {
+		return nil, fmt.Errorf("%w: block version %d", ErrUnknownVersion, block.Version)
+	}
+	for _, tx := range block.Transactions {
+		if err := deriveID(tx); err != nil {
+			return nil, err
+		}
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	return block, nil
+}
+
+func (e *encoder) blockHeader(h *BlockHeader) {
+	e.uvarint(uint64(h.Version))
+	e.bytes(h.PrevBlockHash)
+	e.bytes(h.MerkleRoot)
+	e.varint(h.Timestamp)
+	e.uvarint(uint64(h.Bits))
+	e.varint(int64(h.Nonce))
+}
+
+func (d *decoder) blockHeader() BlockHeader {
+	return BlockHeader{
+		Version:       int(d.uvarint()),
+		PrevBlockHash: d.bytes(),
+		MerkleRoot:    d.bytes(),
+		Timestamp:     d.varint(),
+		Bits:          int(d.uvarint()),
+		Nonce:         int(d.varint()),
+	}
+}
+
+// EncodeHeader returns the canonical encoding of a block header
+func EncodeHeader(h *BlockHeader) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.blockHeader(h)
+
+	return e.Bytes()
+}
+
+// DecodeHeader parses a canonically encoded block header
+func DecodeHeader(data []byte) (BlockHeader, error) {
+	d := decoder{data: data}
+	d.marker()
+	h := d.blockHeader()
+	if err := d.finish(); err != nil {
+		return BlockHeader{}, err
+	}
+
+	return h, nil
+}
+
+// encodeHeaderEntry encodes a header followed by the height of its block, as stored in the headers bucket
+func encodeHeaderEntry(h *BlockHeader, height int) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.blockHeader(h)
+	e.uvarint(uint64(height))
+
+	return e.Bytes()
+}
+
+func decodeHeaderEntry(data []byte) (BlockHeader, int, error) {
+	d := decoder{data: data}
+	d.marker()
+	h := d.blockHeader()
+	height := int(d.uvarint())
+	if err := d.finish(); err != nil {
+		return BlockHeader{}, 0, err
+	}
+
+	return h, height, nil
+}
+
+// encodeTxLocation encodes a transaction index entry: the block hash and the position of the transaction in the block
+func encodeTxLocation(loc TxLocation) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.bytes(loc.BlockHash)
+	e.uvarint(uint64(loc.Position))
+
+	return e.Bytes()
+}
+
+func decodeTxLocation(data []byte) (TxLocation, error) {
+	d := decoder{data: data}
+	d.marker()
+	loc := TxLocation{d.bytes(), int(d.uvarint())}
+	if err := d.finish(); err != nil {
+		return TxLocation{}, err
+	}
+
+	return loc, nil
+}
+
+// encodeAddressTx encodes an address index entry: the ID of a transaction and the
+// amounts it paid to and spent from the address
+func encodeAddressTx(entry AddressTx) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.bytes(entry.TxID)
+	e.varint(int64(entry.Received))
+	e.varint(int64(entry.Sent))
+
+	return e.Bytes()
+}
+
+func decodeAddressTx(data []byte) (AddressTx, error) {
+	d := decoder{data: data}
+	d.marker()
+	entry := AddressTx{TxID: d.bytes(), Received: int(d.varint()), Sent: int(d.varint())}
+	if err := d.finish(); err != nil {
+		return AddressTx{}, err
+	}
+
+	return entry, nil
+}
+
+// encodeUndo encodes the outputs spent by a block, in the order they were spent
+func encodeUndo(spent []spentOutput) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.uvarint(uint64(len(spent)))
+	for i := range spent {
+		e.bytes(spent[i].TxID)
+		e.uvarint(uint64(spent[i].Vout))
+		e.output(&spent[i].Output)
+	}
+
+	return e.Bytes()
+}
+
+func decodeUndo(data []byte) ([]spentOutput, error) {
+	d := decoder{data: data}
+	d.marker()
+	spent := make([]spentOutput, d.count())
+	for i := range spent {
+		spent[i] = spentOutput{d.bytes(), int(d.uvarint()), d.output()}
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return spent, nil
+}
+
+// EncodeOutputs returns the canonical encoding of the unspent outputs of a transaction
+func EncodeOutputs(outs TXOutputs) []byte {
+	var e encoder
+	e.byte(encodingV1)
+
+	e.uvarint(uint64(len(outs.Outputs)))
+	for i := range outs.Outputs {
+		e.uvarint(uint64(outs.Index(i)))
+		e.output(&outs.Outputs[i])
+	}
+
+	return e.Bytes()
+}
+
+// DecodeOutputs parses canonically encoded unspent outputs
+func DecodeOutputs(data []byte) (TXOutputs, error) {
+	d := decoder{data: data}
+	d.marker()
+
+	var outs TXOutputs
+	if n := d.count(); d.err == nil {
+		for i := 0; i < n && d.err == nil; i++ {
+			index := int(d.uvarint())
+			if i > 0 && index <= outs.Indexes[i-1] {
+				d.fail(fmt.Errorf("%w: output indexes not increasing", ErrNonCanonicalData))
+			}
+			outs.Indexes = append(outs.Indexes, index)
+			outs.Outputs = append(outs.Outputs, d.output())
+		}
+	}
+
+	if err := d.finish(); err != nil {
+		return TXOutputs{}, err
+	}
+
+	return outs, nil
+}
+
+func (e *encoder) merkleProof(p *MerkleProof) {
+	e.uvarint(uint64(p.Index))
+	e.uvarint(uint64(p.Count))
+	e.uvarint(uint64(len(p.Siblings)))
+	for _, sibling := range p.Siblings {
+		e.bytes(sibling)
+	}
+}
+
+func (d *decoder) merkleProof() MerkleProof {
+	var p MerkleProof
+
+	p.Index = int(d.uvarint())
+	p.Count = int(d.uvarint())
+	if n := d.count(); d.err == nil {
+		for i := 0; i < n && d.err == nil; i++ {
+			p.Siblings = append(p.Siblings, d.bytes())
+		}
+	}
+
+	return p
+}
+
+// EncodeMerkleProof returns the canonical encoding of a Merkle proof
+func EncodeMerkleProof(p *MerkleProof) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.merkleProof(p)
+
+	return e.Bytes()
+}
+
+// DecodeMerkleProof parses a canonically encoded Merkle proof
+func DecodeMerkleProof(data []byte) (MerkleProof, error) {
+	d := decoder{data: data}
+	d.marker()
+	p := d.merkleProof()
+	if err := d.finish(); err != nil {
+		return MerkleProof{}, err
+	}
+
+	return p, nil
+}
+
+// EncodeTxProof returns the canonical encoding of a transaction inclusion proof
+func EncodeTxProof(p *TxProof) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.blockHeader(&p.Header)
+	e.merkleProof(&p.Proof)
+
+	return e.Bytes()
+}
+
+// DecodeTxProof parses a canonically encoded transaction inclusion proof
+func DecodeTxProof(data []byte) (TxProof, error) {
+	d := decoder{data: data}
+	d.marker()
+	p := TxProof{Header: d.blockHeader(), Proof: d.merkleProof()}
+	if err := d.finish(); err != nil {
+		return TxProof{}, err
+	}
+
+	return p, nil
+}
+
+// EncodeUTXOSnapshot returns the canonical encoding of a UTXO snapshot
+func EncodeUTXOSnapshot(s *UTXOSnapshot) []byte {
+	var e encoder
+	e.byte(encodingV1)
+	e.uvarint(uint64(s.Height))
+	e.bytes(s.Hash)
+
+	e.uvarint(uint64(len(s.Headers)))
+	for i := range s.Headers {
+		e.blockHeader(&s.Headers[i])
+	}
+
+	e.uvarint(uint64(len(s.Entries)))
+	for _, entry := range s.Entries {
+		e.bytes(entry.TxID)
+		e.bytes(EncodeOutputs(entry.Outputs))
+	}
+
+	return e.Bytes()
+}
+
+// DecodeUTXOSnapshot parses a canonically encoded UTXO snapshot. The entries are
+// checked against the snapshot hash when the snapshot is loaded.
+func DecodeUTXOSnapshot(data []byte) (*UTXOSnapshot, error) {
+	d := decoder{data: data}
+	d.marker()
+
+	s := &UTXOSnapshot{Height: int(d.uvarint()), Hash: d.bytes()}
+	s.Headers = make([]BlockHeader, d.count())
+	for i := range s.Headers {
+		s.Headers[i] = d.blockHeader()
+	}
+
+	s.Entries = make([]UTXOEntry, d.count())
+	for i := range s.Entries {
+		s.Entries[i].TxID = d.bytes()
+		outputs, err := DecodeOutputs(d.bytes())
+		if d.err == nil && err != nil {
+			d.fail(err)
+		}
+		s.Entries[i].Outputs = outputs
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,135 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// vectorTx is the transaction used by the test vectors in docs/wire-format.md
+func vectorTx() Transaction {
+	input := TXInput{bytes.Repeat([]byte{0x11}, 32), 1, []byte{0xaa, 0xaa, 0xaa}, []byte{0xbb, 0xbb}}
+	outputs := []TXOutput{{10, bytes.Repeat([]byte{0x22}, 20)}, {-1, nil}}
+
+	return Transaction{nil, []TXInput{input}, outputs, 1}
+}
+
+func TestTransactionEncodingVector(t *testing.T) {
+	tx := vectorTx()
+	expect := "b101012011111111111111111111111111111111111111111111111111111111111111110203aaaaaa02bbbb02141422222222222222222222222222222222222222220100"
+
+	if encoded := hex.EncodeToString(tx.Serialize()); encoded != expect {
+		t.Fatalf("encoding %s, want %s", encoded, expect)
+	}
+	if id := hex.EncodeToString(tx.Hash()); id != "5d4296cd1a2c65474def3049f944ba61bc2e5e11a224bcab6080dc52a2e16db3" {
+		t.Fatalf("ID %s", id)
+	}
+
+	decoded, err := DecodeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	if !reflect.DeepEqual(decoded, tx) {
+		t.Fatalf("decoded %+v, want %+v", decoded, tx)
+	}
+}
+
+func TestOutputsEncodingVector(t *testing.T) {
+	outs := TXOutputs{Outputs: []TXOutput{{300, []byte{0x33}}}, Indexes: []int{2}}
+
+	if encoded := hex.EncodeToString(outs.Serialize()); encoded != "b10102d8040133" {
+		t.Fatalf("encoding %s", encoded)
+	}
+
+	decoded, err := DecodeOutputs(outs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, ok := decoded.Find(2); !ok || out.Value != 300 {
+		t.Fatalf("decoded %+v", decoded)
+	}
+}
+
+// The genesis coinbase of the first chains was hashed over its gob encoding
+func TestLegacyTransactionID(t *testing.T) {
+	pubKeyHash, _ := hex.DecodeString("c30dbb1b3047002a1cfd3300e23cd4b397ab2230")
+	tx := Transaction{
+		Vin:  []TXInput{{[]byte{}, -1, nil, []byte(genesisCoinbaseData)}},
+		Vout: []TXOutput{{subsidy, pubKeyHash}},
+	}
+
+	if id := hex.EncodeToString(tx.Hash()); id != "d73409759cdef7fe23d3f455f5a22787d164e71993ced77e371f2315ebf996ca" {
+		t.Fatalf("legacy ID %s", id)
+	}
+
+	// re-encoding canonically keeps the legacy ID
+	tx.ID = tx.Hash()
+	decoded, err := DecodeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.ID, tx.ID) || decoded.Version != 0 {
+		t.Fatalf("decoded ID %x version %d", decoded.ID, decoded.Version)
+	}
+
+	// a legacy transaction claiming the ID of another one is rejected
+	forged := vectorTx()
+	forged.Version = 0
+	forged.ID = tx.ID
+	if _, err := DecodeTransaction(forged.Serialize()); !errors.Is(err, ErrBadTxID) {
+		t.Errorf("decoding a forged legacy ID returned %v", err)
+	}
+	block := &Block{BlockHeader: BlockHeader{Version: blockVersion, Bits: targetBits}, Transactions: []*Transaction{&forged}}
+	if _, err := DecodeBlock(block.Serialize()); !errors.Is(err, ErrBadTxID) {
+		t.Errorf("decoding a block with a forged legacy ID returned %v", err)
+	}
+}
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	tx := vectorTx()
+	tx.ID = tx.Hash()
+	header := BlockHeader{Version: blockVersion, PrevBlockHash: []byte{1, 2, 3}, Timestamp: 1700000000, Bits: targetBits, Nonce: 42}
+	block := &Block{BlockHeader: header, Transactions: []*Transaction{&tx}, Height: 7}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	decoded, err := DecodeBlock(block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, block) {
+		t.Fatalf("decoded %+v, want %+v", decoded, block)
+	}
+}
+
+func TestDecodeRejectsMalformedData(t *testing.T) {
+	valid := vectorTx()
+	encoded := valid.Serialize()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		expect error
+	}{
+		{"empty", nil, ErrMalformedData},
+		{"gob", []byte{0x3a, 0xff}, ErrUnknownEncoding},
+		{"truncated", encoded[:len(encoded)-1], ErrMalformedData},
+		{"trailing bytes", append(bytes.Clone(encoded), 0), ErrMalformedData},
+		{"overlong varint", append([]byte{encodingV1, 0x81, 0x00}, encoded[2:]...), ErrNonCanonicalData},
+		{"huge count", []byte{encodingV1, 0x01, 0xff, 0xff, 0xff, 0xff, 0x0f}, ErrMalformedData},
+		{"unknown version", append([]byte{encodingV1, 0x02}, encoded[2:]...), ErrUnknownVersion},
+	}
+
+	for _, test := range tests {
+		if _, err := DecodeTransaction(test.data); !errors.Is(err, test.expect) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.expect)
+		}
+	}
+
+	if _, err := DecodeOutputs([]byte{encodingV1, 0x02, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00}); !errors.Is(err, ErrNonCanonicalData) {
+		t.Errorf("repeated output index: got %v, want %v", err, ErrNonCanonicalData)
+	}
+}
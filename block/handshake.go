@@ -0,0 +1,162 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// protocolVersion is the version of the protocol spoken by the node. Peers speaking a
+// version below minProtocolVersion are disconnected.
+const protocolVersion = 2
+const minProtocolVersion = 2
+
+// userAgent names the software of the node to its peers
+const userAgent = "/blockchain:0.2/"
+
+// handshakeTimeout bounds the time a peer takes to complete the handshake
+const handshakeTimeout = 10 * time.Second
+
+// ServiceFlag is a set of services a node offers to its peers
+type ServiceFlag uint64
+
+const (
+	ServiceFullNode ServiceFlag = 1 << iota // serves every block of the main chain
+	ServicePruned                           // serves the blocks above its pruned height
+	ServiceSPV                              // serves filtered blocks to light clients
+)
+
+// Has reports whether s includes every service of flag
+func (s ServiceFlag) Has(flag ServiceFlag) bool {
+	return s&flag == flag
+}
+
+func (s ServiceFlag) String() string {
+	var names []string
+	for i, name := range []string{"full", "pruned", "spv"} {
+		if s.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Optional features of the protocol. A feature is used with a peer only when both
+// nodes announce it in their version message. Unknown features are ignored, so
+// that nodes can add features without breaking older ones.
+const (
+	featureHeaders = "headers" // headers-first sync with getheaders and headers
+)
+
+// supportedFeatures are the features announced by the node
+var supportedFeatures = []string{featureHeaders}
+
+var (
+	ErrHandshake           = errors.New("handshake failed")
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrSelfConnection      = errors.New("connected to self")
+)
+
+// localNonce identifies the version messages of this process, so that a node
+// connecting to itself notices it
+var localNonce = rand.Uint64()
+
+// localServices are the services the node offers, set by StartServer
+var localServices ServiceFlag
+
+// localHeights returns the best height of the node and the lowest height it serves
+// blocks from, set by StartServer
+var localHeights = func() (best, pruned int) { return 0, 0 }
+
+// newVersion returns the version message the node introduces itself with
+func newVersion() verzion {
+	best, pruned := localHeights()
+
+	return verzion{
+		Version:      protocolVersion,
+		Services:     localServices,
+		UserAgent:    userAgent,
+		Timestamp:    time.Now().Unix(),
+		Nonce:        localNonce,
+		BestHeight:   best,
+		AddrFrom:     nodeAddress,
+		PrunedHeight: pruned,
+		Features:     supportedFeatures,
+	}
+}
+
+// sendHandshake queues a version or verack message ahead of the other messages
+func (p *peer) sendHandshake(command string, payload []byte) {
+	msg, err := encodeMessage(command, payload)
+	if err == nil {
+		p.handshakeSend <- msg
+	}
+}
+
+// handshake handles the version and verack messages that open every connection and
+// reports whether the message is to be passed to the handler of the peer. A peer
+// sending anything else before completing the handshake is disconnected.
+func (p *peer) handshake(command string, payload []byte) (bool, error) {
+	switch command {
+	case "version":
+		if p.remote != nil {
+			return false, fmt.Errorf("%w: version sent twice", ErrHandshake)
+		}
+
+		var version verzion
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&version); err != nil {
+			return false, fmt.Errorf("%w: version: %s", ErrBadMessage, err)
+		}
+		if version.Nonce == localNonce {
+			return false, ErrSelfConnection
+		}
+		if version.Version < minProtocolVersion {
+			return false, fmt.Errorf("%w: %d (%s), at least %d is needed", ErrIncompatibleVersion, version.Version, version.UserAgent, minProtocolVersion)
+		}
+
+		p.remote = &version
+		p.features = make(map[string]bool)
+		for _, feature := range version.Features {
+			for _, supported := range supportedFeatures {
+				if feature == supported {
+					p.features[feature] = true
+				}
+			}
+		}
+
+		if p.inbound {
+			p.sendHandshake("version", gobEncode(newVersion()))
+		}
+		p.sendHandshake("verack", nil)
+
+		return true, nil
+
+	case "verack":
+		if p.remote == nil || p.verack {
+			return false, fmt.Errorf("%w: unexpected verack", ErrHandshake)
+		}
+		p.verack = true
+		close(p.ready)
+
+		return false, nil
+	}
+
+	if !p.verack {
+		return false, fmt.Errorf("%w: %s before the handshake", ErrHandshake, command)
+	}
+
+	return true, nil
+}
+
+// supports reports whether the peer and the node both support an optional feature
+func (p *peer) supports(feature string) bool {
+	return p.features[feature]
+}
@@ -0,0 +1,141 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+const headersBucket = "headers"
+
+// maxHeadersPerMessage bounds the number of headers served for one getheaders request
+const maxHeadersPerMessage = 2000
+
+var (
+	ErrHeaderNotFound = errors.New("header is not found")
+	ErrOrphanHeader   = errors.New("previous header is unknown")
+	ErrInvalidPoW     = errors.New("proof of work is invalid")
+)
+
+// BlockHeader holds the fields committed to by the block hash. The transactions
+// only enter through the Merkle root, so a header can be hashed and its proof of
+// work checked without the block body.
+type BlockHeader struct {
+	Version       int
+	PrevBlockHash []byte
+	MerkleRoot    []byte
+	Timestamp     int64
+	Bits          int
+	Nonce         int // 'number once', arbitrary number that's only used once
+}
+
+// Hash returns the hash of the header, which is the ID of its block
+func (h *BlockHeader) Hash() []byte {
+	return NewProofOfWork(h).hash(h.Nonce)
+}
+
+// Serialize returns the canonical encoding of the header
+func (h *BlockHeader) Serialize() []byte {
+	return EncodeHeader(h)
+}
+
+// indexHeaders fills the headers of a database written before headers were stored
+// separately from the stored blocks
+func indexHeaders(tx StoreTx) error {
+	if tx.Tip() == nil || !isEmpty(tx.Headers()) {
+		return nil
+	}
+
+	return tx.Blocks().ForEach(func(k, v []byte) error {
+		block := DeserializeBlock(v)
+		return tx.Headers().Put(k, encodeHeaderEntry(&block.BlockHeader, block.Height))
+	})
+}
+
+// GetBlockHeader finds a header by its hash and returns it with the height of its block
+func (bc *Blockchain) GetBlockHeader(hash []byte) (BlockHeader, int, error) {
+	var header BlockHeader
+	var height int
+
+	err := bc.store.View(func(tx StoreTx) error {
+		var err error
+		header, height, err = bc.readHeader(tx, hash)
+		return err
+	})
+
+	return header, height, err
+}
+
+// readHeader reads a stored header and the height of its block through the header cache
+func (bc *Blockchain) readHeader(tx StoreTx, hash []byte) (BlockHeader, int, error) {
+	if entry, ok := bc.headers.Get(hash); ok {
+		return entry.header, entry.height, nil
+	}
+
+	header, height, err := getHeader(tx, hash)
+	if err != nil {
+		return header, height, err
+	}
+	bc.headers.Add(hash, cachedHeader{header, height})
+
+	return header, height, nil
+}
+
+// AddHeader validates and stores a header whose parent header is already known.
+// The block body can be fetched and added later. Known headers are ignored.
+func (bc *Blockchain) AddHeader(header *BlockHeader) error {
+	if !NewProofOfWork(header).Validate() {
+		return fmt.Errorf("%w: %x", ErrInvalidPoW, header.Hash())
+	}
+
+	return bc.store.Update(func(tx StoreTx) error {
+		if _, _, err := getHeader(tx, header.Hash()); err == nil {
+			return nil
+		}
+
+		_, prevHeight, err := getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return fmt.Errorf("%w: %x", ErrOrphanHeader, header.PrevBlockHash)
+		}
+
+		return tx.Headers().Put(header.Hash(), encodeHeaderEntry(header, prevHeight+1))
+	})
+}
+
+// GetHeaders returns up to max headers of the main chain following the most recent
+// locator hash found on it, oldest first. Without a known locator hash the headers
+// start at the genesis block. Only headers are read, never block bodies.
+func (bc *Blockchain) GetHeaders(locator [][]byte, max int) []BlockHeader {
+	var chain []BlockHeader
+
+	err := bc.store.View(func(tx StoreTx) error {
+		known := make(map[string]bool)
+		for _, hash := range locator {
+			known[string(hash)] = true
+		}
+
+		hash := bc.tip
+		for len(hash) > 0 && !known[string(hash)] {
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, header)
+			hash = header.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	// the chain was collected from the tip backwards
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	if len(chain) > max {
+		chain = chain[:max]
+	}
+
+	return chain
+}
@@ -0,0 +1,147 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testBlock returns an unmined block with one coinbase, whose data makes the block unique
+func testBlock(prevHash []byte, height int, data string) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:       blockVersion,
+			PrevBlockHash: prevHash,
+			Timestamp:     int64(1700000000 + height),
+			Bits:          targetBits,
+		},
+		Transactions: []*Transaction{NewCoinbaseTX(string(NewWallet().GetAddress()), data)},
+		Height:       height,
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	return block
+}
+
+// storeTestChain stores length blocks with one coinbase each on top of bc and moves
+// the tip to the last one. Proof of work is not checked when blocks are stored.
+func storeTestChain(tb testing.TB, bc *Blockchain, length int) []*Block {
+	var blocks []*Block
+	prevHash := []byte{}
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		for height := 0; height < length; height++ {
+			block := testBlock(prevHash, height, fmt.Sprint(height))
+
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+			prevHash = block.Hash
+		}
+
+		return setTip(tx, prevHash, length-1)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bc.tip = prevHash
+
+	return blocks
+}
+
+func TestHeaderHashIsBlockHash(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+
+	for _, block := range blocks {
+		header, height, err := bc.GetBlockHeader(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(header.Hash(), block.Hash) || height != block.Height {
+			t.Fatalf("header %x at height %d, want %x at %d", header.Hash(), height, block.Hash, block.Height)
+		}
+
+		// the header alone is enough to derive the block hash
+		decoded, err := DecodeHeader(header.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.Hash(), block.Hash) {
+			t.Fatalf("decoded header hash %x, want %x", decoded.Hash(), block.Hash)
+		}
+		if size := len(header.Serialize()); size > 90 {
+			t.Fatalf("header takes %d bytes", size)
+		}
+	}
+}
+
+func TestHeaderHashCommitsToVersion(t *testing.T) {
+	header := BlockHeader{Version: blockVersion, PrevBlockHash: []byte{1, 2, 3}, Timestamp: 1700000000, Bits: targetBits, Nonce: 42}
+	hash := header.Hash()
+
+	header.Version++
+	if bytes.Equal(header.Hash(), hash) {
+		t.Error("changing the version kept the block hash")
+	}
+
+	// version 0 headers keep the legacy preimage, without the version
+	header.Version = 0
+	legacy := sha256.Sum256(bytes.Join([][]byte{header.PrevBlockHash, header.MerkleRoot, IntToHex(header.Timestamp),
+		IntToHex(int64(header.Bits)), IntToHex(int64(header.Nonce))}, nil))
+	if !bytes.Equal(header.Hash(), legacy[:]) {
+		t.Errorf("version 0 header hash %x, want %x", header.Hash(), legacy)
+	}
+}
+
+func TestGetHeaders(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 5)
+
+	tests := []struct {
+		name    string
+		locator [][]byte
+		max     int
+		first   int
+		count   int
+	}{
+		{"from genesis", nil, maxHeadersPerMessage, 0, 5},
+		{"after locator", [][]byte{blocks[1].Hash}, maxHeadersPerMessage, 2, 3},
+		{"most recent locator", [][]byte{blocks[0].Hash, blocks[3].Hash}, maxHeadersPerMessage, 4, 1},
+		{"unknown locator", [][]byte{{0xde, 0xad}}, maxHeadersPerMessage, 0, 5},
+		{"limited", nil, 2, 0, 2},
+		{"up to date", [][]byte{blocks[4].Hash}, maxHeadersPerMessage, 0, 0},
+	}
+
+	for _, test := range tests {
+		chain := bc.GetHeaders(test.locator, test.max)
+		if len(chain) != test.count {
+			t.Fatalf("%s: got %d headers, want %d", test.name, len(chain), test.count)
+		}
+		for i := range chain {
+			if !bytes.Equal(chain[i].Hash(), blocks[test.first+i].Hash) {
+				t.Fatalf("%s: header %d is %x, want %x", test.name, i, chain[i].Hash(), blocks[test.first+i].Hash)
+			}
+		}
+	}
+}
+
+func TestAddHeaderRejectsInvalidPoW(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 1)
+
+	header := BlockHeader{Version: blockVersion, PrevBlockHash: blocks[0].Hash, MerkleRoot: blocks[0].MerkleRoot, Bits: targetBits}
+	if err := bc.AddHeader(&header); !errors.Is(err, ErrInvalidPoW) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidPoW)
+	}
+
+	// a header claiming an easier target is rejected whatever its hash
+	header.Bits = 1
+	if err := bc.AddHeader(&header); !errors.Is(err, ErrInvalidPoW) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidPoW)
+	}
+}
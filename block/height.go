@@ -0,0 +1,173 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// heightIndex maps the height of every main chain block to its hash
+const heightIndex = "heights"
+
+var ErrHeightOutOfRange = errors.New("no main chain block at height")
+
+// heightKey encodes a height as a big-endian integer, so that keys sort by height
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+
+	return key
+}
+
+// blockVerifier checks a block against the UTXO set it is about to be connected to
+type blockVerifier func(tx StoreTx, block *Block) error
+
+// setTip makes the block with the given hash and height the tip of the main chain.
+// The height index is rewritten from the tip down to the last block shared with the
+// previous main chain, so switching to another branch costs the length of the branch.
+// The blocks leaving and joining the main chain are passed to the optional indexes
+// and the UTXO set, so that the chain state moves in the same transaction. A UTXO set
+// not known to be at any block, such as one being repaired, is left as it is.
+func setTip(tx StoreTx, hash []byte, height int) error {
+	return moveTip(tx, hash, height, nil)
+}
+
+// moveTip is setTip checking the blocks joining the main chain with verify, when it
+// is not nil, as they are connected to the UTXO set. A failed check is returned, and
+// the transaction must then be rolled back to keep the previous tip.
+func moveTip(tx StoreTx, hash []byte, height int, verify blockVerifier) error {
+	index := tx.Index(heightIndex)
+	utxoTip := getUTXOTip(tx)
+	tracked := utxoTip != nil || tx.Tip() == nil
+	var disconnected, connected [][]byte
+
+	// a shorter branch leaves the heights above it without a block
+	for h := height + 1; index.Get(heightKey(h)) != nil; h++ {
+		old := append([]byte{}, index.Get(heightKey(h))...)
+		disconnected = append([][]byte{old}, disconnected...)
+		if err := index.Delete(heightKey(h)); err != nil {
+			return err
+		}
+	}
+
+	for h, current := height, hash; h >= 0; h-- {
+		old := index.Get(heightKey(h))
+		if bytes.Equal(old, current) {
+			break
+		}
+		if old != nil {
+			disconnected = append(disconnected, append([]byte{}, old...))
+		}
+		connected = append([][]byte{current}, connected...)
+
+		if err := index.Put(heightKey(h), current); err != nil {
+			return err
+		}
+
+		header, _, err := getHeader(tx, current)
+		if err != nil {
+			return err
+		}
+		current = header.PrevBlockHash
+	}
+
+	// blocks leave the main chain from the old tip down, then join it from the fork up
+	for _, blockHash := range disconnected {
+		if err := disconnectBlock(tx, blockHash); err != nil {
+			return err
+		}
+	}
+	for _, blockHash := range connected {
+		if err := connectBlock(tx, blockHash); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.SetTip(hash); err != nil {
+		return err
+	}
+	if !tracked {
+		return nil
+	}
+
+	return syncUTXO(tx, utxoTip, verify)
+}
+
+// indexHeights fills the height index of a database written before it existed
+func indexHeights(tx StoreTx) error {
+	tip := tx.Tip()
+	if tip == nil {
+		return nil
+	}
+
+	_, height, err := getHeader(tx, tip)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(tx.Index(heightIndex).Get(heightKey(height)), tip) {
+		return nil
+	}
+
+	return setTip(tx, tip, height)
+}
+
+// getHashAtHeight returns the hash of the main chain block at height
+func getHashAtHeight(tx StoreTx, height int) ([]byte, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("%w %d", ErrHeightOutOfRange, height)
+	}
+
+	hash := tx.Index(heightIndex).Get(heightKey(height))
+	if hash == nil {
+		return nil, fmt.Errorf("%w %d", ErrHeightOutOfRange, height)
+	}
+
+	return append([]byte{}, hash...), nil
+}
+
+// GetBlockByHeight returns the main chain block at height
+func (bc *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	var block Block
+
+	err := bc.store.View(func(tx StoreTx) error {
+		hash, err := getHashAtHeight(tx, height)
+		if err != nil {
+			return err
+		}
+
+		b, err := bc.readBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+		block = *b
+
+		return nil
+	})
+
+	return block, err
+}
+
+// GetBlockHashRange returns the hashes of the main chain blocks from height start
+// to height end included, lowest first. The range stops at the tip.
+func (bc *Blockchain) GetBlockHashRange(start, end int) ([][]byte, error) {
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid height range %d to %d", start, end)
+	}
+
+	var hashes [][]byte
+
+	err := bc.store.View(func(tx StoreTx) error {
+		for height := start; height <= end; height++ {
+			hash, err := getHashAtHeight(tx, height)
+			if errors.Is(err, ErrHeightOutOfRange) {
+				break
+			}
+			hashes = append(hashes, hash)
+		}
+
+		return nil
+	})
+
+	return hashes, err
+}
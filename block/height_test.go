@@ -0,0 +1,146 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// checkHeightIndex fails unless every height of the main chain ending at tip maps to its block
+func checkHeightIndex(t *testing.T, bc *Blockchain, chain []*Block) {
+	t.Helper()
+
+	for _, want := range chain {
+		block, err := bc.GetBlockByHeight(want.Height)
+		if err != nil {
+			t.Fatalf("height %d: %v", want.Height, err)
+		}
+		if !bytes.Equal(block.Hash, want.Hash) {
+			t.Fatalf("height %d: block %x, want %x", want.Height, block.Hash, want.Hash)
+		}
+	}
+
+	_, err := bc.GetBlockByHeight(len(chain))
+	if !errors.Is(err, ErrHeightOutOfRange) {
+		t.Fatalf("height %d above the tip returned %v", len(chain), err)
+	}
+}
+
+func TestGetBlockByHeight(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 5)
+
+	checkHeightIndex(t, bc, blocks)
+	if _, err := bc.GetBlockByHeight(-1); !errors.Is(err, ErrHeightOutOfRange) {
+		t.Fatalf("negative height returned %v", err)
+	}
+}
+
+func TestGetBlockHashRange(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 5)
+
+	tests := []struct {
+		start, end int
+		want       []*Block
+	}{
+		{0, 4, blocks},
+		{1, 3, blocks[1:4]},
+		{2, 2, blocks[2:3]},
+		{3, 100, blocks[3:]},
+		{5, 10, nil},
+	}
+	for _, test := range tests {
+		hashes, err := bc.GetBlockHashRange(test.start, test.end)
+		if err != nil {
+			t.Fatalf("%d to %d: %v", test.start, test.end, err)
+		}
+		if len(hashes) != len(test.want) {
+			t.Fatalf("%d to %d: %d hashes, want %d", test.start, test.end, len(hashes), len(test.want))
+		}
+		for i := range hashes {
+			if !bytes.Equal(hashes[i], test.want[i].Hash) {
+				t.Fatalf("%d to %d: hash %d is %x, want %x", test.start, test.end, i, hashes[i], test.want[i].Hash)
+			}
+		}
+	}
+
+	for _, r := range [][2]int{{-1, 2}, {3, 2}} {
+		if _, err := bc.GetBlockHashRange(r[0], r[1]); err == nil {
+			t.Fatalf("range %d to %d accepted", r[0], r[1])
+		}
+	}
+}
+
+func TestHeightIndexFollowsReorg(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+
+	// a longer branch forking after the genesis block becomes the main chain
+	fork := []*Block{blocks[0]}
+	for height := 1; height <= 3; height++ {
+		block := testBlock(fork[height-1].Hash, height, "fork")
+		if err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		fork = append(fork, block)
+	}
+	if !bytes.Equal(bc.tip, fork[3].Hash) {
+		t.Fatalf("tip %x, want the end of the fork %x", bc.tip, fork[3].Hash)
+	}
+	checkHeightIndex(t, bc, fork)
+
+	// switching back to the shorter chain removes the heights above it
+	err := bc.store.Update(func(tx StoreTx) error {
+		return setTip(tx, blocks[2].Hash, 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeightIndex(t, bc, blocks)
+}
+
+func TestAddBlockChecksHeight(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+
+	orphan := testBlock([]byte{1, 2, 3}, 3, "orphan")
+	if err := bc.AddBlock(orphan); !errors.Is(err, ErrOrphanBlock) {
+		t.Errorf("adding an orphan block returned %v", err)
+	}
+
+	// a block claiming a height far above its parent would become the tip
+	tall := testBlock(blocks[1].Hash, 100, "tall")
+	if err := bc.AddBlock(tall); !errors.Is(err, ErrBadHeight) {
+		t.Errorf("adding a block of the wrong height returned %v", err)
+	}
+	if !bytes.Equal(bc.tip, blocks[2].Hash) {
+		t.Fatalf("tip %x, want %x", bc.tip, blocks[2].Hash)
+	}
+	if _, err := bc.GetBlock(tall.Hash); err == nil {
+		t.Error("the block of the wrong height was stored")
+	}
+	checkHeightIndex(t, bc, blocks)
+}
+
+func TestHeightIndexBackfill(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 4)
+
+	// a database written before the index existed, and the schema version
+	err := bc.store.Update(func(tx StoreTx) error {
+		if err := tx.Index(metaBucket).Delete([]byte(schemaVersionKey)); err != nil {
+			return err
+		}
+		return tx.DeleteIndex(heightIndex)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenBlockchain(bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHeightIndex(t, reopened, blocks)
+}
@@ -0,0 +1,96 @@
+package block
+
+import "fmt"
+
+// indexesBucket lists the optional indexes that are enabled
+const indexesBucket = "indexes"
+
+// optionalIndexes are indexes that a node can choose to keep. Once enabled, an index
+// is updated for every block joining or leaving the main chain.
+var optionalIndexes = []struct {
+	name       string
+	connect    func(tx StoreTx, block *Block) error
+	disconnect func(tx StoreTx, block *Block) error
+}{
+	{txIndex, connectTxIndex, disconnectTxIndex},
+	{addrIndex, connectAddrIndex, disconnectAddrIndex},
+}
+
+// indexEnabled reports whether the optional index with the given name is kept
+func indexEnabled(tx StoreTx, name string) bool {
+	return tx.Index(indexesBucket).Get([]byte(name)) != nil
+}
+
+// rebuildIndex enables the optional index with the given name and fills it from the
+// main chain. It returns the number of blocks indexed.
+func rebuildIndex(tx StoreTx, name string) (int, error) {
+	for _, index := range optionalIndexes {
+		if index.name != name {
+			continue
+		}
+
+		if err := tx.DeleteIndex(name); err != nil {
+			return 0, err
+		}
+		if err := tx.Index(indexesBucket).Put([]byte(name), []byte{}); err != nil {
+			return 0, err
+		}
+
+		count := 0
+		for height := 0; ; height++ {
+			hash, err := getHashAtHeight(tx, height)
+			if err != nil {
+				return count, nil
+			}
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return count, err
+			}
+			if err := index.connect(tx, block); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return 0, fmt.Errorf("unknown index %s", name)
+}
+
+// connectBlock adds a block joining the main chain to the enabled optional indexes.
+// A block only known by its header cannot be indexed, and is left out until the
+// index is rebuilt.
+func connectBlock(tx StoreTx, hash []byte) error {
+	return updateIndexes(tx, hash, true)
+}
+
+// disconnectBlock removes a block leaving the main chain from the enabled optional indexes
+func disconnectBlock(tx StoreTx, hash []byte) error {
+	return updateIndexes(tx, hash, false)
+}
+
+func updateIndexes(tx StoreTx, hash []byte, connect bool) error {
+	var block *Block
+
+	for _, index := range optionalIndexes {
+		if !indexEnabled(tx, index.name) {
+			continue
+		}
+
+		if block == nil {
+			var err error
+			if block, err = getBlock(tx, hash); err != nil {
+				return nil
+			}
+		}
+
+		update := index.disconnect
+		if connect {
+			update = index.connect
+		}
+		if err := update(tx, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
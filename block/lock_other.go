@@ -0,0 +1,28 @@
+//go:build !unix
+
+package block
+
+import (
+	"errors"
+	"os"
+)
+
+// lockedFiles are the lock files taken by this process. Without advisory locks, only
+// two nodes of the same process are kept apart, while bolt still keeps other processes
+// off the chain database.
+var lockedFiles = make(map[string]bool)
+
+func lockFileExclusive(f *os.File) error {
+	if lockedFiles[f.Name()] {
+		return errors.New("locked")
+	}
+	lockedFiles[f.Name()] = true
+
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	delete(lockedFiles, f.Name())
+
+	return nil
+}
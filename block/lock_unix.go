@@ -0,0 +1,18 @@
+//go:build unix
+
+package block
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFileExclusive takes an advisory lock on f without waiting, released when the
+// process exits
+func lockFileExclusive(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,94 @@
+package block
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultBlockCacheSize is the number of decoded blocks, and of headers, a node keeps
+const defaultBlockCacheSize = 1000
+
+// lruCache keeps up to size values by key, evicting the least recently used one
+// when full. A nil cache keeps nothing.
+type lruCache[V any] struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // of *lruEntry, most recently used first
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, items: make(map[string]*list.Element), order: list.New()}
+}
+
+// Get returns the value of key and marks it as the most recently used
+func (c *lruCache[V]) Get(key []byte) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[string(key)]
+	if !ok {
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+
+	return e.Value.(*lruEntry[V]).value, true
+}
+
+// Add sets the value of key, evicting the least recently used value if the cache is full
+func (c *lruCache[V]) Add(key []byte, value V) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[string(key)]; ok {
+		e.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+	c.items[string(key)] = c.order.PushFront(&lruEntry[V]{string(key), value})
+}
+
+// Purge removes every value
+func (c *lruCache[V]) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Len returns the number of values in the cache
+func (c *lruCache[V]) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
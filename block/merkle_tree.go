@@ -1,9 +1,22 @@
 package block
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTxNotInTree      = errors.New("transaction is not in the Merkle tree")
+	ErrInvalidProof     = errors.New("invalid Merkle proof")
+	ErrMerkleRootDiffer = errors.New("Merkle proof does not lead to the root")
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+	levels   [][]*MerkleNode // every level from the leaves up, padded to an even length below the root
+	count    int             // number of leaves before padding
 }
 
 type MerkleNode struct {
@@ -12,6 +25,13 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// MerkleProof is the path from a leaf to the root of a Merkle tree
+type MerkleProof struct {
+	Index    int      // position of the leaf
+	Count    int      // number of leaves in the tree
+	Siblings [][]byte // sibling hashes from the leaf level up
+}
+
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	mNode := MerkleNode{}
 
@@ -19,9 +39,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		mNode.Data = hash[:]
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		mNode.Data = hash[:]
+		mNode.Data = hashMerklePair(left.Data, right.Data)
 	}
 
 	mNode.Left = left
@@ -30,31 +48,118 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &mNode
 }
 
+func hashMerklePair(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
+
+// NewMerkleTree builds a tree over data. A level with an odd number of nodes,
+// including a single leaf, is padded by duplicating its last node.
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	// number of leaves must be even
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1]) // duplicate the last one
+	mTree := &MerkleTree{count: len(data)}
+	if len(data) == 0 {
+		return mTree
 	}
 
 	// generate the leaf nodes
-	var nodes []MerkleNode
+	var nodes []*MerkleNode
 	for _, d := range data {
-		n := NewMerkleNode(nil, nil, d)
-		nodes = append(nodes, *n)
+		nodes = append(nodes, NewMerkleNode(nil, nil, d))
 	}
 
 	// create the tree
-	for i := 0; i < len(data)/2; i++ {
-		var newLevel []MerkleNode
+	for {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1]) // duplicate the last one
+		}
+		mTree.levels = append(mTree.levels, nodes)
 
+		var newLevel []*MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
-			n := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			newLevel = append(newLevel, *n)
+			newLevel = append(newLevel, NewMerkleNode(nodes[j], nodes[j+1], nil))
 		}
 
 		nodes = newLevel
+		if len(nodes) == 1 {
+			break
+		}
 	}
 
-	mTree := &MerkleTree{RootNode: &nodes[0]}
+	mTree.levels = append(mTree.levels, nodes)
+	mTree.RootNode = nodes[0]
+
 	return mTree
 }
+
+// Proof returns the path from the leaf hashing to leafHash up to the root.
+// For the transactions of a version 1 block the leaf hash is the transaction ID.
+func (t *MerkleTree) Proof(leafHash []byte) (MerkleProof, error) {
+	if len(t.levels) == 0 {
+		return MerkleProof{}, fmt.Errorf("%w: %x", ErrTxNotInTree, leafHash)
+	}
+
+	for index := 0; index < t.count; index++ {
+		if !bytes.Equal(t.levels[0][index].Data, leafHash) {
+			continue
+		}
+
+		proof := MerkleProof{Index: index, Count: t.count}
+		pos := index
+		for _, level := range t.levels[:len(t.levels)-1] {
+			proof.Siblings = append(proof.Siblings, level[pos^1].Data)
+			pos /= 2
+		}
+
+		return proof, nil
+	}
+
+	return MerkleProof{}, fmt.Errorf("%w: %x", ErrTxNotInTree, leafHash)
+}
+
+// merkleDepth returns the number of levels between count leaves and the root
+func merkleDepth(count int) int {
+	depth := 1
+	for count > 2 {
+		count = (count + 1) / 2
+		depth++
+	}
+
+	return depth
+}
+
+// VerifyMerkleProof checks that proof leads from leafHash to root.
+//
+// Padding makes a tree over [a b c] and one over [a b c c] share the same root,
+// so a proof could otherwise place a transaction at a position that does not
+// exist. A sibling is therefore only accepted as equal to its node where the
+// level was padded, and nowhere else.
+func VerifyMerkleProof(root, leafHash []byte, proof MerkleProof) error {
+	if proof.Count < 1 || proof.Index < 0 || proof.Index >= proof.Count {
+		return fmt.Errorf("%w: leaf %d of %d", ErrInvalidProof, proof.Index, proof.Count)
+	}
+	if len(proof.Siblings) != merkleDepth(proof.Count) {
+		return fmt.Errorf("%w: %d siblings for %d leaves", ErrInvalidProof, len(proof.Siblings), proof.Count)
+	}
+
+	hash := leafHash
+	pos, width := proof.Index, proof.Count
+	for _, sibling := range proof.Siblings {
+		padded := pos%2 == 0 && pos == width-1
+		if padded != bytes.Equal(sibling, hash) {
+			return fmt.Errorf("%w: unexpected sibling %x", ErrInvalidProof, sibling)
+		}
+
+		if pos%2 == 0 {
+			hash = hashMerklePair(hash, sibling)
+		} else {
+			hash = hashMerklePair(sibling, hash)
+		}
+		pos, width = pos/2, (width+1)/2
+	}
+
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("%w: %x", ErrMerkleRootDiffer, hash)
+	}
+
+	return nil
+}
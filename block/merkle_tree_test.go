@@ -0,0 +1,155 @@
+package block
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func merkleTestData(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx %d", i)))
+	}
+
+	return data
+}
+
+func leafHash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Roots of trees with up to four leaves must not change, existing blocks commit to them
+func TestMerkleRootCompatibility(t *testing.T) {
+	data := merkleTestData(3)
+	a, b, c := leafHash(data[0]), leafHash(data[1]), leafHash(data[2])
+
+	tests := []struct {
+		leaves [][]byte
+		root   []byte
+	}{
+		{data[:1], hashMerklePair(a, a)},
+		{data[:2], hashMerklePair(a, b)},
+		{data[:3], hashMerklePair(hashMerklePair(a, b), hashMerklePair(c, c))},
+	}
+
+	for _, test := range tests {
+		root := NewMerkleTree(test.leaves).RootNode.Data
+		if fmt.Sprintf("%x", root) != fmt.Sprintf("%x", test.root) {
+			t.Fatalf("%d leaves: root %x, want %x", len(test.leaves), root, test.root)
+		}
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		data := merkleTestData(n)
+		tree := NewMerkleTree(data)
+
+		for i := range data {
+			proof, err := tree.Proof(leafHash(data[i]))
+			if err != nil {
+				t.Fatalf("%d leaves, leaf %d: %s", n, i, err)
+			}
+			if proof.Index != i || proof.Count != n {
+				t.Fatalf("%d leaves, leaf %d: proof for %d of %d", n, i, proof.Index, proof.Count)
+			}
+			if err := VerifyMerkleProof(tree.RootNode.Data, leafHash(data[i]), proof); err != nil {
+				t.Fatalf("%d leaves, leaf %d: %s", n, i, err)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+	data := merkleTestData(5)
+	tree := NewMerkleTree(data)
+	root := tree.RootNode.Data
+	leaf := leafHash(data[1])
+
+	tests := []struct {
+		name   string
+		forge  func(proof *MerkleProof)
+		expect error
+	}{
+		{"wrong sibling", func(proof *MerkleProof) { proof.Siblings[1] = leafHash([]byte("other")) }, ErrMerkleRootDiffer},
+		{"wrong index", func(proof *MerkleProof) { proof.Index = 0 }, ErrMerkleRootDiffer},
+		{"index out of range", func(proof *MerkleProof) { proof.Index = 5 }, ErrInvalidProof},
+		{"missing sibling", func(proof *MerkleProof) { proof.Siblings = proof.Siblings[1:] }, ErrInvalidProof},
+		{"wrong count", func(proof *MerkleProof) { proof.Count = 9 }, ErrInvalidProof},
+	}
+
+	for _, test := range tests {
+		proof, err := tree.Proof(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.forge(&proof)
+
+		if err := VerifyMerkleProof(root, leaf, proof); !errors.Is(err, test.expect) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.expect)
+		}
+	}
+
+	if _, err := tree.Proof(leafHash([]byte("other"))); !errors.Is(err, ErrTxNotInTree) {
+		t.Errorf("unknown leaf: got %v, want %v", err, ErrTxNotInTree)
+	}
+}
+
+// A tree over [a b c] has the same root as one over [a b c c]. The last leaf must
+// not be provable at the padding position.
+func TestMerkleProofDuplicateLeaf(t *testing.T) {
+	data := merkleTestData(3)
+	mutated := append(merkleTestData(3), data[2])
+
+	tree, mutatedTree := NewMerkleTree(data), NewMerkleTree(mutated)
+	if fmt.Sprintf("%x", tree.RootNode.Data) != fmt.Sprintf("%x", mutatedTree.RootNode.Data) {
+		t.Fatal("expected the padded and the mutated tree to share their root")
+	}
+
+	c := leafHash(data[2])
+	proof := MerkleProof{Index: 3, Count: 4, Siblings: [][]byte{c, mutatedTree.levels[1][0].Data}}
+	if err := VerifyMerkleProof(tree.RootNode.Data, c, proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidProof)
+	}
+}
+
+func TestVerifyBlockRejectsDuplicateTx(t *testing.T) {
+	bc := newTestChain(t)
+	block := syntheticBlock(t, bc, NewWallet(), 3, 1)
+	block.Transactions = append(block.Transactions, block.Transactions[0])
+
+	if err := bc.VerifyBlock(block); !errors.Is(err, ErrDuplicateTx) {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateTx)
+	}
+}
+
+func TestTxProof(t *testing.T) {
+	bc := newTestChain(t)
+	block := syntheticBlock(t, bc, NewWallet(), 4, 1)
+	block.Version = blockVersion
+	block.Bits = targetBits
+	block.MerkleRoot = block.HashTransactions()
+
+	for _, tx := range block.Transactions {
+		proof, err := block.TxProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := DecodeTxProof(proof.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyMerkleProof(decoded.Header.MerkleRoot, tx.ID, decoded.Proof); err != nil {
+			t.Fatalf("transaction %x: %s", tx.ID, err)
+		}
+
+		// the block was not mined
+		if err := decoded.Verify(tx.ID); !errors.Is(err, ErrInvalidPoW) {
+			t.Fatalf("got %v, want %v", err, ErrInvalidPoW)
+		}
+	}
+}
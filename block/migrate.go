@@ -0,0 +1,76 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MigrateEncoding rewrites blocks and UTXO entries stored in the legacy gob encoding
+// in the canonical encoding. Block hashes and transaction IDs are preserved, and a
+// block whose hash would change aborts the whole migration. It returns the number
+// of records rewritten.
+func (bc *Blockchain) MigrateEncoding() (int, error) {
+	migrated := 0
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		var err error
+		migrated, err = migrateEncoding(tx)
+		return err
+	})
+
+	return migrated, err
+}
+
+// migrateEncoding rewrites the gob records of tx in the canonical encoding, see MigrateEncoding
+func migrateEncoding(tx StoreTx) (int, error) {
+	blocks := tx.Blocks()
+	updates := make(map[string][]byte)
+
+	err := blocks.ForEach(func(k, v []byte) error {
+		if isCanonical(v) {
+			return nil
+		}
+
+		block := DeserializeBlock(v)
+		data := block.Serialize()
+
+		decoded, err := DecodeBlock(data)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(decoded.Hash, k) {
+			return fmt.Errorf("block %x would be re-encoded with hash %x", k, decoded.Hash)
+		}
+
+		updates[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	utxo := tx.UTXO()
+	utxoUpdates := make(map[string][]byte)
+	err = utxo.ForEach(func(k, v []byte) error {
+		if !isCanonical(v) {
+			utxoUpdates[string(k)] = DeserializeOutputs(v).Serialize()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for k, v := range updates {
+		if err := blocks.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+	for k, v := range utxoUpdates {
+		if err := utxo.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(updates) + len(utxoUpdates), nil
+}
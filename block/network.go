@@ -0,0 +1,46 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Network names a chain. Nodes of different networks never share a database.
+type Network string
+
+const (
+	MainNet Network = "main"
+	TestNet Network = "test"
+)
+
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// activeNetwork is the network of this node, set from the NETWORK env. var. by the CLI
+var activeNetwork = MainNet
+
+// ParseNetwork returns the network with the given name, the main network when empty
+func ParseNetwork(name string) (Network, error) {
+	switch Network(name) {
+	case "", MainNet:
+		return MainNet, nil
+	case TestNet:
+		return TestNet, nil
+	}
+
+	return "", fmt.Errorf("%w %q", ErrUnknownNetwork, name)
+}
+
+// SetNetwork makes n the network of the node
+func SetNetwork(n Network) {
+	activeNetwork = n
+}
+
+// magic returns the bytes starting every message between nodes of the network, so
+// that nodes of different networks never talk to each other
+func (n Network) magic() []byte {
+	if n == TestNet {
+		return []byte{0xB1, 'T', 'S', 'T'}
+	}
+
+	return []byte{0xB1, 'N', 'E', 'T'}
+}
@@ -0,0 +1,360 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxMessageSize bounds the payload of a message, which holds at most a block or the
+// hashes of a whole chain
+const maxMessageSize = 1 << 25
+
+// peerSendQueue is the number of messages waiting to be written to a peer. A peer
+// reading slower than that is disconnected rather than holding the node back.
+const peerSendQueue = 1000
+
+// dialTimeout bounds the time to connect to a peer
+const dialTimeout = 5 * time.Second
+
+// closeTimeout bounds the time to write the queued messages when disconnecting
+const closeTimeout = 5 * time.Second
+
+var ErrBadMessage = errors.New("malformed message")
+
+// writeMessage writes a message to w in the envelope
+//
+//	magic (4 bytes) | command length (1 byte) | command | length (4 bytes, big-endian) | checksum (4 bytes) | payload
+//
+// where the magic is that of the network of the node and the checksum is the first
+// bytes of the double SHA-256 of the payload
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(command) == 0 || len(command) > 0xFF {
+		return fmt.Errorf("%w: command %q", ErrBadMessage, command)
+	}
+	if len(payload) > maxMessageSize {
+		return fmt.Errorf("%w: length %d", ErrBadMessage, len(payload))
+	}
+
+	header := make([]byte, 0, 13+len(command))
+	header = append(header, activeNetwork.magic()...)
+	header = append(header, byte(len(command)))
+	header = append(header, command...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(payload)))
+	header = append(header, checksum(payload)...)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// encodeMessage returns a message framed by writeMessage
+func encodeMessage(command string, payload []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := writeMessage(&buff, command, payload); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// readMessage reads the next message of r, io.EOF when the stream ends between messages
+func readMessage(r io.Reader) (string, []byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", nil, fmt.Errorf("%w: truncated header", ErrBadMessage)
+		}
+		return "", nil, err
+	}
+	if !bytes.Equal(head[:4], activeNetwork.magic()) {
+		return "", nil, fmt.Errorf("%w: bad magic %x", ErrBadMessage, head[:4])
+	}
+	if head[4] == 0 {
+		return "", nil, fmt.Errorf("%w: empty command", ErrBadMessage)
+	}
+
+	rest := make([]byte, int(head[4])+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", nil, fmt.Errorf("%w: truncated header", ErrBadMessage)
+	}
+	command := string(rest[:head[4]])
+	length := binary.BigEndian.Uint32(rest[head[4]:])
+	sum := rest[len(rest)-4:]
+	if length > maxMessageSize {
+		return "", nil, fmt.Errorf("%w: %s of length %d", ErrBadMessage, command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, fmt.Errorf("%w: truncated %s", ErrBadMessage, command)
+	}
+	if !bytes.Equal(checksum(payload), sum) {
+		return "", nil, fmt.Errorf("%w: checksum mismatch in %s", ErrBadMessage, command)
+	}
+
+	return command, payload, nil
+}
+
+// messageHandler handles a message received from a peer. Messages of a peer are
+// handled one at a time, in the order they were sent.
+type messageHandler func(p *peer, command string, payload []byte)
+
+// handleMessage handles the messages of the peers the node connects to. A node
+// handles them with handleCommand once its blockchain is open, other commands
+// ignore them.
+var handleMessage messageHandler = func(p *peer, command string, payload []byte) {}
+
+// peers holds the connected peers by address, connections every connected peer
+var peers = make(map[string]*peer)
+var connections = make(map[*peer]bool)
+var peersMu sync.Mutex
+
+// peer is a long-lived connection to another node. One goroutine reads and handles
+// its messages while another writes the messages queued for it, once the version
+// handshake is complete.
+type peer struct {
+	addr    string // address dialled for an outbound peer, remote address of an inbound one
+	conn    net.Conn
+	inbound bool // the peer connected to the node
+	handler messageHandler
+
+	send          chan []byte // framed messages, nil to write the queue out and disconnect
+	handshakeSend chan []byte // version and verack, written first
+
+	// set by the handshake, read once ready is closed
+	remote   *verzion        // version message of the peer
+	features map[string]bool // optional features both ends support
+	verack   bool
+
+	ready    chan struct{} // closed once the handshake is complete
+	done     chan struct{} // closed once disconnected
+	doneOnce sync.Once
+}
+
+// newPeer starts reading and writing conn. The node opens the handshake on the
+// connections it makes and answers it on the others. The caller holds peersMu.
+func newPeer(conn net.Conn, addr string, inbound bool, handler messageHandler) *peer {
+	p := &peer{
+		addr:          addr,
+		conn:          conn,
+		inbound:       inbound,
+		handler:       handler,
+		send:          make(chan []byte, peerSendQueue),
+		handshakeSend: make(chan []byte, 2),
+		ready:         make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if !inbound {
+		p.sendHandshake("version", gobEncode(newVersion()))
+	}
+	connections[p] = true
+
+	go p.readLoop()
+	go p.writeLoop()
+	time.AfterFunc(handshakeTimeout, func() {
+		select {
+		case <-p.ready:
+		case <-p.done:
+		default:
+			fmt.Printf("Disconnecting %s: %s: timed out\n", p.address(), ErrHandshake)
+			p.disconnect()
+		}
+	})
+
+	return p
+}
+
+func (p *peer) readLoop() {
+	r := bufio.NewReader(p.conn)
+	for {
+		command, payload, err := readMessage(r)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				if !errors.Is(err, io.EOF) {
+					fmt.Printf("Disconnecting %s: %s\n", p.address(), err)
+				}
+			}
+			p.disconnect()
+			return
+		}
+
+		pass, err := p.handshake(command, payload)
+		if err != nil {
+			fmt.Printf("Disconnecting %s: %s\n", p.address(), err)
+			p.disconnect()
+			return
+		}
+		if pass {
+			p.handler(p, command, payload)
+		}
+	}
+}
+
+func (p *peer) writeLoop() {
+	w := bufio.NewWriter(p.conn)
+	write := func(msg []byte) bool {
+		if _, err := w.Write(msg); err != nil {
+			p.disconnect()
+			return false
+		}
+		return true
+	}
+
+	// the other messages wait for the handshake
+	for handshaking := true; handshaking; {
+		select {
+		case msg := <-p.handshakeSend:
+			if !write(msg) || w.Flush() != nil {
+				p.disconnect()
+				return
+			}
+		case <-p.ready:
+			handshaking = false
+		case <-p.done:
+			return
+		}
+	}
+	for len(p.handshakeSend) > 0 {
+		if !write(<-p.handshakeSend) {
+			return
+		}
+	}
+	if w.Flush() != nil {
+		p.disconnect()
+		return
+	}
+
+	for {
+		select {
+		case msg := <-p.send:
+			if msg == nil {
+				_ = w.Flush()
+				p.disconnect()
+				return
+			}
+			if !write(msg) {
+				return
+			}
+			if len(p.send) == 0 && w.Flush() != nil {
+				p.disconnect()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// push queues a framed message, disconnecting the peer if its queue is full
+func (p *peer) push(msg []byte) {
+	select {
+	case <-p.done:
+	case p.send <- msg:
+	default:
+		fmt.Printf("%s is too slow, disconnecting\n", p.address())
+		p.disconnect()
+	}
+}
+
+// address returns the address of the peer
+func (p *peer) address() string {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	return p.addr
+}
+
+// disconnect closes the connection at once, dropping the queued messages
+func (p *peer) disconnect() {
+	p.doneOnce.Do(func() {
+		close(p.done)
+		_ = p.conn.Close()
+
+		peersMu.Lock()
+		if peers[p.addr] == p {
+			delete(peers, p.addr)
+		}
+		delete(connections, p)
+		peersMu.Unlock()
+	})
+}
+
+// close writes the queued messages and disconnects, waiting up to closeTimeout
+func (p *peer) close() {
+	select {
+	case p.send <- nil:
+	case <-p.done:
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(closeTimeout):
+		p.disconnect()
+	}
+}
+
+// connectPeer returns the connected peer at addr, connecting to it with handler if needed
+func connectPeer(addr string, handler messageHandler) (*peer, error) {
+	peersMu.Lock()
+	p := peers[addr]
+	peersMu.Unlock()
+	if p != nil {
+		return p, nil
+	}
+
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	if existing := peers[addr]; existing != nil {
+		_ = conn.Close()
+		return existing, nil
+	}
+	p = newPeer(conn, addr, false, handler)
+	peers[addr] = p
+
+	return p, nil
+}
+
+// acceptPeer starts a peer for a connection made to the node. The peer is known by
+// the address it connected from, whatever address it claims to listen on.
+func acceptPeer(conn net.Conn, handler messageHandler) *peer {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	addr := conn.RemoteAddr().String()
+	p := newPeer(conn, addr, true, handler)
+	if peers[addr] == nil {
+		peers[addr] = p
+	}
+
+	return p
+}
+
+// closePeers writes out the messages queued for every peer and disconnects them
+func closePeers() {
+	peersMu.Lock()
+	var all []*peer
+	for p := range connections {
+		all = append(all, p)
+	}
+	peersMu.Unlock()
+
+	for _, p := range all {
+		p.close()
+	}
+}
@@ -0,0 +1,247 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageFraming(t *testing.T) {
+	var buff bytes.Buffer
+	if err := writeMessage(&buff, "version", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(&buff, "verack", nil); err != nil {
+		t.Fatal(err)
+	}
+	stream := buff.Bytes()
+
+	for _, want := range []string{"version", "verack"} {
+		command, payload, err := readMessage(&buff)
+		if err != nil || command != want {
+			t.Fatalf("read %s, want %s: %v", command, want, err)
+		}
+		if command == "version" && string(payload) != "payload" {
+			t.Fatalf("payload %q", payload)
+		}
+	}
+	if _, _, err := readMessage(&buff); err != io.EOF {
+		t.Fatalf("reading past the last message returned %v", err)
+	}
+
+	corrupt := func(name string, data []byte) {
+		if _, _, err := readMessage(bytes.NewReader(data)); !errors.Is(err, ErrBadMessage) {
+			t.Errorf("%s: reading returned %v", name, err)
+		}
+	}
+	badSum := append([]byte{}, stream...)
+	badSum[len("version")+14] ^= 1
+	corrupt("bad checksum", badSum)
+	corrupt("truncated", stream[:10])
+	tooLong := append([]byte{}, stream[:len("version")+5]...)
+	tooLong = append(tooLong, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0)
+	corrupt("too long", tooLong)
+
+	SetNetwork(TestNet)
+	_, _, err := readMessage(bytes.NewReader(stream))
+	SetNetwork(MainNet)
+	if !errors.Is(err, ErrBadMessage) {
+		t.Errorf("reading a message of another network returned %v", err)
+	}
+}
+
+// listenFakeNode accepts connections to a node answering the handshake with version
+// and then running serve, returning its address
+func listenFakeNode(t *testing.T, version verzion, serve func(conn net.Conn)) string {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	t.Cleanup(closePeers)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if command, _, err := readMessage(conn); err != nil || command != "version" {
+					return
+				}
+				_ = writeMessage(conn, "version", gobEncode(version))
+				_ = writeMessage(conn, "verack", nil)
+				if command, _, err := readMessage(conn); err != nil || command != "verack" {
+					return
+				}
+				serve(conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// fakeVersion returns the version message of another node
+func fakeVersion() verzion {
+	return verzion{
+		Version:   protocolVersion,
+		Services:  ServiceFullNode,
+		UserAgent: "/fake:1.0/",
+		Nonce:     localNonce + 1,
+		Features:  []string{featureHeaders, "future"},
+	}
+}
+
+// waitDisconnected fails unless p is disconnected within a few seconds
+func waitDisconnected(t *testing.T, p *peer, reason string) {
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the peer was not disconnected after %s", reason)
+	}
+}
+
+func TestPeerConnection(t *testing.T) {
+	// the remote node echoes every message
+	addr := listenFakeNode(t, fakeVersion(), func(conn net.Conn) {
+		for {
+			command, payload, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			_ = writeMessage(conn, "echo"+command, payload)
+		}
+	})
+
+	received := make(chan string, 10)
+	p, err := connectPeer(addr, func(p *peer, command string, payload []byte) {
+		received <- command
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		sendData(addr, fmt.Sprint(i), nil)
+	}
+
+	for _, want := range []string{"version", "echo0", "echo1", "echo2"} {
+		select {
+		case command := <-received:
+			if command != want {
+				t.Fatalf("received %s, want %s", command, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s", want)
+		}
+	}
+
+	if p.remote.UserAgent != "/fake:1.0/" || !p.remote.Services.Has(ServiceFullNode) {
+		t.Errorf("version of the peer %+v", p.remote)
+	}
+	if !p.supports(featureHeaders) || p.supports("future") {
+		t.Errorf("negotiated features %v", p.features)
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	handler := func(p *peer, command string, payload []byte) {}
+
+	old := fakeVersion()
+	old.Version = minProtocolVersion - 1
+	p, err := connectPeer(listenFakeNode(t, old, func(net.Conn) {}), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnected(t, p, "an incompatible version")
+
+	// a node sending a message before its version
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = writeMessage(conn, "inv", nil)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	p, err = connectPeer(ln.Addr().String(), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnected(t, p, "a message before the handshake")
+
+	// the node connecting to itself
+	self, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer self.Close()
+	go func() {
+		conn, err := self.Accept()
+		if err == nil {
+			acceptPeer(conn, handler)
+		}
+	}()
+	p, err = connectPeer(self.Addr().String(), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnected(t, p, "connecting to self")
+	if p.remote != nil {
+		t.Error("the version of the node itself was accepted")
+	}
+}
+
+func TestMalformedPayloadDisconnects(t *testing.T) {
+	handler := func(p *peer, command string, payload []byte) {}
+	malformed := []byte{0xB1, 0x01, 0xFF}
+	truncated := gobEncode(getdata{"localhost:4000", "block", []byte{1, 2, 3}})
+	truncated = truncated[:len(truncated)-2]
+
+	type message struct {
+		command string
+		payload []byte
+	}
+	messages := []message{
+		{"tx", gobEncode(tx{"localhost:4000", malformed})},
+		{"block", gobEncode(block{"localhost:4000", malformed})},
+	}
+	for _, command := range []string{"addr", "getaddr", "block", "inv", "getblocks", "getheaders", "headers",
+		"filterload", "filteradd", "filterclear", "getdata", "notfound", "tx"} {
+		messages = append(messages, message{command, truncated})
+	}
+
+	for _, msg := range messages {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p := acceptPeer(local, handler)
+		handleCommand(p, msg.command, msg.payload, nil)
+		waitDisconnected(t, p, "a malformed "+msg.command)
+	}
+
+	// an empty inventory is not worth disconnecting for
+	for _, kind := range []string{"block", "tx"} {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p := acceptPeer(local, handler)
+		handleCommand(p, "inv", gobEncode(inv{"localhost:4000", kind, nil}), nil)
+		select {
+		case <-p.done:
+			t.Errorf("the peer was disconnected after an empty %s inventory", kind)
+		default:
+		}
+		p.disconnect()
+	}
+}
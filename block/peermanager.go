@@ -0,0 +1,554 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultSeeds are the nodes a node without known addresses connects to first
+var defaultSeeds = []string{"localhost:3000"}
+
+const (
+	defaultMaxInbound  = 32
+	defaultMaxOutbound = 8
+
+	// connectInterval is how often the node tops up its outbound connections
+	connectInterval = 5 * time.Second
+	// addrInterval is how often the node sends the addresses it knows to its peers
+	addrInterval = 2 * time.Minute
+
+	// minRetryDelay doubles after every failed connection to an address, up to maxRetryDelay
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = 30 * time.Minute
+
+	// maxAddrBook bounds the address book, the addresses seen least recently going first
+	maxAddrBook = 2000
+	// maxAddrPerMessage bounds the addresses of an addr message
+	maxAddrPerMessage = 1000
+	// maxAddrFailures is the number of failed connections in a row after which an
+	// address that never worked is forgotten
+	maxAddrFailures = 10
+)
+
+var ErrUnknownPeer = errors.New("not connected to peer")
+
+// AddrInfo is what the node knows about the address of another node. Only Addr,
+// Services and LastSeen are gossiped, the other fields are local.
+type AddrInfo struct {
+	Addr        string
+	Services    ServiceFlag
+	LastSeen    int64 // Unix time the node was last heard of
+	LastSuccess int64 // Unix time of the last handshake with the node, 0 if none
+	LastAttempt int64 // Unix time of the last connection to the node
+	Failures    int   // failed connections since the last success
+}
+
+// retryAt returns when the node may connect to the address again
+func (a *AddrInfo) retryAt() time.Time {
+	if a.Failures == 0 {
+		return time.Unix(a.LastAttempt, 0)
+	}
+
+	delay := maxRetryDelay
+	if a.Failures < 20 && minRetryDelay<<a.Failures < maxRetryDelay {
+		delay = minRetryDelay << a.Failures
+	}
+	return time.Unix(a.LastAttempt, 0).Add(delay)
+}
+
+// PeerConfig sets how a node connects to other nodes
+type PeerConfig struct {
+	MaxInbound  int      // connections accepted from other nodes
+	MaxOutbound int      // connections made to other nodes
+	AddNodes    []string // nodes kept connected, on top of MaxOutbound
+	Connect     []string // when set, the only nodes connected to, without discovery
+}
+
+// PeerManager chooses the nodes a node connects to. It keeps an address book of the
+// nodes it heard of, saved in the peers file, learns addresses from its peers and
+// gossips them, keeps up to MaxOutbound connections, retrying addresses that failed
+// after a delay doubling each time, and refuses inbound connections beyond MaxInbound.
+type PeerManager struct {
+	nodeID string
+	config PeerConfig
+
+	mu    sync.Mutex
+	book  map[string]*AddrInfo
+	added map[string]bool // nodes kept connected, from AddNodes and the addnode command
+	dirty bool            // the book changed since it was saved
+}
+
+// NewPeerManager returns the peer manager of node nodeID, loading its address book
+func NewPeerManager(nodeID string, config PeerConfig) (*PeerManager, error) {
+	pm := &PeerManager{
+		nodeID: nodeID,
+		config: config,
+		book:   make(map[string]*AddrInfo),
+		added:  make(map[string]bool),
+	}
+	if err := pm.load(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, addr := range config.AddNodes {
+		pm.added[addr] = true
+		pm.learn(AddrInfo{Addr: addr, LastSeen: now})
+	}
+	if len(pm.book) == 0 {
+		for _, addr := range defaultSeeds {
+			pm.learn(AddrInfo{Addr: addr, LastSeen: now})
+		}
+	}
+
+	return pm, nil
+}
+
+// load reads the address book from the peers file, if any
+func (pm *PeerManager) load() error {
+	content, err := os.ReadFile(peersFile.path(pm.nodeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var addrs []AddrInfo
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&addrs); err != nil {
+		return fmt.Errorf("%s: %w", peersFile.path(pm.nodeID), err)
+	}
+	for i := range addrs {
+		pm.book[addrs[i].Addr] = &addrs[i]
+	}
+
+	return nil
+}
+
+// Save writes the address book to the peers file if it changed
+func (pm *PeerManager) Save() error {
+	pm.mu.Lock()
+	if !pm.dirty {
+		pm.mu.Unlock()
+		return nil
+	}
+	addrs := make([]AddrInfo, 0, len(pm.book))
+	for _, a := range pm.book {
+		addrs = append(addrs, *a)
+	}
+	pm.dirty = false
+	pm.mu.Unlock()
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	return os.WriteFile(peersFile.path(pm.nodeID), gobEncode(addrs), 0644)
+}
+
+// Addrs returns the address book, the addresses heard of most recently first
+func (pm *PeerManager) Addrs() []AddrInfo {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	addrs := make([]AddrInfo, 0, len(pm.book))
+	for _, a := range pm.book {
+		addrs = append(addrs, *a)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].LastSeen != addrs[j].LastSeen {
+			return addrs[i].LastSeen > addrs[j].LastSeen
+		}
+		return addrs[i].Addr < addrs[j].Addr
+	})
+
+	return addrs
+}
+
+// learn adds an address to the book or updates the services and time it was seen.
+// The caller holds pm.mu or owns pm.
+func (pm *PeerManager) learn(info AddrInfo) {
+	if info.Addr == "" || info.Addr == nodeAddress {
+		return
+	}
+
+	if a := pm.book[info.Addr]; a != nil {
+		if info.LastSeen > a.LastSeen {
+			a.LastSeen = info.LastSeen
+			if info.Services != 0 {
+				a.Services = info.Services
+			}
+			pm.dirty = true
+		}
+		return
+	}
+
+	if len(pm.book) >= maxAddrBook {
+		var oldest *AddrInfo
+		for _, a := range pm.book {
+			if !pm.added[a.Addr] && (oldest == nil || a.LastSeen < oldest.LastSeen) {
+				oldest = a
+			}
+		}
+		if oldest == nil || oldest.LastSeen >= info.LastSeen {
+			return
+		}
+		delete(pm.book, oldest.Addr)
+	}
+	pm.book[info.Addr] = &AddrInfo{Addr: info.Addr, Services: info.Services, LastSeen: info.LastSeen}
+	pm.dirty = true
+}
+
+// AddAddrs adds gossiped addresses to the book. Times in the future are taken as now.
+func (pm *PeerManager) AddAddrs(addrs []AddrInfo) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now().Unix()
+	for i, info := range addrs {
+		if i == maxAddrPerMessage {
+			break
+		}
+		pm.learn(AddrInfo{Addr: info.Addr, Services: info.Services, LastSeen: min(info.LastSeen, now)})
+	}
+}
+
+// gossiped returns up to maxAddrPerMessage addresses of nodes serving blocks for an
+// addr message, the addresses heard of most recently first
+func (pm *PeerManager) gossiped() []AddrInfo {
+	var addrs []AddrInfo
+	for _, a := range pm.Addrs() {
+		if a.Services.Has(ServiceFullNode) || a.Services.Has(ServicePruned) {
+			addrs = append(addrs, AddrInfo{Addr: a.Addr, Services: a.Services, LastSeen: a.LastSeen})
+		}
+		if len(addrs) == maxAddrPerMessage {
+			break
+		}
+	}
+
+	return addrs
+}
+
+// Connected records a completed handshake with p. The addresses of the nodes serving
+// blocks that connect to this one are learnt too, so that they are gossiped.
+func (pm *PeerManager) Connected(p *peer) {
+	version := p.remote
+	now := time.Now().Unix()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p.inbound {
+		if version.Services.Has(ServiceFullNode) || version.Services.Has(ServicePruned) {
+			pm.learn(AddrInfo{Addr: version.AddrFrom, Services: version.Services, LastSeen: now})
+		}
+		return
+	}
+
+	if a := pm.book[p.address()]; a != nil {
+		a.Services = version.Services
+		a.LastSeen = now
+		a.LastSuccess = now
+		a.Failures = 0
+		pm.dirty = true
+	}
+}
+
+// failed records a failed connection to addr, forgetting addresses that never worked
+// after maxAddrFailures
+func (pm *PeerManager) failed(addr string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	a := pm.book[addr]
+	if a == nil {
+		return
+	}
+	a.Failures++
+	if a.Failures >= maxAddrFailures && a.LastSuccess == 0 && !pm.added[addr] {
+		delete(pm.book, addr)
+	}
+	pm.dirty = true
+}
+
+// candidates returns the addresses to connect to now, nodes kept connected first,
+// then those that worked most recently
+func (pm *PeerManager) candidates(now time.Time) (added, others []string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	connected := connectedAddrs()
+	ready := func(addr string) bool {
+		if connected[addr] {
+			return false
+		}
+		a := pm.book[addr]
+		return a == nil || !now.Before(a.retryAt())
+	}
+
+	for addr := range pm.added {
+		if ready(addr) {
+			added = append(added, addr)
+		}
+	}
+	sort.Strings(added)
+
+	if len(pm.config.Connect) > 0 {
+		for _, addr := range pm.config.Connect {
+			if ready(addr) {
+				others = append(others, addr)
+			}
+		}
+		return added, others
+	}
+
+	var infos []*AddrInfo
+	for addr, a := range pm.book {
+		if !pm.added[addr] && ready(addr) {
+			infos = append(infos, a)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].LastSuccess != infos[j].LastSuccess {
+			return infos[i].LastSuccess > infos[j].LastSuccess
+		}
+		if infos[i].LastSeen != infos[j].LastSeen {
+			return infos[i].LastSeen > infos[j].LastSeen
+		}
+		return infos[i].Addr < infos[j].Addr
+	})
+	for _, a := range infos {
+		others = append(others, a.Addr)
+	}
+
+	return added, others
+}
+
+// connect makes an outbound connection to addr
+func (pm *PeerManager) connect(addr string) error {
+	pm.mu.Lock()
+	if a := pm.book[addr]; a != nil {
+		a.LastAttempt = time.Now().Unix()
+		pm.dirty = true
+	} else {
+		pm.learn(AddrInfo{Addr: addr, LastSeen: time.Now().Unix(), LastAttempt: time.Now().Unix()})
+	}
+	pm.mu.Unlock()
+
+	p, err := connectPeer(addr, handleMessage)
+	if err != nil {
+		pm.failed(addr)
+		return err
+	}
+
+	// a node refusing the handshake is retried later like one that is down
+	go func() {
+		select {
+		case <-p.ready:
+		case <-p.done:
+			pm.failed(addr)
+		}
+	}()
+
+	return nil
+}
+
+// connectOutbound connects to the nodes kept connected, then to other nodes until
+// there are MaxOutbound outbound connections
+func (pm *PeerManager) connectOutbound() {
+	added, others := pm.candidates(time.Now())
+	for _, addr := range added {
+		if err := pm.connect(addr); err != nil {
+			fmt.Printf("%s is not available: %s\n", addr, err)
+		}
+	}
+
+	for _, addr := range others {
+		if pm.outbound() >= pm.config.MaxOutbound {
+			return
+		}
+		_ = pm.connect(addr)
+	}
+}
+
+// outbound returns the number of outbound connections, leaving out the nodes kept
+// connected
+func (pm *PeerManager) outbound() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	n := 0
+	for p := range connections {
+		if !p.inbound && !pm.added[p.addr] {
+			n++
+		}
+	}
+
+	return n
+}
+
+// AcceptInbound reports whether another inbound connection is allowed
+func (pm *PeerManager) AcceptInbound() bool {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	n := 0
+	for p := range connections {
+		if p.inbound {
+			n++
+		}
+	}
+
+	return n < pm.config.MaxInbound
+}
+
+// AddNode keeps addr connected, reconnecting to it when the connection is lost
+func (pm *PeerManager) AddNode(addr string) error {
+	pm.mu.Lock()
+	pm.added[addr] = true
+	pm.learn(AddrInfo{Addr: addr, LastSeen: time.Now().Unix()})
+	pm.mu.Unlock()
+
+	return pm.connect(addr)
+}
+
+// Connect connects to addr once, without keeping it connected
+func (pm *PeerManager) Connect(addr string) error {
+	return pm.connect(addr)
+}
+
+// Disconnect closes the connection to addr and stops keeping it connected
+func (pm *PeerManager) Disconnect(addr string) error {
+	pm.mu.Lock()
+	delete(pm.added, addr)
+	pm.mu.Unlock()
+
+	peersMu.Lock()
+	p := peers[addr]
+	peersMu.Unlock()
+	if p == nil {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, addr)
+	}
+	p.disconnect()
+
+	return nil
+}
+
+// Run keeps the outbound connections up, gossips addresses and saves the book
+// until stop is closed, for ever when stop is nil
+func (pm *PeerManager) Run(stop <-chan struct{}) {
+	connect := time.NewTicker(connectInterval)
+	defer connect.Stop()
+	gossip := time.NewTicker(addrInterval)
+	defer gossip.Stop()
+
+	pm.connectOutbound()
+	for {
+		select {
+		case <-connect.C:
+			pm.connectOutbound()
+		case <-gossip.C:
+			for _, addr := range readyPeers() {
+				sendAddr(addr, pm.gossiped())
+			}
+			if err := pm.Save(); err != nil {
+				fmt.Printf("ERROR: Saving the address book failed: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// connectedAddrs returns the addresses of the connected peers
+func connectedAddrs() map[string]bool {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	addrs := make(map[string]bool)
+	for addr := range peers {
+		addrs[addr] = true
+	}
+
+	return addrs
+}
+
+// readyPeers returns the addresses of the peers that completed the handshake and
+// serve blocks, to which blocks, transactions and addresses are relayed
+func readyPeers() []string {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	var addrs []string
+	for addr, p := range peers {
+		select {
+		case <-p.ready:
+			if p.remote.Services.Has(ServiceFullNode) || p.remote.Services.Has(ServicePruned) || peerHasFilter(addr) {
+				addrs = append(addrs, addr)
+			}
+		default:
+		}
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// isLoopback reports whether a connection comes from the same machine
+func isLoopback(conn net.Conn) bool {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	Addr       string
+	Inbound    bool
+	UserAgent  string
+	Services   ServiceFlag
+	BestHeight int // when it connected
+	Features   []string
+}
+
+// peerInfos returns the peers that completed the handshake, by address
+func peerInfos() []PeerInfo {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	var infos []PeerInfo
+	for p := range connections {
+		select {
+		case <-p.ready:
+		default:
+			continue
+		}
+
+		info := PeerInfo{
+			Addr:       p.addr,
+			Inbound:    p.inbound,
+			UserAgent:  p.remote.UserAgent,
+			Services:   p.remote.Services,
+			BestHeight: p.remote.BestHeight,
+		}
+		for _, feature := range supportedFeatures {
+			if p.supports(feature) {
+				info.Features = append(info.Features, feature)
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+
+	return infos
+}
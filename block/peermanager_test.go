@@ -0,0 +1,225 @@
+package block
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddrBook(t *testing.T) {
+	if err := SetDataDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDataDir("")
+
+	pm, err := NewPeerManager("7", PeerConfig{AddNodes: []string{"localhost:4000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	pm.AddAddrs([]AddrInfo{
+		{Addr: "localhost:4001", Services: ServiceFullNode, LastSeen: now - 100},
+		{Addr: "localhost:4001", Services: ServicePruned, LastSeen: now - 200},
+		{Addr: "localhost:4002", Services: ServiceSPV, LastSeen: now + 3600},
+		{Addr: nodeAddress, Services: ServiceFullNode, LastSeen: now},
+	})
+
+	addrs := pm.Addrs()
+	if len(addrs) != 3 {
+		t.Fatalf("address book %+v", addrs)
+	}
+	for _, a := range addrs {
+		if a.Addr == "localhost:4002" && a.LastSeen > time.Now().Unix() {
+			t.Errorf("an address was seen in the future: %+v", a)
+		}
+	}
+	if addrs[2].Addr != "localhost:4001" || addrs[2].Services != ServiceFullNode {
+		t.Errorf("an older address replaced a newer one: %+v", addrs[2])
+	}
+	if gossiped := pm.gossiped(); len(gossiped) != 1 || gossiped[0].Addr != "localhost:4001" {
+		t.Errorf("gossiped %+v, want only the node serving blocks", gossiped)
+	}
+
+	if err := pm.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewPeerManager("7", PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Addrs(), addrs) {
+		t.Errorf("loaded %+v, want %+v", loaded.Addrs(), addrs)
+	}
+	if loaded.added["localhost:4000"] {
+		t.Error("a node kept connected by the previous configuration is still kept")
+	}
+
+	if err := SetDataDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := NewPeerManager("7", PeerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book := empty.Addrs(); len(book) != len(defaultSeeds) || book[0].Addr != defaultSeeds[0] {
+		t.Errorf("new address book %+v, want the seeds", book)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	a := AddrInfo{LastAttempt: 1000}
+	if a.retryAt() != time.Unix(1000, 0) {
+		t.Errorf("an address that did not fail is retried at %v", a.retryAt())
+	}
+
+	var previous time.Duration
+	for a.Failures = 1; a.Failures < 30; a.Failures++ {
+		delay := a.retryAt().Sub(time.Unix(a.LastAttempt, 0))
+		if delay < previous || delay > maxRetryDelay {
+			t.Fatalf("delay %v after %d failures", delay, a.Failures)
+		}
+		previous = delay
+	}
+	if previous != maxRetryDelay {
+		t.Errorf("delay %v after many failures, want %v", previous, maxRetryDelay)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	pm := &PeerManager{book: make(map[string]*AddrInfo), added: map[string]bool{"localhost:4000": true}}
+	now := time.Now()
+	for _, a := range []AddrInfo{
+		{Addr: "localhost:4000", LastAttempt: now.Unix(), Failures: 1},
+		{Addr: "localhost:4001", LastSeen: 30},
+		{Addr: "localhost:4002", LastSeen: 10, LastSuccess: 20},
+		{Addr: "localhost:4003", LastSeen: 40, LastAttempt: now.Unix(), Failures: 2},
+	} {
+		info := a
+		pm.book[a.Addr] = &info
+	}
+
+	added, others := pm.candidates(now)
+	if len(added) != 0 || !reflect.DeepEqual(others, []string{"localhost:4002", "localhost:4001"}) {
+		t.Errorf("candidates %v %v", added, others)
+	}
+	added, others = pm.candidates(now.Add(maxRetryDelay))
+	if !reflect.DeepEqual(added, []string{"localhost:4000"}) || len(others) != 3 {
+		t.Errorf("candidates after the retry delay %v %v", added, others)
+	}
+
+	for i := 0; i < maxAddrFailures; i++ {
+		pm.failed("localhost:4001")
+		pm.failed("localhost:4000")
+	}
+	if pm.book["localhost:4001"] != nil || pm.book["localhost:4000"] == nil {
+		t.Error("failing addresses were not forgotten, or a node kept connected was")
+	}
+
+	pm.config.Connect = []string{"localhost:5000"}
+	if _, others := pm.candidates(now); !reflect.DeepEqual(others, []string{"localhost:5000"}) {
+		t.Errorf("candidates with -connect %v", others)
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer closePeers()
+
+	pm := &PeerManager{config: PeerConfig{MaxInbound: 1}}
+	if !pm.AcceptInbound() {
+		t.Fatal("the first inbound connection was refused")
+	}
+
+	conn, err := net.Dial(protocol, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := acceptPeer(accepted, func(p *peer, command string, payload []byte) {})
+	if pm.AcceptInbound() {
+		t.Error("an inbound connection beyond the limit was accepted")
+	}
+
+	p.disconnect()
+	if !pm.AcceptInbound() {
+		t.Error("an inbound connection was refused after the peer left")
+	}
+}
+
+func TestDisconnectUnknownPeer(t *testing.T) {
+	pm := &PeerManager{book: make(map[string]*AddrInfo), added: map[string]bool{"localhost:4000": true}}
+	if err := pm.Disconnect("localhost:4000"); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("disconnecting an unknown peer returned %v", err)
+	}
+	if pm.added["localhost:4000"] {
+		t.Error("the node is still kept connected")
+	}
+}
+
+// loopbackPeer returns an inbound peer connected from the loopback interface
+func loopbackPeer(t *testing.T) *peer {
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial(protocol, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := acceptPeer(accepted, func(p *peer, command string, payload []byte) {})
+	t.Cleanup(p.disconnect)
+
+	return p
+}
+
+func TestNodeCommandCookie(t *testing.T) {
+	saved := peerManager
+	defer func() { peerManager, nodeCookie = saved, "" }()
+	peerManager = &PeerManager{book: make(map[string]*AddrInfo), added: make(map[string]bool)}
+	nodeCookie = "secret"
+	p := loopbackPeer(t)
+
+	handleCommand(p, "addnode", gobEncode(nodecommand{"127.0.0.1:1", "guess"}), nil)
+	if peerManager.added["127.0.0.1:1"] {
+		t.Error("a command with a wrong cookie was run")
+	}
+	handleCommand(p, "addnode", gobEncode(nodecommand{"127.0.0.1:1", "secret"}), nil)
+	if !peerManager.added["127.0.0.1:1"] {
+		t.Error("a command with the cookie was refused")
+	}
+}
+
+func TestInboundPeerAddress(t *testing.T) {
+	p := loopbackPeer(t)
+	remote := p.conn.RemoteAddr().String()
+
+	version := fakeVersion()
+	version.AddrFrom = "localhost:4001"
+	if _, err := p.handshake("version", gobEncode(version)); err != nil {
+		t.Fatal(err)
+	}
+
+	peersMu.Lock()
+	claimed, connected := peers["localhost:4001"], peers[remote]
+	peersMu.Unlock()
+	if claimed != nil || connected != p || p.address() != remote {
+		t.Errorf("an inbound peer is known as %s, claiming %s", p.address(), version.AddrFrom)
+	}
+}
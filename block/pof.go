@@ -11,23 +11,31 @@ import (
 const targetBits = 24 //
 
 type ProofOfWork struct {
-	Block  *Block
+	Header *BlockHeader
 	Target *big.Int
 }
 
-func NewProofOfWork(b *Block) *ProofOfWork {
+func NewProofOfWork(h *BlockHeader) *ProofOfWork {
 	target := big.NewInt(1)
 	// SHA-256, left shift 'targetBits'
 	target = target.Lsh(target, uint(256-targetBits))
-	return &ProofOfWork{Block: b, Target: target}
+	return &ProofOfWork{Header: h, Target: target}
 }
 
+// prepareData returns the data hashed for the given nonce. Headers of version 1 and
+// later commit to their version too, version 0 headers keep the legacy preimage.
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	var version []byte
+	if pow.Header.Version >= 1 {
+		version = IntToHex(int64(pow.Header.Version))
+	}
+
 	data := bytes.Join([][]byte{
-		pow.Block.PrevBlockHash,
-		pow.Block.HashTransactions(),
-		IntToHex(pow.Block.Timestamp),
-		IntToHex(int64(targetBits)),
+		version,
+		pow.Header.PrevBlockHash,
+		pow.Header.MerkleRoot,
+		IntToHex(pow.Header.Timestamp),
+		IntToHex(int64(pow.Header.Bits)),
 		IntToHex(int64(nonce)),
 	}, []byte{})
 
@@ -60,10 +68,21 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	return nonce, hash[:]
 }
 
+// hash returns the block hash for the given nonce
+func (pow *ProofOfWork) hash(nonce int) []byte {
+	hash := sha256.Sum256(pow.prepareData(nonce))
+	return hash[:]
+}
+
+// Validate checks the header hash against the target. Only headers claiming the
+// network difficulty are accepted.
 func (pow *ProofOfWork) Validate() bool {
+	if pow.Header.Bits != targetBits {
+		return false
+	}
+
 	var hashInt big.Int
-	data := pow.prepareData(pow.Block.Nonce)
-	hash := sha256.Sum256(data) // unique
-	hashInt.SetBytes(hash[:])
+	hash := pow.hash(pow.Header.Nonce) // unique
+	hashInt.SetBytes(hash)
 	return hashInt.Cmp(pow.Target) == -1
 }
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metaBucket holds single values describing the chain as a whole
+const metaBucket = "meta"
+
+// prunedHeightKey is the meta key of the height of the lowest block whose body is kept
+const prunedHeightKey = "prunedheight"
+
+// minPruneBlocks is the number of recent blocks a pruned node always keeps, so that
+// it can still disconnect blocks and serve its peers the tip of the chain
+const minPruneBlocks = 10
+
+var ErrBlockPruned = errors.New("block is pruned")
+
+// PruneTarget is how much block data a pruned node keeps. Blocks below the target
+// lose their bodies and undo data, while their headers and the UTXO set are kept.
+type PruneTarget struct {
+	Blocks int   // keep the last Blocks blocks
+	Bytes  int64 // or as many of the last blocks as fit in Bytes
+}
+
+// ParsePruneTarget parses a number of blocks, such as "1000", or a size in megabytes,
+// such as "550MB". An empty string or zero disables pruning.
+func ParsePruneTarget(s string) (PruneTarget, error) {
+	if s == "" {
+		return PruneTarget{}, nil
+	}
+
+	if mb, ok := strings.CutSuffix(strings.ToUpper(s), "MB"); ok {
+		n, err := strconv.ParseInt(mb, 10, 64)
+		if err != nil || n < 0 {
+			return PruneTarget{}, fmt.Errorf("invalid prune size %q", s)
+		}
+		return PruneTarget{Bytes: n << 20}, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return PruneTarget{}, fmt.Errorf("invalid prune target %q, want a number of blocks or a size such as 550MB", s)
+	}
+	if n > 0 && n < minPruneBlocks {
+		return PruneTarget{}, fmt.Errorf("prune target of %d blocks is below the minimum of %d", n, minPruneBlocks)
+	}
+
+	return PruneTarget{Blocks: n}, nil
+}
+
+// Enabled reports whether the target prunes anything
+func (t PruneTarget) Enabled() bool {
+	return t.Blocks > 0 || t.Bytes > 0
+}
+
+// getPrunedHeight returns the height of the lowest main chain block whose body is kept
+func getPrunedHeight(tx StoreTx) int {
+	data := tx.Index(metaBucket).Get([]byte(prunedHeightKey))
+	if len(data) != 8 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint64(data))
+}
+
+// PrunedHeight returns the height of the lowest main chain block whose body is kept,
+// 0 when no block was pruned
+func (bc *Blockchain) PrunedHeight() int {
+	height := 0
+	_ = bc.store.View(func(tx StoreTx) error {
+		height = getPrunedHeight(tx)
+		return nil
+	})
+
+	return height
+}
+
+// Prune deletes the bodies and undo data of the main chain blocks below the target,
+// always keeping at least minPruneBlocks. It returns the number of blocks pruned.
+// The cached chain state is written first, since after a crash it is brought to the
+// tip by connecting blocks that must still be stored.
+func (bc *Blockchain) Prune(target PruneTarget) (int, error) {
+	if !target.Enabled() {
+		return 0, nil
+	}
+	if err := flushChainState(bc.store); err != nil {
+		return 0, err
+	}
+	pruned := 0
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		_, tipHeight, err := getHeader(tx, tx.Tip())
+		if err != nil {
+			return err
+		}
+
+		keepFrom := tipHeight - max(target.Blocks, minPruneBlocks) + 1
+		if target.Bytes > 0 {
+			keepFrom, err = pruneHeightForSize(tx, tipHeight, target.Bytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		// blocks below a snapshot are kept until they are validated
+		if _, _, next, ok := getSnapshotState(tx); ok {
+			keepFrom = min(keepFrom, next)
+		}
+
+		from := getPrunedHeight(tx)
+		for height := from; height < keepFrom; height++ {
+			hash, err := getHashAtHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			if err := tx.Blocks().Delete(hash); err != nil {
+				return err
+			}
+			if err := tx.Index(undoIndex).Delete(hash); err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		if keepFrom <= from {
+			return nil
+		}
+		return tx.Index(metaBucket).Put([]byte(prunedHeightKey), heightKey(keepFrom))
+	})
+	if pruned > 0 {
+		bc.blocks.Purge()
+	}
+
+	return pruned, err
+}
+
+// pruneHeightForSize returns the lowest height from which the blocks up to the tip,
+// with their undo data, fit in size bytes, keeping at least minPruneBlocks
+func pruneHeightForSize(tx StoreTx, tipHeight int, size int64) (int, error) {
+	var total int64
+
+	height := tipHeight
+	for ; height >= getPrunedHeight(tx); height-- {
+		hash, err := getHashAtHeight(tx, height)
+		if err != nil {
+			return 0, err
+		}
+
+		total += int64(len(tx.Blocks().Get(hash)) + len(tx.Index(undoIndex).Get(hash)))
+		if total > size && tipHeight-height >= minPruneBlocks {
+			break
+		}
+	}
+
+	return height + 1, nil
+}
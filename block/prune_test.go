@@ -0,0 +1,204 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// utxoValues returns the value of every output of the UTXO set by txid:vout
+func utxoValues(t *testing.T, bc *Blockchain) map[string]int {
+	values := make(map[string]int)
+
+	err := bc.store.View(func(tx StoreTx) error {
+		return tx.UTXO().ForEach(func(k, v []byte) error {
+			outputs := DeserializeOutputs(v)
+			for idx, out := range outputs.Outputs {
+				values[fmt.Sprintf("%x:%d", k, outputs.Index(idx))] = out.Value
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return values
+}
+
+// chainUTXOValues returns the values of the unspent outputs found by scanning the main chain
+func chainUTXOValues(bc *Blockchain) map[string]int {
+	values := make(map[string]int)
+
+	for id, outputs := range bc.FindUTXO() {
+		txID, _ := hex.DecodeString(id)
+		for idx, out := range outputs.Outputs {
+			values[fmt.Sprintf("%x:%d", txID, outputs.Index(idx))] = out.Value
+		}
+	}
+
+	return values
+}
+
+func TestParsePruneTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PruneTarget
+		err  bool
+	}{
+		{"", PruneTarget{}, false},
+		{"0", PruneTarget{}, false},
+		{"1000", PruneTarget{Blocks: 1000}, false},
+		{"550MB", PruneTarget{Bytes: 550 << 20}, false},
+		{"2mb", PruneTarget{Bytes: 2 << 20}, false},
+		{"5", PruneTarget{}, true},
+		{"-1", PruneTarget{}, true},
+		{"MB", PruneTarget{}, true},
+		{"lots", PruneTarget{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParsePruneTarget(test.in)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("ParsePruneTarget(%q) = %+v, %v", test.in, got, err)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	bc := newTestChain(t)
+	chain := storeTestChain(t, bc, 30)
+
+	if pruned, err := bc.Prune(PruneTarget{}); err != nil || pruned != 0 {
+		t.Fatalf("disabled pruning pruned %d blocks: %v", pruned, err)
+	}
+
+	pruned, err := bc.Prune(PruneTarget{Blocks: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 18 || bc.PrunedHeight() != 18 {
+		t.Fatalf("pruned %d blocks up to height %d, want 18", pruned, bc.PrunedHeight())
+	}
+
+	if _, err := bc.GetBlock(chain[17].Hash); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("GetBlock of a pruned block returned %v", err)
+	}
+	if _, err := bc.GetBlockByHeight(5); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("GetBlockByHeight of a pruned block returned %v", err)
+	}
+	if block, err := bc.GetBlockByHeight(18); err != nil || !bytes.Equal(block.Hash, chain[18].Hash) {
+		t.Fatalf("GetBlockByHeight(18) = %x, %v", block.Hash, err)
+	}
+	if headers := bc.GetHeaders(nil, 100); len(headers) != 30 {
+		t.Fatalf("%d headers are left, want all 30", len(headers))
+	}
+
+	// a block target below the minimum still keeps minPruneBlocks
+	if pruned, err = bc.Prune(PruneTarget{Blocks: 1}); err != nil || pruned != 2 {
+		t.Fatalf("pruned %d blocks below the minimum: %v", pruned, err)
+	}
+	if pruned, err = bc.Prune(PruneTarget{Blocks: 1}); err != nil || pruned != 0 {
+		t.Fatalf("pruning again pruned %d blocks: %v", pruned, err)
+	}
+}
+
+func TestPruneBySize(t *testing.T) {
+	bc := newTestChain(t)
+	chain := storeTestChain(t, bc, 40)
+
+	// the blocks and their undo data differ in size by a byte at most, so 15 of the
+	// largest fit exactly 15
+	var size int64
+	err := bc.store.View(func(tx StoreTx) error {
+		for _, block := range chain {
+			size = max(size, int64(len(tx.Blocks().Get(block.Hash))+len(tx.Index(undoIndex).Get(block.Hash))))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := bc.Prune(PruneTarget{Bytes: 15 * size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 25 || bc.PrunedHeight() != 25 {
+		t.Fatalf("pruned %d blocks up to height %d, want 25", pruned, bc.PrunedHeight())
+	}
+
+	if pruned, err = bc.Prune(PruneTarget{Bytes: 1}); err != nil || bc.PrunedHeight() != 40-minPruneBlocks {
+		t.Fatalf("a tiny size target pruned up to height %d: %v", bc.PrunedHeight(), err)
+	}
+}
+
+func TestUTXOReorganize(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	bc := newTestChain(t)
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	genesis := addTestBlock(t, bc, nil, cbAlice)
+
+	pay := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(4, string(bob.GetAddress())), *NewTXOutput(6, string(alice.GetAddress()))}, txVersion}
+	signTestTx(t, pay, alice, cbAlice)
+	paid := addTestBlock(t, bc, genesis, NewCoinbaseTX(string(NewWallet().GetAddress()), "1"), pay)
+	if got, want := utxoValues(t, bc), chainUTXOValues(bc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after connecting %v, want %v", got, want)
+	}
+
+	// a longer branch without the payment disconnects the block holding it
+	fork := addTestBlock(t, bc, genesis, NewCoinbaseTX(string(NewWallet().GetAddress()), "fork 1"))
+	fork = addTestBlock(t, bc, fork, NewCoinbaseTX(string(NewWallet().GetAddress()), "fork 2"))
+	got, want := utxoValues(t, bc), chainUTXOValues(bc)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after the reorganization %v, want %v", got, want)
+	}
+	if got[fmt.Sprintf("%x:0", cbAlice.ID)] != subsidy {
+		t.Fatal("the output spent by the disconnected block was not restored")
+	}
+
+	err := bc.store.View(func(tx StoreTx) error {
+		if tx.Index(undoIndex).Get(paid.Hash) != nil {
+			t.Error("the disconnected block kept its undo data")
+		}
+		if !bytes.Equal(getUTXOTip(tx), fork.Hash) {
+			t.Errorf("the UTXO set is at %x, want the fork %x", getUTXOTip(tx), fork.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.tip, fork.Hash) {
+		t.Fatal("the fork did not become the main chain")
+	}
+}
+
+func TestSignSpendingPrunedBlock(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	bc := newTestChain(t)
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	prev := addTestBlock(t, bc, nil, cbAlice)
+	for i := 1; i < 20; i++ {
+		prev = addTestBlock(t, bc, prev, NewCoinbaseTX(string(NewWallet().GetAddress()), fmt.Sprint(i)))
+	}
+	if _, err := bc.Prune(PruneTarget{Blocks: minPruneBlocks}); err != nil {
+		t.Fatal(err)
+	}
+
+	pay := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(bob.GetAddress()))}, txVersion}
+	if err := bc.SignTransaction(pay, alice, SigHashAll); err != nil {
+		t.Fatalf("signing an input of a pruned block: %v", err)
+	}
+	pay.ID = pay.Hash()
+	if err := bc.VerifyTransaction(pay); err != nil {
+		t.Fatalf("verifying an input of a pruned block: %v", err)
+	}
+}
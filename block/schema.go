@@ -0,0 +1,117 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// schemaVersionKey is the meta key of the version of the database layout
+const schemaVersionKey = "schemaversion"
+
+// networkKey is the meta key of the name of the network the database belongs to
+const networkKey = "network"
+
+var (
+	ErrSchemaTooNew = errors.New("the database was written by a newer version")
+	ErrWrongNetwork = errors.New("the database belongs to another network")
+)
+
+// migration upgrades a database from the previous schema version
+type migration struct {
+	description string
+	apply       func(tx StoreTx) error
+}
+
+// migrations upgrade a database one version at a time: migrations[i] brings it from
+// version i to version i+1. Databases written before the schema was versioned are
+// version 0, and each step must accept one already partly in the newer layout.
+var migrations = []migration{
+	{"rewrite gob records in the canonical encoding", func(tx StoreTx) error {
+		_, err := migrateEncoding(tx)
+		return err
+	}},
+	{"store headers apart from blocks", indexHeaders},
+	{"index main chain heights", indexHeights},
+	{"record the block the UTXO set is at, with undo data", migrateChainState},
+}
+
+// schemaVersion is the version of the databases written by this version
+var schemaVersion = len(migrations)
+
+func encodeSchemaVersion(version int) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(version))
+
+	return data
+}
+
+// getSchemaVersion returns the schema version of the database, 0 when it predates versioning
+func getSchemaVersion(tx StoreTx) int {
+	data := tx.Index(metaBucket).Get([]byte(schemaVersionKey))
+	if len(data) != 4 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint32(data))
+}
+
+// checkSchema refuses a database of another network or a newer schema, and returns
+// its schema version. A database without a network takes the network of the node,
+// and an empty one gets the latest schema version.
+func checkSchema(tx StoreTx) (int, error) {
+	meta := tx.Index(metaBucket)
+
+	network := meta.Get([]byte(networkKey))
+	if network == nil {
+		if err := meta.Put([]byte(networkKey), []byte(activeNetwork)); err != nil {
+			return 0, err
+		}
+	} else if Network(network) != activeNetwork {
+		return 0, fmt.Errorf("%w: %q, this node is on %q", ErrWrongNetwork, network, activeNetwork)
+	}
+
+	version := getSchemaVersion(tx)
+	if version == 0 && tx.Tip() == nil && isEmpty(tx.Blocks()) {
+		version = schemaVersion
+		if err := meta.Put([]byte(schemaVersionKey), encodeSchemaVersion(version)); err != nil {
+			return 0, err
+		}
+	}
+	if version > schemaVersion {
+		return 0, fmt.Errorf("%w: schema version %d, this version reads up to %d", ErrSchemaTooNew, version, schemaVersion)
+	}
+
+	return version, nil
+}
+
+// migrateSchema checks the database and upgrades it to the latest schema version,
+// returning the version it was at. Each step is committed with its version, so an
+// interrupted upgrade resumes from the last step completed.
+func migrateSchema(store ChainStore) (int, error) {
+	from := -1
+
+	for {
+		done := false
+
+		err := store.Update(func(tx StoreTx) error {
+			version, err := checkSchema(tx)
+			if from < 0 {
+				from = version
+			}
+			if err != nil || version == schemaVersion {
+				done = true
+				return err
+			}
+
+			step := migrations[version]
+			if err := step.apply(tx); err != nil {
+				return fmt.Errorf("upgrading the database to schema version %d (%s): %w", version+1, step.description, err)
+			}
+			return tx.Index(metaBucket).Put([]byte(schemaVersionKey), encodeSchemaVersion(version+1))
+		})
+		if err != nil || done {
+			return from, err
+		}
+	}
+}
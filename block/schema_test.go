@@ -0,0 +1,110 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// storedSchema returns the schema version and network recorded in store
+func storedSchema(t *testing.T, store ChainStore) (int, Network) {
+	var version int
+	var network Network
+
+	err := store.View(func(tx StoreTx) error {
+		version = getSchemaVersion(tx)
+		network = Network(tx.Index(metaBucket).Get([]byte(networkKey)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return version, network
+}
+
+func TestNewStoreSchema(t *testing.T) {
+	bc := newTestChain(t)
+	if version, network := storedSchema(t, bc.store); version != schemaVersion || network != MainNet {
+		t.Fatalf("new database at schema version %d on network %q", version, network)
+	}
+
+	if from, err := migrateSchema(bc.store); err != nil || from != schemaVersion {
+		t.Fatalf("migrating a new database started from version %d: %v", from, err)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+	want := utxoValues(t, bc)
+
+	// the first databases only had blocks, the tip and the UTXO set
+	err := bc.store.Update(func(tx StoreTx) error {
+		for _, name := range []string{headersBucket, heightIndex, undoIndex, metaBucket} {
+			if err := tx.DeleteIndex(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, err := migrateSchema(bc.store)
+	if err != nil || from != 0 {
+		t.Fatalf("migrated from version %d: %v", from, err)
+	}
+	if version, network := storedSchema(t, bc.store); version != schemaVersion || network != MainNet {
+		t.Fatalf("migrated database at schema version %d on network %q", version, network)
+	}
+
+	reopened, err := OpenBlockchain(bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, height, err := reopened.GetBlockHeader(blocks[2].Hash); err != nil || height != 2 {
+		t.Fatalf("header of the tip at height %d: %v", height, err)
+	}
+	checkHeightIndex(t, reopened, blocks)
+	if got := utxoValues(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after the migration %v, want %v", got, want)
+	}
+	err = bc.store.View(func(tx StoreTx) error {
+		if !bytes.Equal(getUTXOTip(tx), blocks[2].Hash) || tx.Index(undoIndex).Get(blocks[2].Hash) == nil {
+			t.Error("the chain state was not migrated")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaRefuses(t *testing.T) {
+	bc := newTestChain(t)
+	storeTestChain(t, bc, 2)
+
+	SetNetwork(TestNet)
+	_, err := OpenBlockchain(bc.store)
+	SetNetwork(MainNet)
+	if !errors.Is(err, ErrWrongNetwork) {
+		t.Fatalf("opening a database of another network returned %v", err)
+	}
+
+	err = bc.store.Update(func(tx StoreTx) error {
+		return tx.Index(metaBucket).Put([]byte(schemaVersionKey), encodeSchemaVersion(schemaVersion+1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBlockchain(bc.store); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("opening a database of a newer schema returned %v", err)
+	}
+
+	if _, err := ParseNetwork("regtest"); !errors.Is(err, ErrUnknownNetwork) {
+		t.Fatalf("parsing an unknown network returned %v", err)
+	}
+}
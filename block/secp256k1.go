@@ -0,0 +1,288 @@
+package block
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+)
+
+// secp256k1 domain parameters (y^2 = x^3 + 7 over GF(p))
+var (
+	secpP, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	secpN, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+	secpB     = big.NewInt(7)
+
+	secpG         = &secpPoint{secpGx, secpGy}
+	secpHalfOrder = new(big.Int).Rsh(secpN, 1)
+	secpSqrtExp   = new(big.Int).Rsh(new(big.Int).Add(secpP, big.NewInt(1)), 2) // (p+1)/4
+)
+
+// secpPoint is an affine point on secp256k1, nil represents the point at infinity
+type secpPoint struct {
+	X, Y *big.Int
+}
+
+// secpCurveRHS returns x^3 + 7 mod p
+func secpCurveRHS(x *big.Int) *big.Int {
+	rhs := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	rhs.Add(rhs, secpB)
+
+	return rhs.Mod(rhs, secpP)
+}
+
+func secpAdd(a, b *secpPoint) *secpPoint {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	var lambda *big.Int
+	if a.X.Cmp(b.X) == 0 {
+		sum := new(big.Int).Add(a.Y, b.Y)
+		if sum.Mod(sum, secpP).Sign() == 0 {
+			return nil // a == -b
+		}
+
+		// doubling: lambda = 3x^2 / 2y
+		num := new(big.Int).Mul(a.X, a.X)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.Y, 1)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	} else {
+		// addition: lambda = (y2 - y1) / (x2 - x1)
+		num := new(big.Int).Sub(b.Y, a.Y)
+		den := new(big.Int).Sub(b.X, a.X)
+		den.Mod(den, secpP)
+		lambda = num.Mul(num, den.ModInverse(den, secpP))
+	}
+	lambda.Mod(lambda, secpP)
+
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.X)
+	x.Sub(x, b.X)
+	x.Mod(x, secpP)
+
+	y := new(big.Int).Sub(a.X, x)
+	y.Mul(y, lambda)
+	y.Sub(y, a.Y)
+	y.Mod(y, secpP)
+
+	return &secpPoint{x, y}
+}
+
+func secpScalarMult(p *secpPoint, k *big.Int) *secpPoint {
+	var result *secpPoint
+
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = secpAdd(result, result)
+		if k.Bit(i) == 1 {
+			result = secpAdd(result, p)
+		}
+	}
+
+	return result
+}
+
+func secpScalarBaseMult(k *big.Int) *secpPoint {
+	return secpScalarMult(secpG, k)
+}
+
+// secpLiftX returns the point with the given x coordinate and an even y, if it exists
+func secpLiftX(x *big.Int) *secpPoint {
+	if x.Cmp(secpP) >= 0 {
+		return nil
+	}
+
+	rhs := secpCurveRHS(x)
+	y := new(big.Int).Exp(rhs, secpSqrtExp, secpP)
+	if new(big.Int).Exp(y, big.NewInt(2), secpP).Cmp(rhs) != 0 {
+		return nil
+	}
+	if y.Bit(0) == 1 {
+		y.Sub(secpP, y)
+	}
+
+	return &secpPoint{new(big.Int).Set(x), y}
+}
+
+// secpCompress encodes a point as 0x02/0x03 || X
+func secpCompress(p *secpPoint) []byte {
+	prefix := byte(0x02)
+	if p.Y.Bit(0) == 1 {
+		prefix = 0x03
+	}
+
+	return append([]byte{prefix}, padBytes(p.X.Bytes(), coordinateLen)...)
+}
+
+func secpDecompress(data []byte) (*secpPoint, error) {
+	if len(data) != coordinateLen+1 || (data[0] != 0x02 && data[0] != 0x03) {
+		return nil, ErrInvalidPubKey
+	}
+
+	p := secpLiftX(new(big.Int).SetBytes(data[1:]))
+	if p == nil {
+		return nil, ErrInvalidPubKey
+	}
+	if data[0] == 0x03 {
+		p.Y.Sub(secpP, p.Y)
+	}
+
+	return p, nil
+}
+
+// secpGenerateKey returns a random secret scalar in [1, n-1]
+func secpGenerateKey() (*big.Int, error) {
+	for {
+		d, err := rand.Int(rand.Reader, secpN)
+		if err != nil {
+			return nil, err
+		}
+		if d.Sign() > 0 {
+			return d, nil
+		}
+	}
+}
+
+// secpParseSecret decodes a 32-byte secret scalar
+func secpParseSecret(secret []byte) (*big.Int, error) {
+	d := new(big.Int).SetBytes(secret)
+	if len(secret) != coordinateLen || d.Sign() == 0 || d.Cmp(secpN) >= 0 {
+		return nil, ErrInvalidSecretKey
+	}
+
+	return d, nil
+}
+
+// secpECDSASign signs a 32-byte hash, returning r and a low s
+func secpECDSASign(d *big.Int, hash []byte) (*big.Int, *big.Int, error) {
+	z := new(big.Int).SetBytes(hash)
+
+	for {
+		k, err := secpGenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r := new(big.Int).Mod(secpScalarBaseMult(k).X, secpN)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		s := new(big.Int).Mul(r, d)
+		s.Add(s, z)
+		s.Mul(s, new(big.Int).ModInverse(k, secpN))
+		s.Mod(s, secpN)
+		if s.Sign() == 0 {
+			continue
+		}
+		if s.Cmp(secpHalfOrder) > 0 {
+			s.Sub(secpN, s)
+		}
+
+		return r, s, nil
+	}
+}
+
+func secpECDSAVerify(pub *secpPoint, hash []byte, r, s *big.Int) bool {
+	z := new(big.Int).SetBytes(hash)
+	w := new(big.Int).ModInverse(s, secpN)
+
+	u1 := new(big.Int).Mul(z, w)
+	u1.Mod(u1, secpN)
+	u2 := new(big.Int).Mul(r, w)
+	u2.Mod(u2, secpN)
+
+	p := secpAdd(secpScalarBaseMult(u1), secpScalarMult(pub, u2))
+	if p == nil {
+		return false
+	}
+
+	return new(big.Int).Mod(p.X, secpN).Cmp(r) == 0
+}
+
+// taggedHash implements the BIP340 tagged hash SHA256(SHA256(tag) || SHA256(tag) || msg)
+func taggedHash(tag string, msg ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, m := range msg {
+		h.Write(m)
+	}
+
+	return h.Sum(nil)
+}
+
+// schnorrSign produces a BIP340 signature R.x || s over a 32-byte message
+func schnorrSign(d *big.Int, msg, aux []byte) ([]byte, error) {
+	p := secpScalarBaseMult(d)
+	if p.Y.Bit(0) == 1 {
+		d = new(big.Int).Sub(secpN, d)
+	}
+	px := padBytes(p.X.Bytes(), coordinateLen)
+
+	t := padBytes(d.Bytes(), coordinateLen)
+	auxHash := taggedHash("BIP0340/aux", aux)
+	masked := make([]byte, coordinateLen)
+	for i := range masked {
+		masked[i] = t[i] ^ auxHash[i]
+	}
+
+	k := new(big.Int).SetBytes(taggedHash("BIP0340/nonce", masked, px, msg))
+	k.Mod(k, secpN)
+	if k.Sign() == 0 {
+		return nil, ErrInvalidSecretKey
+	}
+
+	r := secpScalarBaseMult(k)
+	if r.Y.Bit(0) == 1 {
+		k.Sub(secpN, k)
+	}
+	rx := padBytes(r.X.Bytes(), coordinateLen)
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", rx, px, msg))
+	e.Mod(e, secpN)
+
+	s := e.Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, secpN)
+
+	return append(rx, padBytes(s.Bytes(), coordinateLen)...), nil
+}
+
+// schnorrVerify checks a BIP340 signature against an x-only public key
+func schnorrVerify(pubKey, msg, sig []byte) error {
+	if len(pubKey) != coordinateLen {
+		return ErrInvalidPubKey
+	}
+	p := secpLiftX(new(big.Int).SetBytes(pubKey))
+	if p == nil {
+		return ErrInvalidPubKey
+	}
+
+	if len(sig) != signatureLen {
+		return ErrInvalidSignature
+	}
+	r := new(big.Int).SetBytes(sig[:coordinateLen])
+	s := new(big.Int).SetBytes(sig[coordinateLen:])
+	if r.Cmp(secpP) >= 0 || s.Cmp(secpN) >= 0 {
+		return ErrInvalidSignature
+	}
+
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", sig[:coordinateLen], pubKey, msg))
+	e.Sub(secpN, e.Mod(e, secpN))
+
+	// R = s*G - e*P
+	point := secpAdd(secpScalarBaseMult(s), secpScalarMult(p, e))
+	if point == nil || point.Y.Bit(0) == 1 || point.X.Cmp(r) != 0 {
+		return ErrSignatureMismatch
+	}
+
+	return nil
+}
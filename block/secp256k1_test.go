@@ -0,0 +1,113 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// BIP340 test vectors 0 and 1
+func TestSchnorrVectors(t *testing.T) {
+	vectors := []struct {
+		secret, pubKey, aux, msg, sig string
+	}{
+		{
+			"0000000000000000000000000000000000000000000000000000000000000003",
+			"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+		},
+		{
+			"B7E151628AED2A6ABF7158809CF4F3C762E7160F38B4DA56A784D9045190CFEF",
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+		},
+	}
+
+	for i, v := range vectors {
+		d := new(big.Int).SetBytes(decodeHex(t, v.secret))
+		pubKey := decodeHex(t, v.pubKey)
+		msg := decodeHex(t, v.msg)
+
+		if x := padBytes(secpScalarBaseMult(d).X.Bytes(), coordinateLen); !bytes.Equal(x, pubKey) {
+			t.Errorf("vector %d: public key %X, want %X", i, x, pubKey)
+		}
+
+		sig, err := schnorrSign(d, msg, decodeHex(t, v.aux))
+		if err != nil {
+			t.Fatalf("vector %d: %s", i, err)
+		}
+		if !bytes.Equal(sig, decodeHex(t, v.sig)) {
+			t.Errorf("vector %d: signature %X, want %s", i, sig, v.sig)
+		}
+
+		if err := schnorrVerify(pubKey, msg, sig); err != nil {
+			t.Errorf("vector %d: %s", i, err)
+		}
+
+		sig[0] ^= 1
+		if err := schnorrVerify(pubKey, msg, sig); err == nil {
+			t.Errorf("vector %d: tampered signature accepted", i)
+		}
+	}
+}
+
+func TestSecp256k1ECDSA(t *testing.T) {
+	wallet, err := NewWalletWithScheme(SchemeSecp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("secp256k1"))
+
+	sig, err := wallet.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature(wallet.PublicKey, hash[:], sig); err != nil {
+		t.Fatalf("valid signature rejected: %s", err)
+	}
+
+	other := sha256.Sum256([]byte("other"))
+	if err := verifySignature(wallet.PublicKey, other[:], sig); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrSignatureMismatch)
+	}
+
+	// high S is not canonical
+	s := new(big.Int).SetBytes(sig[coordinateLen:])
+	highS := append(sig[:coordinateLen:coordinateLen], padBytes(new(big.Int).Sub(secpN, s).Bytes(), coordinateLen)...)
+	if err := verifySignature(wallet.PublicKey, hash[:], highS); !errors.Is(err, ErrHighS) {
+		t.Fatalf("got %v, want %v", err, ErrHighS)
+	}
+}
+
+func TestAddressVersionEncodesScheme(t *testing.T) {
+	for _, scheme := range []SigScheme{SchemeP256, SchemeSecp256k1, SchemeSchnorr} {
+		wallet, err := NewWalletWithScheme(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := string(wallet.GetAddress())
+
+		if !ValidateAddress(address) {
+			t.Errorf("%s: address %s is not valid", scheme, address)
+		}
+		if version := Base58Decode([]byte(address))[0]; SigScheme(version) != scheme {
+			t.Errorf("%s: address version %d", scheme, version)
+		}
+	}
+}
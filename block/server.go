@@ -2,27 +2,72 @@ package block
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
-const commandLength = 12
+
+// snapshotValidationBatch is the number of blocks validated at a time below a UTXO snapshot
+const snapshotValidationBatch = 100
 
 var nodeAddress string
 var miningAddress string
-var knownNodes = []string{"localhost:3000"}
+
+// peerManager chooses the peers of a running node, nil in other commands
+var peerManager *PeerManager
+
 var blocksInTransit = [][]byte{}
 var mempool = make(map[string]Transaction)
 
+// nodeMu is held while a message is handled. Every peer is read on its own goroutine,
+// and the handlers share the chain, the mempool and the blocks in transit.
+var nodeMu sync.Mutex
+
+// bestHeight and prunedHeight are the heights announced in version messages, updated
+// after every message handled. Versions are sent from any goroutine, including those
+// of handlers, so the heights are not read from the chain then.
+var bestHeight, prunedHeight atomic.Int64
+
+// pruneTarget is how much block data the node keeps, see PruneTarget
+var pruneTarget PruneTarget
+
+// peerFilters holds the bloom filter loaded by each light client, by address
+var peerFilters = make(map[string]*BloomFilter)
+var peerFiltersMu sync.Mutex
+
 type addr struct {
-	AddrList []string
+	AddrList []AddrInfo
+}
+
+// getaddr asks a peer for the addresses it knows
+type getaddr struct {
+	AddrFrom string
+}
+
+// nodecommand asks a running node to addnode, connect to or disconnect Addr. It is
+// only accepted from the same machine, with the cookie the node wrote in its files.
+type nodecommand struct {
+	Addr   string
+	Cookie string
+}
+
+// noderesult answers a nodecommand or a getpeerinfo, with an error when Err is set
+type noderesult struct {
+	Err   string
+	Peers []PeerInfo
 }
 
 type block struct {
@@ -34,205 +79,332 @@ type getblocks struct {
 	AddrFrom string
 }
 
-type getdata struct {
+type getheaders struct {
 	AddrFrom string
-	Type     string
-	ID       []byte
+	Locator  [][]byte
 }
 
-type inv struct {
+type headers struct {
 	AddrFrom string
-	Type     string
-	Items    [][]byte
+	Headers  [][]byte
 }
 
-type tx struct {
-	AddFrom     string
-	Transaction []byte
+type filterload struct {
+	AddrFrom string
+	Filter   BloomFilter
 }
 
-type verzion struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+type filteradd struct {
+	AddrFrom string
+	Data     []byte
 }
 
-func commandToBytes(command string) []byte {
-	var bytes [commandLength]byte
+type filterclear struct {
+	AddrFrom string
+}
 
-	for i, c := range command {
-		bytes[i] = byte(c)
-	}
+type filterack struct {
+	AddrFrom string
+}
 
-	return bytes[:]
+// merkleblock answers a getdata for a filtered block with the header and the
+// transactions matching the peer's filter, each with its Merkle proof
+type merkleblock struct {
+	AddrFrom     string
+	Header       []byte
+	Transactions [][]byte
+	Proofs       [][]byte
 }
 
-func bytesToCommand(bytes []byte) string {
-	var command []byte
+type getdata struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
 
-	for _, b := range bytes {
-		if b != 0x0 {
-			command = append(command, b)
-		}
-	}
+// notfound answers a getdata for data the node does not have, such as a pruned block
+type notfound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
 
-	return fmt.Sprintf("%s", command)
+type inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
 }
 
-func extractCommand(request []byte) []byte {
-	return request[:commandLength]
+type tx struct {
+	AddFrom     string
+	Transaction []byte
 }
 
-func requestBlocks() {
-	for _, node := range knownNodes {
-		sendGetBlocks(node)
-	}
+// verzion opens every connection, each node introducing itself to the other, which
+// answers with a verack
+type verzion struct {
+	Version      int // protocol version
+	Services     ServiceFlag
+	UserAgent    string
+	Timestamp    int64
+	Nonce        uint64 // random for every process, to detect connections to self
+	BestHeight   int
+	AddrFrom     string
+	PrunedHeight int      // lowest height the node serves blocks from, 0 unless pruned
+	Features     []string // optional features the node supports
 }
 
-func sendAddr(address string) {
-	nodes := addr{knownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := gobEncode(nodes)
-	request := append(commandToBytes("addr"), payload...)
+func sendAddr(address string, addrs []AddrInfo) {
+	payload := gobEncode(addr{addrs})
+	sendData(address, "addr", payload)
+}
 
-	sendData(address, request)
+func sendGetAddr(address string) {
+	payload := gobEncode(getaddr{nodeAddress})
+	sendData(address, "getaddr", payload)
 }
 
 func sendBlock(addr string, b *Block) {
 	data := block{nodeAddress, b.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
+	sendData(addr, "block", payload)
+}
 
-	sendData(addr, request)
+// sendData sends a message to the node at addr, connecting to it if needed
+func sendData(addr, command string, payload []byte) {
+	msg, err := encodeMessage(command, payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if p := connectNode(addr); p != nil {
+		p.push(msg)
+	}
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// connectNode returns the connected peer at addr, connecting to it if needed, or nil
+// when it is not available
+func connectNode(addr string) *peer {
+	p, err := connectPeer(addr, handleMessage)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
+		if peerManager != nil {
+			peerManager.failed(addr)
 		}
 
-		knownNodes = updatedNodes
-
-		return
+		return nil
 	}
-	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
-	}
+	return p
 }
 
 func sendInv(address, kind string, items [][]byte) {
 	inventory := inv{nodeAddress, kind, items}
 	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-
-	sendData(address, request)
+	sendData(address, "inv", payload)
 }
 
 func sendGetBlocks(address string) {
 	payload := gobEncode(getblocks{nodeAddress})
-	request := append(commandToBytes("getblocks"), payload...)
+	sendData(address, "getblocks", payload)
+}
 
-	sendData(address, request)
+func sendGetHeaders(address string, locator [][]byte) {
+	payload := gobEncode(getheaders{nodeAddress, locator})
+	sendData(address, "getheaders", payload)
+}
+
+func sendHeaders(address string, chain []BlockHeader) {
+	var items [][]byte
+	for i := range chain {
+		items = append(items, chain[i].Serialize())
+	}
+
+	payload := gobEncode(headers{nodeAddress, items})
+	sendData(address, "headers", payload)
+}
+
+func sendFilterLoad(address string, filter *BloomFilter) {
+	payload := gobEncode(filterload{nodeAddress, *filter})
+	sendData(address, "filterload", payload)
+}
+
+// sendFilterAck confirms a filterload, so that a client knows the filter is in place
+// before requesting blocks
+func sendFilterAck(address string) {
+	payload := gobEncode(filterack{nodeAddress})
+	sendData(address, "filterack", payload)
+}
+
+func sendMerkleBlock(address string, b *Block, txs []*Transaction, proofs []MerkleProof) {
+	data := merkleblock{AddrFrom: nodeAddress, Header: b.BlockHeader.Serialize()}
+	for i := range txs {
+		data.Transactions = append(data.Transactions, txs[i].Serialize())
+		data.Proofs = append(data.Proofs, EncodeMerkleProof(&proofs[i]))
+	}
+
+	payload := gobEncode(data)
+	sendData(address, "merkleblock", payload)
 }
 
 func sendGetData(address, kind string, id []byte) {
 	payload := gobEncode(getdata{nodeAddress, kind, id})
-	request := append(commandToBytes("getdata"), payload...)
+	sendData(address, "getdata", payload)
+}
 
-	sendData(address, request)
+func sendNotFound(address, kind string, id []byte) {
+	payload := gobEncode(notfound{nodeAddress, kind, id})
+	sendData(address, "notfound", payload)
 }
 
 func sendTx(addr string, tnx *Transaction) {
 	data := tx{nodeAddress, tnx.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
-
-	sendData(addr, request)
+	sendData(addr, "tx", payload)
 }
 
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
+func handleAddr(request []byte) error {
+	var buff bytes.Buffer
+	var payload addr
 
-	request := append(commandToBytes("version"), payload...)
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: addr: %s", ErrBadMessage, err)
+	}
+
+	if peerManager == nil {
+		return nil
+	}
+	peerManager.AddAddrs(payload.AddrList)
+	fmt.Printf("There are %d known nodes now!\n", len(peerManager.Addrs()))
 
-	sendData(addr, request)
+	return nil
 }
 
-func handleAddr(request []byte) {
+func handleGetAddr(p *peer, request []byte) error {
 	var buff bytes.Buffer
-	var payload addr
+	var payload getaddr
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: getaddr: %s", ErrBadMessage, err)
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+	if peerManager != nil {
+		sendAddr(p.address(), peerManager.gossiped())
+	}
+
+	return nil
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
+func handleBlock(p *peer, request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload block
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: block: %s", ErrBadMessage, err)
 	}
 
 	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block, err := DecodeBlock(blockData)
+	if err != nil {
+		return fmt.Errorf("%w: block: %s", ErrBadMessage, err)
+	}
 
 	fmt.Println("Recevied a new block!")
-	bc.AddBlock(block)
+	if err := CheckBlock(block); err != nil {
+		return err
+	}
+	oldTip := bc.tip
+	err = bc.AddBlock(block)
+	if errors.Is(err, ErrOrphanBlock) || errors.Is(err, ErrBlockNotFound) || errors.Is(err, ErrBlockPruned) {
+		// the block may be valid, the node lacks the blocks to tell
+		fmt.Printf("Ignored block %x: %s\n", block.Hash, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
+	if !bytes.Equal(oldTip, bc.tip) {
+		pruneChain(bc)
+	}
+
+	// the new tip is announced once the blocks in transit are all received
+	if len(blocksInTransit) == 0 && !bytes.Equal(oldTip, bc.tip) {
+		relayInv(p.address(), "block", bc.tip)
+	}
+	requestNextBlock(p.address())
+
+	return nil
+}
+
+// relayInv announces an item to every peer but the one it came from
+func relayInv(from, kind string, id []byte) {
+	for _, node := range readyPeers() {
+		if node != from {
+			sendInv(node, kind, [][]byte{id})
+		}
+	}
+}
+
+// requestNextBlock asks address for the next block in transit, if any
+func requestNextBlock(address string) {
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+		sendGetData(address, "block", blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
 	}
 }
 
-func handleInv(request []byte, bc *Blockchain) {
+// pruneChain prunes the blocks falling below the prune target after the tip moved.
+// The UTXO set moved with the tip when the block was connected.
+func pruneChain(bc *Blockchain) {
+	if pruned, err := bc.Prune(pruneTarget); err != nil {
+		fmt.Printf("ERROR: Pruning failed: %s\n", err)
+	} else if pruned > 0 {
+		fmt.Printf("Pruned %d blocks\n", pruned)
+	}
+}
+
+func handleInv(p *peer, request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload inv
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: inv: %s", ErrBadMessage, err)
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+		// blocks already stored, or pruned, are not downloaded again
+		var missing [][]byte
+		for _, hash := range payload.Items {
+			if _, err := bc.GetBlock(hash); err != nil && !errors.Is(err, ErrBlockPruned) {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		blocksInTransit = missing
 
-		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+		blockHash := missing[0]
+		sendGetData(p.address(), "block", blockHash)
 
 		newInTransit := [][]byte{}
 		for _, b := range blocksInTransit {
@@ -244,201 +416,676 @@ func handleInv(request []byte, bc *Blockchain) {
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
-
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		for _, txID := range payload.Items {
+			if mempool[hex.EncodeToString(txID)].ID == nil {
+				sendGetData(p.address(), "tx", txID)
+			}
 		}
 	}
+
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *Blockchain) {
+func handleGetBlocks(p *peer, request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload getblocks
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: getblocks: %s", ErrBadMessage, err)
 	}
 
 	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	sendInv(p.address(), "block", blocks)
+
+	return nil
+}
+
+func handleGetHeaders(p *peer, request []byte, bc *Blockchain) error {
+	var buff bytes.Buffer
+	var payload getheaders
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: getheaders: %s", ErrBadMessage, err)
+	}
+
+	sendHeaders(p.address(), bc.GetHeaders(payload.Locator, maxHeadersPerMessage))
+
+	return nil
+}
+
+// handleHeaders stores the announced headers and requests the blocks whose bodies are missing
+func handleHeaders(p *peer, request []byte, bc *Blockchain) error {
+	var buff bytes.Buffer
+	var payload headers
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: headers: %s", ErrBadMessage, err)
+	}
+
+	fmt.Printf("Recevied %d headers\n", len(payload.Headers))
+
+	var missing [][]byte
+	for _, data := range payload.Headers {
+		header, err := DecodeHeader(data)
+		if err == nil {
+			err = bc.AddHeader(&header)
+		}
+		if err != nil {
+			fmt.Printf("Rejected header: %s\n", err)
+			break
+		}
+
+		if _, err := bc.GetBlock(header.Hash()); err != nil {
+			missing = append(missing, header.Hash())
+		}
+	}
+
+	if len(missing) > 0 {
+		blocksInTransit = missing[1:]
+		sendGetData(p.address(), "block", missing[0])
+	}
+
+	return nil
+}
+
+func handleFilterLoad(p *peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload filterload
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: filterload: %s", ErrBadMessage, err)
+	}
+
+	if err := payload.Filter.Validate(); err != nil {
+		fmt.Printf("Rejected filter from %s: %s\n", p.address(), err)
+		return nil
+	}
+
+	peerFiltersMu.Lock()
+	peerFilters[p.address()] = &payload.Filter
+	peerFiltersMu.Unlock()
+
+	sendFilterAck(p.address())
+
+	return nil
+}
+
+func handleFilterAdd(p *peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload filteradd
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: filteradd: %s", ErrBadMessage, err)
+	}
+
+	if len(payload.Data) > maxFilterAddSize {
+		fmt.Printf("Rejected filteradd from %s: %d bytes\n", p.address(), len(payload.Data))
+		return nil
+	}
+
+	peerFiltersMu.Lock()
+	if filter := peerFilters[p.address()]; filter != nil {
+		filter.Add(payload.Data)
+	}
+	peerFiltersMu.Unlock()
+
+	return nil
+}
+
+func handleFilterClear(p *peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload filterclear
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: filterclear: %s", ErrBadMessage, err)
+	}
+
+	peerFiltersMu.Lock()
+	delete(peerFilters, p.address())
+	peerFiltersMu.Unlock()
+
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
+// peerHasFilter reports whether a light client loaded a filter from address
+func peerHasFilter(address string) bool {
+	peerFiltersMu.Lock()
+	defer peerFiltersMu.Unlock()
+
+	return peerFilters[address] != nil
+}
+
+// peerWantsTx reports whether a transaction should be relayed to a peer, which is
+// always the case unless the peer loaded a filter that does not match it
+func peerWantsTx(address string, tx *Transaction) bool {
+	peerFiltersMu.Lock()
+	defer peerFiltersMu.Unlock()
+
+	filter := peerFilters[address]
+	return filter == nil || filter.MatchTransaction(tx)
+}
+
+// sendFilteredBlock sends a block to a peer as a merkleblock, holding only the
+// transactions matching the peer's filter
+func sendFilteredBlock(address string, b *Block) {
+	var txs []*Transaction
+	var proofs []MerkleProof
+
+	peerFiltersMu.Lock()
+	filter := peerFilters[address]
+	if filter != nil {
+		for _, tx := range b.Transactions {
+			if !filter.MatchTransaction(tx) {
+				continue
+			}
+			proof, err := b.TxProof(tx.ID)
+			if err != nil {
+				continue
+			}
+			txs = append(txs, tx)
+			proofs = append(proofs, proof.Proof)
+		}
+	}
+	peerFiltersMu.Unlock()
+
+	if filter == nil {
+		fmt.Printf("No filter loaded by %s\n", address)
+		return
+	}
+
+	sendMerkleBlock(address, b, txs, proofs)
+}
+
+func handleGetData(p *peer, request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload getdata
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: getdata: %s", ErrBadMessage, err)
 	}
 
 	if payload.Type == "block" {
 		block, err := bc.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			fmt.Printf("Cannot serve block %x: %s\n", payload.ID, err)
+			sendNotFound(p.address(), payload.Type, payload.ID)
+			return nil
+		}
+
+		sendBlock(p.address(), &block)
+	}
+
+	if payload.Type == "filtered_block" {
+		block, err := bc.GetBlock([]byte(payload.ID))
+		if err != nil {
+			fmt.Printf("Cannot serve block %x: %s\n", payload.ID, err)
+			sendNotFound(p.address(), payload.Type, payload.ID)
+			return nil
 		}
 
-		sendBlock(payload.AddrFrom, &block)
+		sendFilteredBlock(p.address(), &block)
 	}
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := mempool[txID]
+		if !ok {
+			sendNotFound(p.address(), payload.Type, payload.ID)
+			return nil
+		}
 
-		sendTx(payload.AddrFrom, &tx)
+		sendTx(p.address(), &tx)
 		// delete(mempool, txID)
 	}
+
+	return nil
 }
 
-func handleTx(request []byte, bc *Blockchain) {
+// handleNotFound skips data a peer could not send, moving on to the next block in transit
+func handleNotFound(p *peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload notfound
+
+	buff.Write(request)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: notfound: %s", ErrBadMessage, err)
+	}
+
+	fmt.Printf("%s does not have %s %x\n", p.address(), payload.Type, payload.ID)
+	if payload.Type == "block" {
+		requestNextBlock(p.address())
+	}
+
+	return nil
+}
+
+func handleTx(p *peer, request []byte, bc *Blockchain) error {
 	var buff bytes.Buffer
 	var payload tx
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: tx: %s", ErrBadMessage, err)
 	}
 
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
+	tx, err := DecodeTransaction(txData)
+	if err != nil {
+		return fmt.Errorf("%w: tx: %s", ErrBadMessage, err)
+	}
+	if mempool[hex.EncodeToString(tx.ID)].ID != nil {
+		return nil
+	}
+	if err := bc.VerifyTransaction(&tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return nil
+	}
 	mempool[hex.EncodeToString(tx.ID)] = tx
 
-	if nodeAddress == knownNodes[0] {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
+	for _, node := range readyPeers() {
+		if node != p.address() && peerWantsTx(node, &tx) {
+			sendInv(node, "tx", [][]byte{tx.ID})
 		}
-	} else {
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+	}
 
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
+	if len(mempool) >= 2 && len(miningAddress) > 0 {
+	MineTransactions:
+		var candidates []*Transaction
 
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
+		for id := range mempool {
+			tx := mempool[id]
+			candidates = append(candidates, &tx)
+		}
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
+		txs, rejected, err := bc.selectTransactions(candidates)
+		if err != nil {
+			fmt.Printf("ERROR: Selecting transactions failed: %s\n", err)
+			return nil
+		}
+		for _, tx := range rejected {
+			delete(mempool, hex.EncodeToString(tx.ID))
+		}
 
-			fmt.Println("New block is mined!")
+		if len(txs) == 0 {
+			fmt.Println("All transactions are invalid! Waiting for new ones...")
+			return nil
+		}
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+		cbTx := NewCoinbaseTX(miningAddress, "")
+		txs = append(txs, cbTx)
 
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					sendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+		newBlock, err := bc.MineBlock(txs)
+		if err != nil {
+			fmt.Printf("ERROR: Mining failed: %s\n", err)
+			return nil
+		}
+		pruneChain(bc)
+
+		fmt.Println("New block is mined!")
+
+		for _, tx := range txs {
+			txID := hex.EncodeToString(tx.ID)
+			delete(mempool, txID)
+		}
+
+		relayInv(nodeAddress, "block", newBlock.Hash)
+
+		if len(mempool) > 0 {
+			goto MineTransactions
+		}
+	}
 
-			if len(mempool) > 0 {
-				goto MineTransactions
+	return nil
+}
+
+// handleVersion starts syncing from a node whose chain is longer, once the handshake
+// accepted its version
+func handleVersion(p *peer, bc *Blockchain) {
+	version := p.remote
+	fmt.Printf("%s runs %s, protocol %d, services %s, best height %d\n", p.address(), version.UserAgent, version.Version, version.Services, version.BestHeight)
+
+	// light clients neither serve nor relay blocks
+	if !version.Services.Has(ServiceFullNode) && !version.Services.Has(ServicePruned) {
+		return
+	}
+
+	address := p.address()
+	if peerManager != nil {
+		peerManager.Connected(p)
+	}
+	if !p.inbound {
+		sendGetAddr(address)
+	}
+
+	myBestHeight := bc.GetBestHeight()
+	foreignerBestHeight := version.BestHeight
+
+	if myBestHeight < foreignerBestHeight && version.PrunedHeight > myBestHeight+1 {
+		fmt.Printf("%s is pruned below height %d and cannot serve the blocks after %d\n", address, version.PrunedHeight, myBestHeight)
+	} else if myBestHeight < foreignerBestHeight && p.supports(featureHeaders) {
+		sendGetHeaders(address, [][]byte{bc.tip})
+	} else if myBestHeight < foreignerBestHeight {
+		sendGetBlocks(address)
+	}
+
+	// the blocks below a UTXO snapshot come from the first peer serving them all
+	if _, pending := bc.SnapshotPending(); pending && len(blocksInTransit) == 0 && version.Services.Has(ServiceFullNode) {
+		if missing := bc.snapshotMissingBlocks(); len(missing) > 0 {
+			blocksInTransit = append(blocksInTransit, missing[1:]...)
+			sendGetData(address, "block", missing[0])
+		}
+	}
+}
+
+// nodeCookie is the token expected in the commands of the CLI, written to the cookie
+// file of the node when it starts. Its peers cannot read the file.
+var nodeCookie string
+
+// writeCookie writes a new random token to the cookie file of the node nodeID, which
+// only the user running the node can read
+func writeCookie(nodeID string) (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	cookie := hex.EncodeToString(token)
+
+	path := cookieFile.path(nodeID)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	return cookie, os.WriteFile(path, []byte(cookie), 0600)
+}
+
+// readCookie returns the token of the running node nodeID
+func readCookie(nodeID string) (string, error) {
+	cookie, err := os.ReadFile(cookieFile.path(nodeID))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("node %s is not running", nodeID)
+	}
+
+	return string(cookie), err
+}
+
+// nodeCommandTimeout bounds the time a node takes to run a command of the CLI
+const nodeCommandTimeout = 15 * time.Second
+
+// runNodeCommand sends an addnode, connect, disconnect or getpeerinfo command for addr
+// to the node running at address, along with its cookie, and returns its result
+func runNodeCommand(address, command, addr, cookie string) (noderesult, error) {
+	results := make(chan noderesult, 1)
+	p, err := connectPeer(address, func(p *peer, command string, payload []byte) {
+		var result noderesult
+		if command == "noderesult" && gob.NewDecoder(bytes.NewReader(payload)).Decode(&result) == nil {
+			select {
+			case results <- result:
+			default:
 			}
 		}
+	})
+	if err != nil {
+		return noderesult{}, err
+	}
+	defer p.disconnect()
+
+	sendData(address, command, gobEncode(nodecommand{addr, cookie}))
+	select {
+	case result := <-results:
+		if result.Err != "" {
+			return result, errors.New(result.Err)
+		}
+		return result, nil
+	case <-p.done:
+		return noderesult{}, fmt.Errorf("%s closed the connection", address)
+	case <-time.After(nodeCommandTimeout):
+		return noderesult{}, fmt.Errorf("%s did not answer", address)
 	}
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+// handleNodeCommand runs an addnode, connect, disconnect or getpeerinfo command sent
+// by a CLI command from the same machine
+func handleNodeCommand(p *peer, command string, request []byte) error {
 	var buff bytes.Buffer
-	var payload verzion
+	var payload nodecommand
 
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %s: %s", ErrBadMessage, command, err)
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
-
-	if myBestHeight < foreignerBestHeight {
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		sendVersion(payload.AddrFrom, bc)
+	cookie := subtle.ConstantTimeCompare([]byte(payload.Cookie), []byte(nodeCookie)) == 1
+	if !p.inbound || !isLoopback(p.conn) || peerManager == nil || nodeCookie == "" || !cookie {
+		fmt.Printf("Refused %s command from %s\n", command, p.address())
+		return nil
 	}
 
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	var result noderesult
+	switch command {
+	case "addnode":
+		err = peerManager.AddNode(payload.Addr)
+	case "connect":
+		err = peerManager.Connect(payload.Addr)
+	case "disconnect":
+		err = peerManager.Disconnect(payload.Addr)
+	case "getpeerinfo":
+		result.Peers = peerInfos()
+	}
+	if err != nil {
+		result.Err = err.Error()
 	}
-}
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
+	msg, err := encodeMessage("noderesult", gobEncode(result))
 	if err != nil {
 		log.Panic(err)
 	}
-	command := bytesToCommand(request[:commandLength])
+	p.push(msg)
+
+	return nil
+}
+
+// handleConnection starts exchanging messages with a node that connected to this one
+func handleConnection(conn net.Conn) {
+	acceptPeer(conn, handleMessage)
+}
+
+// misbehaving disconnects a peer that sent an invalid message
+func misbehaving(p *peer, err error) {
+	fmt.Printf("Disconnecting %s: %s\n", p.address(), err)
+	p.disconnect()
+}
+
+// handleCommand handles a message of a peer, disconnecting it when the message is invalid
+func handleCommand(p *peer, command string, request []byte, bc *Blockchain) {
 	fmt.Printf("Received %s command\n", command)
 
+	var err error
 	switch command {
 	case "addr":
-		handleAddr(request)
+		err = handleAddr(request)
+	case "getaddr":
+		err = handleGetAddr(p, request)
+	case "addnode", "connect", "disconnect", "getpeerinfo":
+		err = handleNodeCommand(p, command, request)
 	case "block":
-		handleBlock(request, bc)
+		err = handleBlock(p, request, bc)
 	case "inv":
-		handleInv(request, bc)
+		err = handleInv(p, request, bc)
 	case "getblocks":
-		handleGetBlocks(request, bc)
+		err = handleGetBlocks(p, request, bc)
+	case "getheaders":
+		err = handleGetHeaders(p, request, bc)
+	case "headers":
+		err = handleHeaders(p, request, bc)
+	case "filterload":
+		err = handleFilterLoad(p, request)
+	case "filteradd":
+		err = handleFilterAdd(p, request)
+	case "filterclear":
+		err = handleFilterClear(p, request)
 	case "getdata":
-		handleGetData(request, bc)
+		err = handleGetData(p, request, bc)
+	case "notfound":
+		err = handleNotFound(p, request)
 	case "tx":
-		handleTx(request, bc)
+		err = handleTx(p, request, bc)
 	case "version":
-		handleVersion(request, bc)
+		handleVersion(p, bc)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-	conn.Close()
+	if err != nil {
+		misbehaving(p, err)
+	}
 }
 
-// StartServer starts a node
-func StartServer(nodeID, minerAddress string) {
+// StartServer starts a node, pruning old blocks down to prune when it is enabled and
+// connecting to other nodes as set by config
+func StartServer(nodeID, minerAddress string, prune PruneTarget, config PeerConfig) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	miningAddress = minerAddress
+	pruneTarget = prune
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
 		log.Panic(err)
 	}
 	defer ln.Close()
 
+	peerManager, err = NewPeerManager(nodeID, config)
+	if err != nil {
+		log.Panic(err)
+	}
+	nodeCookie, err = writeCookie(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	bc := NewBlockchain(nodeID)
+	updateHeights := func() {
+		bestHeight.Store(int64(bc.GetBestHeight()))
+		prunedHeight.Store(int64(bc.PrunedHeight()))
+	}
+	handleMessage = func(p *peer, command string, payload []byte) {
+		nodeMu.Lock()
+		defer nodeMu.Unlock()
+
+		handleCommand(p, command, payload, bc)
+		updateHeights()
+	}
+	localServices = ServiceFullNode | ServiceSPV
+	if pruneTarget.Enabled() {
+		localServices = ServicePruned | ServiceSPV
+	}
+	localHeights = func() (int, int) {
+		return int(bestHeight.Load()), int(prunedHeight.Load())
+	}
+
+	// the node stops accepting connections when it is stopped, then shuts down below
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		ln.Close()
+	}()
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc)
+	if pruned, err := bc.Prune(pruneTarget); err != nil {
+		log.Panic(err)
+	} else if pruned > 0 {
+		fmt.Printf("Pruned %d blocks\n", pruned)
+	}
+	updateHeights()
+
+	stopPeers := make(chan struct{})
+	peersStopped := make(chan struct{})
+	go func() {
+		peerManager.Run(stopPeers)
+		close(peersStopped)
+	}()
+
+	if height, pending := bc.SnapshotPending(); pending {
+		fmt.Printf("Validating the blocks below the UTXO snapshot at height %d\n", height)
+		go validateSnapshot(bc)
 	}
 
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			log.Panic(err)
 		}
-		go handleConnection(conn, bc)
+		if !peerManager.AcceptInbound() {
+			fmt.Printf("Refused a connection from %s: too many inbound connections\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		handleConnection(conn)
+	}
+
+	// the message being handled is finished and no other is handled after it, so that
+	// the cached chain state is written back as the handlers left it
+	fmt.Println("Stopping the node")
+	close(stopPeers)
+	<-peersStopped
+	nodeMu.Lock()
+	closePeers()
+	if err := peerManager.Save(); err != nil {
+		fmt.Printf("ERROR: Saving the address book failed: %s\n", err)
+	}
+	bc.CloseDB()
+	_ = os.Remove(cookieFile.path(nodeID))
+}
+
+// validateSnapshot validates the blocks below the snapshot the node was loaded from
+// as they are downloaded
+func validateSnapshot(bc *Blockchain) {
+	validated := 0
+	for {
+		nodeMu.Lock()
+		next, done, err := bc.ValidateSnapshot(snapshotValidationBatch)
+		nodeMu.Unlock()
+		if err != nil {
+			fmt.Printf("ERROR: The UTXO snapshot is invalid: %s\n", err)
+			return
+		}
+		if done {
+			fmt.Println("The UTXO snapshot is valid")
+			return
+		}
+		if next != validated {
+			fmt.Printf("Validated the blocks below the UTXO snapshot up to height %d\n", next-1)
+			validated = next
+		}
+
+		time.Sleep(time.Second)
 	}
 }
 
@@ -453,13 +1100,3 @@ func gobEncode(data interface{}) []byte {
 
 	return buff.Bytes()
 }
-
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
@@ -0,0 +1,90 @@
+package block
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// defaultSigCacheSize is the number of verified inputs remembered by a node
+const defaultSigCacheSize = 50000
+
+// sigCacheKey identifies the check of one input: the transaction, the input index and the signed message
+type sigCacheKey struct {
+	txID    string
+	inID    int
+	sigHash [32]byte
+}
+
+// SigCache remembers successful input signature checks, so that a transaction verified on
+// mempool acceptance isn't verified again when it is mined or arrives in a block.
+// Entries are evicted first-in first-out once the cache is full.
+type SigCache struct {
+	mu      sync.Mutex
+	entries map[sigCacheKey][32]byte // digest of the signature and public key that passed
+	order   []sigCacheKey            // ring of keys in insertion order
+	next    int
+}
+
+// NewSigCache creates a cache holding up to size entries
+func NewSigCache(size int) *SigCache {
+	return &SigCache{
+		entries: make(map[sigCacheKey][32]byte, size),
+		order:   make([]sigCacheKey, size),
+	}
+}
+
+func newSigCacheKey(txID []byte, inID int, sigHash []byte) sigCacheKey {
+	key := sigCacheKey{txID: string(txID), inID: inID}
+	copy(key.sigHash[:], sigHash)
+
+	return key
+}
+
+func sigDigest(sig, pubKey []byte) [32]byte {
+	return sha256.Sum256(append(append([]byte{}, sig...), pubKey...))
+}
+
+// Contains reports whether sig and pubKey were already found valid for the key.
+// A nil cache contains nothing.
+func (c *SigCache) Contains(key sigCacheKey, sig, pubKey []byte) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	digest, ok := c.entries[key]
+	return ok && digest == sigDigest(sig, pubKey)
+}
+
+// Add records a successful check, evicting the oldest entry if the cache is full
+func (c *SigCache) Add(key sigCacheKey, sig, pubKey []byte) {
+	if c == nil || len(c.order) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		if len(c.entries) == len(c.order) {
+			delete(c.entries, c.order[c.next])
+		}
+		c.order[c.next] = key
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.entries[key] = sigDigest(sig, pubKey)
+}
+
+// Len returns the number of cached checks
+func (c *SigCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
@@ -0,0 +1,55 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSigCacheEviction(t *testing.T) {
+	cache := NewSigCache(2)
+	sig, pubKey := []byte("sig"), []byte("key")
+
+	keys := []sigCacheKey{
+		newSigCacheKey([]byte("tx"), 0, nil),
+		newSigCacheKey([]byte("tx"), 1, nil),
+		newSigCacheKey([]byte("tx"), 2, nil),
+	}
+	for _, key := range keys {
+		cache.Add(key, sig, pubKey)
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("cache holds %d entries, want 2", cache.Len())
+	}
+	if cache.Contains(keys[0], sig, pubKey) {
+		t.Error("oldest entry was not evicted")
+	}
+	if !cache.Contains(keys[2], sig, pubKey) {
+		t.Error("newest entry is missing")
+	}
+	if cache.Contains(keys[2], []byte("other"), pubKey) {
+		t.Error("entry matched a different signature")
+	}
+}
+
+func TestVerifyBlockUsesSigCache(t *testing.T) {
+	bc := newTestChain(t)
+	owner := NewWallet()
+	block := syntheticBlock(t, bc, owner, 4, 2)
+
+	if err := bc.VerifyBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if bc.sigCache.Len() != 8 {
+		t.Fatalf("cache holds %d entries, want 8", bc.sigCache.Len())
+	}
+
+	// a different signature for a cached input is verified again
+	tx := block.Transactions[1]
+	other := bytes.Clone(block.Transactions[2].Vin[0].Signature)
+	tx.Vin[0].Signature = other
+	if err := bc.VerifyBlock(block); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrSignatureMismatch)
+	}
+}
@@ -0,0 +1,131 @@
+package block
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SigHashType selects which parts of a transaction a signature commits to.
+// It is appended as the last byte of every input signature.
+type SigHashType byte
+
+const (
+	SigHashAll    SigHashType = 0x01 // sign all inputs and outputs
+	SigHashNone   SigHashType = 0x02 // sign all inputs, no outputs
+	SigHashSingle SigHashType = 0x03 // sign all inputs and the output with the same index
+
+	// SigHashAnyoneCanPay modifies the types above to sign only the current input
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashMask = 0x1f
+)
+
+var (
+	ErrUnknownSigHash = errors.New("unknown signature hash type")
+	ErrSigHashSingle  = errors.New("SIGHASH_SINGLE input has no matching output")
+)
+
+// ParseSigHashType parses a flag such as "ALL", "SINGLE" or "NONE|ANYONECANPAY":
+// exactly one of ALL, NONE and SINGLE, optionally with ANYONECANPAY
+func ParseSigHashType(s string) (SigHashType, error) {
+	var hashType SigHashType
+
+	for _, part := range strings.Split(strings.ToUpper(s), "|") {
+		var flag SigHashType
+		switch strings.TrimSpace(part) {
+		case "ALL":
+			flag = SigHashAll
+		case "NONE":
+			flag = SigHashNone
+		case "SINGLE":
+			flag = SigHashSingle
+		case "ANYONECANPAY":
+			flag = SigHashAnyoneCanPay
+		default:
+			return 0, fmt.Errorf("%w: %q", ErrUnknownSigHash, s)
+		}
+
+		if flag == SigHashAnyoneCanPay && hashType&SigHashAnyoneCanPay != 0 {
+			return 0, fmt.Errorf("%w: %q repeats ANYONECANPAY", ErrUnknownSigHash, s)
+		}
+		if flag != SigHashAnyoneCanPay && hashType&sigHashMask != 0 {
+			return 0, fmt.Errorf("%w: %q names more than one of ALL, NONE and SINGLE", ErrUnknownSigHash, s)
+		}
+		hashType |= flag
+	}
+
+	if hashType&sigHashMask == 0 {
+		return 0, fmt.Errorf("%w: %q names none of ALL, NONE and SINGLE", ErrUnknownSigHash, s)
+	}
+
+	return hashType, nil
+}
+
+// IsValid reports whether the type is one of the defined combinations
+func (t SigHashType) IsValid() bool {
+	if t&^(sigHashMask|SigHashAnyoneCanPay) != 0 {
+		return false
+	}
+
+	base := t & sigHashMask
+	return base == SigHashAll || base == SigHashNone || base == SigHashSingle
+}
+
+func (t SigHashType) String() string {
+	var name string
+
+	switch t & sigHashMask {
+	case SigHashAll:
+		name = "ALL"
+	case SigHashNone:
+		name = "NONE"
+	case SigHashSingle:
+		name = "SINGLE"
+	default:
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+
+	if t&SigHashAnyoneCanPay != 0 {
+		name += "|ANYONECANPAY"
+	}
+
+	return name
+}
+
+// signatureHash returns the message signed by input inID. It always commits to the
+// locking hash of the spent output and to the hash type; which other inputs and
+// outputs are covered depends on hashType.
+func (tx *Transaction) signatureHash(inID int, prevOut *TXOutput, hashType SigHashType) ([]byte, error) {
+	if !hashType.IsValid() {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSigHash, hashType)
+	}
+
+	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
+	txCopy.Vin[inID].PubKey = prevOut.PubKeyHash
+
+	switch hashType & sigHashMask {
+	case SigHashNone:
+		txCopy.Vout = nil
+	case SigHashSingle:
+		if inID >= len(txCopy.Vout) {
+			return nil, ErrSigHashSingle
+		}
+
+		// outputs before ours are blanked so that only their count is committed
+		txCopy.Vout = txCopy.Vout[:inID+1]
+		for i := 0; i < inID; i++ {
+			txCopy.Vout[i] = TXOutput{-1, nil}
+		}
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Vin = txCopy.Vin[inID : inID+1]
+	}
+
+	hash := sha256.Sum256(append(txCopy.Serialize(), byte(hashType)))
+
+	return hash[:], nil
+}
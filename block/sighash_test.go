@@ -0,0 +1,129 @@
+package block
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// newTwoInputSpend returns an unsigned transaction spending two coinbase outputs of owner into two outputs
+func newTwoInputSpend(owner, receiver *Wallet) (*Transaction, map[string]Transaction) {
+	prevTXs := make(map[string]Transaction)
+	var inputs []TXInput
+
+	for i := 0; i < 2; i++ {
+		prevTX := NewCoinbaseTX(string(owner.GetAddress()), hex.EncodeToString([]byte{byte(i)}))
+		prevTXs[hex.EncodeToString(prevTX.ID)] = *prevTX
+		inputs = append(inputs, TXInput{prevTX.ID, 0, nil, owner.PublicKey})
+	}
+
+	outputs := []TXOutput{
+		*NewTXOutput(subsidy, string(receiver.GetAddress())),
+		*NewTXOutput(subsidy, string(owner.GetAddress())),
+	}
+	tx := &Transaction{nil, inputs, outputs, txVersion}
+	tx.ID = tx.Hash()
+
+	return tx, prevTXs
+}
+
+func TestParseSigHashType(t *testing.T) {
+	tests := map[string]SigHashType{
+		"ALL":                   SigHashAll,
+		"none":                  SigHashNone,
+		"SINGLE|ANYONECANPAY":   SigHashSingle | SigHashAnyoneCanPay,
+		"anyonecanpay | single": SigHashSingle | SigHashAnyoneCanPay,
+	}
+	for flag, expect := range tests {
+		hashType, err := ParseSigHashType(flag)
+		if err != nil || hashType != expect {
+			t.Errorf("%s: got %s, %v; want %s", flag, hashType, err, expect)
+		}
+	}
+
+	for _, flag := range []string{"", "ANYONECANPAY", "ALL|BOGUS", "ALL|NONE", "NONE|SINGLE", "ALL|ALL",
+		"ALL|ANYONECANPAY|ANYONECANPAY", "ALL|", "|"} {
+		if _, err := ParseSigHashType(flag); !errors.Is(err, ErrUnknownSigHash) {
+			t.Errorf("%q: got %v, want %v", flag, err, ErrUnknownSigHash)
+		}
+	}
+}
+
+func TestSigHashCoverage(t *testing.T) {
+	owner, receiver, other := NewWallet(), NewWallet(), NewWallet()
+
+	tests := []struct {
+		name     string
+		hashType SigHashType
+		modify   func(tx *Transaction)
+		valid    bool
+	}{
+		{"ALL commits to outputs", SigHashAll, func(tx *Transaction) { tx.Vout[1].Value-- }, false},
+		{"ALL commits to inputs", SigHashAll, func(tx *Transaction) { tx.Vin = tx.Vin[:1] }, false},
+		{"NONE leaves outputs open", SigHashNone, func(tx *Transaction) {
+			tx.Vout[0].PubKeyHash = HashPubKey(other.PublicKey)
+		}, true},
+		{"NONE commits to inputs", SigHashNone, func(tx *Transaction) { tx.Vin = tx.Vin[:1] }, false},
+		{"SINGLE commits to its output", SigHashSingle, func(tx *Transaction) { tx.Vout[0].Value-- }, false},
+		{"SINGLE leaves later outputs open", SigHashSingle, func(tx *Transaction) {
+			tx.Vout = append(tx.Vout, *NewTXOutput(1, string(other.GetAddress())))
+		}, true},
+		{"ANYONECANPAY allows dropping other inputs", SigHashAll | SigHashAnyoneCanPay, func(tx *Transaction) {
+			tx.Vin = tx.Vin[:1]
+		}, true},
+		{"ANYONECANPAY still commits to outputs", SigHashAll | SigHashAnyoneCanPay, func(tx *Transaction) {
+			tx.Vout[0].Value++
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx, prevTXs := newTwoInputSpend(owner, receiver)
+			if err := tx.Sign(owner, prevTXs, test.hashType); err != nil {
+				t.Fatalf("sign: %s", err)
+			}
+			if err := tx.Verify(prevTXs); err != nil {
+				t.Fatalf("unmodified transaction rejected: %s", err)
+			}
+
+			test.modify(tx)
+			err := tx.Verify(prevTXs)
+			if test.valid && err != nil {
+				t.Fatalf("modification should be allowed: %s", err)
+			}
+			if !test.valid && !errors.Is(err, ErrSignatureMismatch) {
+				t.Fatalf("got %v, want %v", err, ErrSignatureMismatch)
+			}
+		})
+	}
+}
+
+func TestSigHashTypeIsCommitted(t *testing.T) {
+	owner := NewWallet()
+	tx, prevTXs := newTwoInputSpend(owner, NewWallet())
+
+	if err := tx.Sign(owner, prevTXs, SigHashAll); err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	sig := tx.Vin[0].Signature
+	sig[len(sig)-1] = byte(SigHashNone)
+	if err := tx.Verify(prevTXs); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrSignatureMismatch)
+	}
+
+	sig[len(sig)-1] = 0x42
+	if err := tx.Verify(prevTXs); !errors.Is(err, ErrUnknownSigHash) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownSigHash)
+	}
+}
+
+func TestSigHashSingleWithoutOutput(t *testing.T) {
+	owner := NewWallet()
+	tx, prevTXs := newTwoInputSpend(owner, NewWallet())
+	tx.Vout = tx.Vout[:1]
+
+	if err := tx.Sign(owner, prevTXs, SigHashSingle); !errors.Is(err, ErrSigHashSingle) {
+		t.Fatalf("got %v, want %v", err, ErrSigHashSingle)
+	}
+}
@@ -0,0 +1,311 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// coordinateLen is the fixed width of a scalar or coordinate
+const coordinateLen = 32
+
+// signatureLen is the length of an encoded r||s signature
+const signatureLen = 2 * coordinateLen
+
+// pubKeyLen is the length of an encoded P256 X||Y public key
+const pubKeyLen = 2 * coordinateLen
+
+var (
+	ErrMissingPrevTx     = errors.New("referenced transaction not found")
+	ErrBadOutputIndex    = errors.New("referenced output does not exist")
+	ErrPubKeyMismatch    = errors.New("public key does not match the referenced output")
+	ErrInvalidPubKey     = errors.New("malformed public key")
+	ErrInvalidSecretKey  = errors.New("malformed secret key")
+	ErrInvalidSignature  = errors.New("malformed signature")
+	ErrHighS             = errors.New("signature S value is not canonical (high S)")
+	ErrSignatureMismatch = errors.New("signature verification failed")
+	ErrUnknownScheme     = errors.New("unknown signature scheme")
+)
+
+// SigScheme identifies the signature algorithm of a key. It is used as the
+// address version byte and prefixes every public key except legacy P256 ones.
+type SigScheme byte
+
+const (
+	SchemeP256      SigScheme = 0x00 // ECDSA over NIST P-256, public key is untagged X||Y
+	SchemeSecp256k1 SigScheme = 0x01 // ECDSA over secp256k1, compressed public key
+	SchemeSchnorr   SigScheme = 0x02 // BIP340 Schnorr over secp256k1, x-only public key
+)
+
+// SignatureScheme creates keys for wallets and signs and verifies input signatures
+type SignatureScheme interface {
+	// NewKey fills in the key material of w
+	NewKey(w *Wallet) error
+	// Sign signs a 32-byte hash with the key of w
+	Sign(w *Wallet, hash []byte) ([]byte, error)
+	// Verify checks sig against an untagged public key
+	Verify(pubKey, hash, sig []byte) error
+}
+
+var signatureSchemes = map[SigScheme]SignatureScheme{
+	SchemeP256:      p256Scheme{},
+	SchemeSecp256k1: secp256k1Scheme{},
+	SchemeSchnorr:   schnorrScheme{},
+}
+
+var schemeNames = map[SigScheme]string{
+	SchemeP256:      "p256",
+	SchemeSecp256k1: "secp256k1",
+	SchemeSchnorr:   "schnorr",
+}
+
+// ParseSigScheme parses a scheme name such as "p256", "secp256k1" or "schnorr"
+func ParseSigScheme(name string) (SigScheme, error) {
+	for scheme, schemeName := range schemeNames {
+		if strings.EqualFold(name, schemeName) {
+			return scheme, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownScheme, name)
+}
+
+func (s SigScheme) String() string {
+	if name, ok := schemeNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("scheme(0x%02x)", byte(s))
+}
+
+// schemeFor returns the implementation of a scheme
+func schemeFor(scheme SigScheme) (SignatureScheme, error) {
+	impl, ok := signatureSchemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+
+	return impl, nil
+}
+
+// tagPubKey prefixes a public key with its scheme; P256 keys stay untagged
+// so that outputs locked before schemes existed remain spendable
+func tagPubKey(scheme SigScheme, pubKey []byte) []byte {
+	if scheme == SchemeP256 {
+		return pubKey
+	}
+
+	return append([]byte{byte(scheme)}, pubKey...)
+}
+
+// splitPubKey returns the scheme and untagged key of a public key found in an input
+func splitPubKey(pubKey []byte) (SigScheme, []byte, error) {
+	if len(pubKey) == pubKeyLen {
+		return SchemeP256, pubKey, nil
+	}
+	if len(pubKey) == 0 || SigScheme(pubKey[0]) == SchemeP256 {
+		return 0, nil, ErrInvalidPubKey
+	}
+
+	return SigScheme(pubKey[0]), pubKey[1:], nil
+}
+
+// verifySignature checks sig over hash against a tagged public key
+func verifySignature(pubKey, hash, sig []byte) error {
+	scheme, key, err := splitPubKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	impl, err := schemeFor(scheme)
+	if err != nil {
+		return err
+	}
+
+	return impl.Verify(key, hash, sig)
+}
+
+// p256Scheme is the original ECDSA over P-256
+type p256Scheme struct{}
+
+func (p256Scheme) NewKey(w *Wallet) error {
+	priKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	w.PrivateKey = *priKey
+	w.PublicKey = encodePubKey(&priKey.PublicKey)
+
+	return nil
+}
+
+func (p256Scheme) Sign(w *Wallet, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, &w.PrivateKey, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeSignature(r, s, elliptic.P256().Params().N), nil
+}
+
+func (p256Scheme) Verify(pubKey, hash, sig []byte) error {
+	pub, err := decodePubKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	r, s, err := decodeSignature(sig, elliptic.P256().Params().N)
+	if err != nil {
+		return err
+	}
+
+	if !ecdsa.Verify(pub, hash, r, s) {
+		return ErrSignatureMismatch
+	}
+
+	return nil
+}
+
+// secp256k1Scheme is ECDSA over secp256k1 with compressed public keys
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) NewKey(w *Wallet) error {
+	d, err := secpGenerateKey()
+	if err != nil {
+		return err
+	}
+
+	w.SecretKey = padBytes(d.Bytes(), coordinateLen)
+	w.PublicKey = tagPubKey(SchemeSecp256k1, secpCompress(secpScalarBaseMult(d)))
+
+	return nil
+}
+
+func (secp256k1Scheme) Sign(w *Wallet, hash []byte) ([]byte, error) {
+	d, err := secpParseSecret(w.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r, s, err := secpECDSASign(d, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeSignature(r, s, secpN), nil
+}
+
+func (secp256k1Scheme) Verify(pubKey, hash, sig []byte) error {
+	pub, err := secpDecompress(pubKey)
+	if err != nil {
+		return err
+	}
+
+	r, s, err := decodeSignature(sig, secpN)
+	if err != nil {
+		return err
+	}
+
+	if !secpECDSAVerify(pub, hash, r, s) {
+		return ErrSignatureMismatch
+	}
+
+	return nil
+}
+
+// schnorrScheme is BIP340 Schnorr over secp256k1 with x-only public keys
+type schnorrScheme struct{}
+
+func (schnorrScheme) NewKey(w *Wallet) error {
+	d, err := secpGenerateKey()
+	if err != nil {
+		return err
+	}
+
+	w.SecretKey = padBytes(d.Bytes(), coordinateLen)
+	w.PublicKey = tagPubKey(SchemeSchnorr, padBytes(secpScalarBaseMult(d).X.Bytes(), coordinateLen))
+
+	return nil
+}
+
+func (schnorrScheme) Sign(w *Wallet, hash []byte) ([]byte, error) {
+	d, err := secpParseSecret(w.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aux := make([]byte, coordinateLen)
+	if _, err := rand.Read(aux); err != nil {
+		return nil, err
+	}
+
+	return schnorrSign(d, hash, aux)
+}
+
+func (schnorrScheme) Verify(pubKey, hash, sig []byte) error {
+	return schnorrVerify(pubKey, hash, sig)
+}
+
+// padBytes left-pads b with zeroes to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+
+	return padded
+}
+
+// encodePubKey encodes a P256 public key as fixed-width X||Y
+func encodePubKey(pub *ecdsa.PublicKey) []byte {
+	return append(padBytes(pub.X.Bytes(), coordinateLen), padBytes(pub.Y.Bytes(), coordinateLen)...)
+}
+
+// decodePubKey parses a fixed-width X||Y P256 public key and checks it lies on the curve
+func decodePubKey(data []byte) (*ecdsa.PublicKey, error) {
+	if len(data) != pubKeyLen {
+		return nil, ErrInvalidPubKey
+	}
+
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(data[:coordinateLen])
+	y := new(big.Int).SetBytes(data[coordinateLen:])
+	if !curve.IsOnCurve(x, y) {
+		return nil, ErrInvalidPubKey
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// encodeSignature encodes r and s as a fixed-width r||s pair, normalizing s to the lower half of the order n
+func encodeSignature(r, s, n *big.Int) []byte {
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s = new(big.Int).Sub(n, s)
+	}
+
+	return append(padBytes(r.Bytes(), coordinateLen), padBytes(s.Bytes(), coordinateLen)...)
+}
+
+// decodeSignature parses a fixed-width r||s signature and rejects non-canonical values
+func decodeSignature(sig []byte, n *big.Int) (*big.Int, *big.Int, error) {
+	if len(sig) != signatureLen {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	r := new(big.Int).SetBytes(sig[:coordinateLen])
+	s := new(big.Int).SetBytes(sig[coordinateLen:])
+	if r.Sign() == 0 || s.Sign() == 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, nil, ErrInvalidSignature
+	}
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		return nil, nil, ErrHighS
+	}
+
+	return r, s, nil
+}
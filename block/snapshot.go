@@ -0,0 +1,399 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// snapshotKey is the meta key of the snapshot a node was loaded from, until old
+// blocks have been validated up to it: its height followed by its UTXO hash
+const snapshotKey = "snapshot"
+
+// snapshotNextKey is the meta key of the next block to connect to the UTXO set
+// built from genesis to validate the snapshot
+const snapshotNextKey = "snapshotnext"
+
+// snapshotUTXOIndex holds the UTXO set built from genesis while a snapshot is validated
+const snapshotUTXOIndex = "snapshotutxo"
+
+var (
+	ErrChainNotEmpty     = errors.New("a UTXO snapshot can only be loaded into an empty chain")
+	ErrSnapshotHash      = errors.New("UTXO snapshot does not match its hash")
+	ErrSnapshotMismatch  = errors.New("the blocks below the snapshot lead to a different UTXO set")
+	ErrSnapshotNotLinked = errors.New("snapshot headers do not form a chain")
+)
+
+// UTXOSnapshot is the UTXO set of the main chain at a height, with the headers from
+// genesis to that height so that a node without blocks can be initialized from it
+type UTXOSnapshot struct {
+	Height  int
+	Hash    []byte // commitment over the UTXO set, see UTXOSet.Hash
+	Headers []BlockHeader
+	Entries []UTXOEntry // by transaction ID
+}
+
+// UTXOEntry holds the unspent outputs of a transaction
+type UTXOEntry struct {
+	TxID    []byte
+	Outputs TXOutputs
+}
+
+// Serialize returns the canonical encoding of the snapshot
+func (s *UTXOSnapshot) Serialize() []byte {
+	return EncodeUTXOSnapshot(s)
+}
+
+// BlockHash returns the hash of the block the snapshot was taken at
+func (s *UTXOSnapshot) BlockHash() []byte {
+	return s.Headers[s.Height].Hash()
+}
+
+// hashUTXO returns the SHA-256 of the entries of a UTXO set in transaction ID order,
+// each as its ID and its outputs in the canonical encoding. Nodes with the same
+// UTXO set get the same hash whatever encoding their database stores.
+func hashUTXO(b StoreBucket) ([]byte, int, error) {
+	h := sha256.New()
+	count := 0
+
+	err := b.ForEach(func(k, v []byte) error {
+		var e encoder
+		e.bytes(k)
+		e.bytes(EncodeOutputs(DeserializeOutputs(v)))
+		h.Write(e.Bytes())
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return h.Sum(nil), count, nil
+}
+
+// Hash returns the commitment over the UTXO set and its number of transactions
+func (u UTXOSet) Hash() ([]byte, int, error) {
+	var hash []byte
+	var count int
+
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		var err error
+		hash, count, err = hashUTXO(tx.UTXO())
+		return err
+	})
+
+	return hash, count, err
+}
+
+// Snapshot returns the UTXO set at a main chain height. The set is rolled back from
+// the tip with the undo data of the blocks above height, which must not be pruned.
+func (u UTXOSet) Snapshot(height int) (*UTXOSnapshot, error) {
+	snapshot := &UTXOSnapshot{Height: height}
+	scratch := NewMemoryStore()
+	var blocks []*Block
+	var undo [][]spentOutput
+
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		_, tipHeight, err := getHeader(tx, tx.Tip())
+		if err != nil {
+			return err
+		}
+		if height < 0 || height > tipHeight {
+			return fmt.Errorf("%w %d", ErrHeightOutOfRange, height)
+		}
+
+		for h := 0; h <= height; h++ {
+			hash, err := getHashAtHeight(tx, h)
+			if err != nil {
+				return err
+			}
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			snapshot.Headers = append(snapshot.Headers, header)
+		}
+
+		for h := tipHeight; h > height; h-- {
+			hash, err := getHashAtHeight(tx, h)
+			if err != nil {
+				return err
+			}
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			data := tx.Index(undoIndex).Get(hash)
+			if data == nil {
+				return fmt.Errorf("%w %x", ErrNoUndoData, hash)
+			}
+			spent, err := decodeUndo(data)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+			undo = append(undo, spent)
+		}
+
+		return scratch.Update(func(scratchTx StoreTx) error {
+			return tx.UTXO().ForEach(func(k, v []byte) error {
+				return scratchTx.UTXO().Put(k, v)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scratch.Update(func(tx StoreTx) error {
+		for i, block := range blocks {
+			if err := restoreOutputs(tx.UTXO(), block, undo[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scratch.View(func(tx StoreTx) error {
+		var err error
+		if snapshot.Hash, _, err = hashUTXO(tx.UTXO()); err != nil {
+			return err
+		}
+
+		return tx.UTXO().ForEach(func(k, v []byte) error {
+			snapshot.Entries = append(snapshot.Entries, UTXOEntry{append([]byte{}, k...), DeserializeOutputs(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// LoadUTXOSnapshot initializes an empty chain from a snapshot: its headers are stored,
+// its UTXO set becomes the UTXO set of the node and its block becomes the tip. The
+// blocks below the snapshot are then validated by ValidateSnapshot as they arrive.
+func (bc *Blockchain) LoadUTXOSnapshot(s *UTXOSnapshot) error {
+	if bc.tip != nil {
+		return ErrChainNotEmpty
+	}
+	if len(s.Headers) != s.Height+1 {
+		return fmt.Errorf("%w: %d headers for height %d", ErrSnapshotNotLinked, len(s.Headers), s.Height)
+	}
+
+	prevHash := []byte{}
+	for i := range s.Headers {
+		header := &s.Headers[i]
+		if !bytes.Equal(header.PrevBlockHash, prevHash) {
+			return fmt.Errorf("%w: header at height %d", ErrSnapshotNotLinked, i)
+		}
+		if !NewProofOfWork(header).Validate() {
+			return fmt.Errorf("%w: %x", ErrInvalidPoW, header.Hash())
+		}
+		prevHash = header.Hash()
+	}
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		for i := range s.Headers {
+			if err := tx.Headers().Put(s.Headers[i].Hash(), encodeHeaderEntry(&s.Headers[i], i)); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.ClearUTXO(); err != nil {
+			return err
+		}
+		for _, entry := range s.Entries {
+			if err := tx.UTXO().Put(entry.TxID, entry.Outputs.Serialize()); err != nil {
+				return err
+			}
+		}
+		if hash, _, err := hashUTXO(tx.UTXO()); err != nil {
+			return err
+		} else if !bytes.Equal(hash, s.Hash) {
+			return ErrSnapshotHash
+		}
+
+		state := append(heightKey(s.Height), s.Hash...)
+		if err := tx.Index(metaBucket).Put([]byte(snapshotKey), state); err != nil {
+			return err
+		}
+		if err := tx.Index(metaBucket).Put([]byte(snapshotNextKey), heightKey(0)); err != nil {
+			return err
+		}
+		// the UTXO set is already at the snapshot block, whose ancestors have no body
+		if err := tx.Index(metaBucket).Put([]byte(utxoTipKey), prevHash); err != nil {
+			return err
+		}
+
+		return setTip(tx, prevHash, s.Height)
+	})
+	if err != nil {
+		return err
+	}
+	bc.tip = prevHash
+
+	// without blocks, the UTXO set could not be rebuilt after a crash
+	return flushChainState(bc.store)
+}
+
+// getSnapshotState returns the height and hash of the snapshot being validated and the
+// next height to validate. ok is false when the chain was not loaded from a snapshot
+// or the snapshot is validated.
+func getSnapshotState(tx StoreTx) (height int, hash []byte, next int, ok bool) {
+	meta := tx.Index(metaBucket)
+	state := meta.Get([]byte(snapshotKey))
+	if len(state) < 8 {
+		return 0, nil, 0, false
+	}
+
+	if data := meta.Get([]byte(snapshotNextKey)); len(data) == 8 {
+		next = int(binary.BigEndian.Uint64(data))
+	}
+
+	return int(binary.BigEndian.Uint64(state)), append([]byte{}, state[8:]...), next, true
+}
+
+// SnapshotPending returns the height of the snapshot the chain was loaded from while
+// the blocks below it are not all validated
+func (bc *Blockchain) SnapshotPending() (int, bool) {
+	var height int
+	var ok bool
+
+	_ = bc.store.View(func(tx StoreTx) error {
+		height, _, _, ok = getSnapshotState(tx)
+		return nil
+	})
+
+	return height, ok
+}
+
+// snapshotMissingBlocks returns the hashes of the blocks below the snapshot still to be
+// validated whose bodies have not been downloaded, lowest first
+func (bc *Blockchain) snapshotMissingBlocks() [][]byte {
+	var missing [][]byte
+
+	_ = bc.store.View(func(tx StoreTx) error {
+		height, _, next, ok := getSnapshotState(tx)
+		if !ok {
+			return nil
+		}
+
+		for h := next; h <= height; h++ {
+			hash, err := getHashAtHeight(tx, h)
+			if err != nil {
+				return err
+			}
+			if tx.Blocks().Get(hash) == nil {
+				missing = append(missing, hash)
+			}
+		}
+		return nil
+	})
+
+	return missing
+}
+
+// ValidateSnapshot connects up to maxBlocks downloaded blocks below the snapshot to a
+// UTXO set built from genesis, checking their input signatures. Once the snapshot
+// block is connected, the UTXO set built must have the hash of the snapshot, and the
+// node is then like any other. It returns the next height to validate and whether
+// the snapshot is validated. Validation stops at the first block not yet downloaded.
+func (bc *Blockchain) ValidateSnapshot(maxBlocks int) (int, bool, error) {
+	for i := 0; i < maxBlocks; i++ {
+		var block *Block
+		var height, next int
+		var hash []byte
+		var ok bool
+
+		err := bc.store.View(func(tx StoreTx) error {
+			height, hash, next, ok = getSnapshotState(tx)
+			if !ok || next > height {
+				return nil
+			}
+
+			blockHash, err := getHashAtHeight(tx, next)
+			if err != nil {
+				return err
+			}
+			block, err = getBlock(tx, blockHash)
+			if errors.Is(err, ErrBlockNotFound) {
+				return nil
+			}
+			return err
+		})
+		if err != nil || !ok {
+			return next, !ok, err
+		}
+
+		if next > height {
+			if err := bc.finishSnapshot(hash); err != nil {
+				return next, false, err
+			}
+			return next, true, nil
+		}
+		if block == nil {
+			return next, false, nil
+		}
+
+		var checks []inputCheck
+		err = bc.store.View(func(tx StoreTx) error {
+			checks, err = inputChecks(tx.Index(snapshotUTXOIndex), block.Transactions)
+			return err
+		})
+		if err == nil {
+			err = runInputChecks(checks, runtime.NumCPU(), bc.sigCache)
+		}
+		if err != nil {
+			return next, false, fmt.Errorf("block %x at height %d: %w", block.Hash, next, err)
+		}
+
+		err = bc.store.Update(func(tx StoreTx) error {
+			if _, err := spendOutputs(tx.Index(snapshotUTXOIndex), block); err != nil {
+				return err
+			}
+			return tx.Index(metaBucket).Put([]byte(snapshotNextKey), heightKey(next+1))
+		})
+		if err != nil {
+			return next, false, err
+		}
+	}
+
+	next := 0
+	_ = bc.store.View(func(tx StoreTx) error {
+		_, _, next, _ = getSnapshotState(tx)
+		return nil
+	})
+
+	return next, false, nil
+}
+
+// finishSnapshot compares the UTXO set built from genesis with the snapshot and, when
+// they match, forgets the snapshot
+func (bc *Blockchain) finishSnapshot(want []byte) error {
+	return bc.store.Update(func(tx StoreTx) error {
+		hash, _, err := hashUTXO(tx.Index(snapshotUTXOIndex))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, want) {
+			return fmt.Errorf("%w: got %x, want %x", ErrSnapshotMismatch, hash, want)
+		}
+
+		if err := tx.Index(metaBucket).Delete([]byte(snapshotKey)); err != nil {
+			return err
+		}
+		if err := tx.Index(metaBucket).Delete([]byte(snapshotNextKey)); err != nil {
+			return err
+		}
+		return tx.DeleteIndex(snapshotUTXOIndex)
+	})
+}
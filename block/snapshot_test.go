@@ -0,0 +1,181 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// importTestChain returns a chain holding the first blocks of testdata/chain.dat
+func importTestChain(t *testing.T, blocks int) *Blockchain {
+	data := readTestChain(t)
+	end := 0
+	for i := 0; i < blocks; i++ {
+		end += 12 + int(binary.BigEndian.Uint32(data[end+4:end+8]))
+	}
+
+	bc := newTestChain(t)
+	if _, err := bc.ImportChain(bytes.NewReader(data[:end]), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return bc
+}
+
+// rehashSnapshot sets the hash of a snapshot whose entries were changed
+func rehashSnapshot(t *testing.T, s *UTXOSnapshot) {
+	scratch := NewMemoryStore()
+	err := scratch.Update(func(tx StoreTx) error {
+		for _, entry := range s.Entries {
+			if err := tx.UTXO().Put(entry.TxID, entry.Outputs.Serialize()); err != nil {
+				return err
+			}
+		}
+		var err error
+		s.Hash, _, err = hashUTXO(tx.UTXO())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUTXOSnapshot(t *testing.T) {
+	bc := importTestChain(t, 3)
+
+	tipHash, count, err := UTXOSet{bc}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := UTXOSet{bc}.Snapshot(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snapshot.Hash, tipHash) || len(snapshot.Entries) != count {
+		t.Fatalf("snapshot at the tip has hash %x and %d entries, want %x and %d", snapshot.Hash, len(snapshot.Entries), tipHash, count)
+	}
+
+	// the set rolled back to height 1 is the set of a node that stopped at height 1
+	snapshot, err = UTXOSet{bc}.Snapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, _ := UTXOSet{importTestChain(t, 2)}.Hash()
+	if !bytes.Equal(snapshot.Hash, want) {
+		t.Fatalf("snapshot at height 1 has hash %x, want %x", snapshot.Hash, want)
+	}
+	if len(snapshot.Headers) != 2 || !bytes.Equal(snapshot.BlockHash(), bc.GetBlockHashes()[1]) {
+		t.Fatalf("snapshot at height 1 is for block %x with %d headers", snapshot.BlockHash(), len(snapshot.Headers))
+	}
+
+	decoded, err := DecodeUTXOSnapshot(snapshot.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Serialize(), snapshot.Serialize()) {
+		t.Fatal("the decoded snapshot encodes differently")
+	}
+
+	if _, err := (UTXOSet{bc}).Snapshot(3); !errors.Is(err, ErrHeightOutOfRange) {
+		t.Fatalf("snapshot above the tip returned %v", err)
+	}
+}
+
+func TestLoadUTXOSnapshot(t *testing.T) {
+	source := importTestChain(t, 3)
+	snapshot, err := UTXOSet{source}.Snapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.LoadUTXOSnapshot(snapshot); !errors.Is(err, ErrChainNotEmpty) {
+		t.Fatalf("loading into a chain returned %v", err)
+	}
+
+	bc := newTestChain(t)
+	if err := bc.LoadUTXOSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if height, pending := bc.SnapshotPending(); !pending || height != 1 || !bytes.Equal(bc.tip, snapshot.BlockHash()) {
+		t.Fatalf("loaded snapshot pending %v at height %d with tip %x", pending, height, bc.tip)
+	}
+	if hash, _, _ := (UTXOSet{bc}).Hash(); !bytes.Equal(hash, snapshot.Hash) {
+		t.Fatalf("loaded UTXO set has hash %x, want %x", hash, snapshot.Hash)
+	}
+
+	// nothing is validated before the blocks arrive
+	if next, done, err := bc.ValidateSnapshot(10); err != nil || done || next != 0 {
+		t.Fatalf("validation without blocks reached %d, done %v: %v", next, done, err)
+	}
+	if missing := bc.snapshotMissingBlocks(); len(missing) != 2 {
+		t.Fatalf("%d blocks missing below the snapshot, want 2", len(missing))
+	}
+
+	for height := 0; height <= 1; height++ {
+		block, err := source.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.AddBlock(&block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next, done, err := bc.ValidateSnapshot(1); err != nil || done || next != 1 {
+		t.Fatalf("validating one block reached %d, done %v: %v", next, done, err)
+	}
+	if _, done, err := bc.ValidateSnapshot(10); err != nil || !done {
+		t.Fatalf("validation done %v: %v", done, err)
+	}
+	if _, pending := bc.SnapshotPending(); pending {
+		t.Fatal("the snapshot is still pending after validation")
+	}
+
+	// the node then follows the chain like any other
+	imported, err := bc.ImportChain(bytes.NewReader(readTestChain(t)), nil)
+	if err != nil || imported != 1 {
+		t.Fatalf("imported %d blocks after the snapshot: %v", imported, err)
+	}
+	if got, want := utxoValues(t, bc), utxoValues(t, source); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set %v, want %v", got, want)
+	}
+}
+
+func TestLoadUTXOSnapshotRejects(t *testing.T) {
+	source := importTestChain(t, 3)
+	snapshot, err := UTXOSet{source}.Snapshot(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot.Entries[0].Outputs.Outputs[0].Value++
+	if err := newTestChain(t).LoadUTXOSnapshot(snapshot); !errors.Is(err, ErrSnapshotHash) {
+		t.Fatalf("loading a snapshot not matching its hash returned %v", err)
+	}
+
+	// a snapshot consistent with its own hash is caught once the blocks are validated
+	rehashSnapshot(t, snapshot)
+	bc := newTestChain(t)
+	if err := bc.LoadUTXOSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for height := 0; height <= 2; height++ {
+		block, _ := source.GetBlockByHeight(height)
+		if err := bc.AddBlock(&block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, done, err := bc.ValidateSnapshot(10); !errors.Is(err, ErrSnapshotMismatch) || done {
+		t.Fatalf("validating a wrong snapshot returned done %v: %v", done, err)
+	}
+	if _, pending := bc.SnapshotPending(); !pending {
+		t.Fatal("a wrong snapshot is no longer pending")
+	}
+
+	snapshot.Headers = snapshot.Headers[1:]
+	snapshot.Height--
+	if err := newTestChain(t).LoadUTXOSnapshot(snapshot); !errors.Is(err, ErrSnapshotNotLinked) {
+		t.Fatalf("loading a snapshot without genesis returned %v", err)
+	}
+}
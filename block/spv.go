@@ -0,0 +1,453 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const spvTxBucket = "spvTransactions"
+const spvScannedBucket = "spvScanned"
+
+// spvFilterFPRate is the false positive rate of the bloom filters loaded into peers.
+// Higher rates hide the wallet's keys better at the cost of more traffic.
+const spvFilterFPRate = 0.001
+
+// spvSyncTimeout bounds a light client sync session
+const spvSyncTimeout = 30 * time.Second
+
+var (
+	ErrHeaderNotOnChain = errors.New("header does not link to the known chain")
+	ErrNoSPVService     = errors.New("peer does not serve light clients")
+	ErrBlockNotServed   = errors.New("peer does not have the block")
+)
+
+// LightClient is a wallet that does not store the chain. It keeps the block headers,
+// checking their proof of work and linkage, and the transactions of its wallet that
+// were proven to be in one of those blocks.
+type LightClient struct {
+	tip   []byte // best header's hash
+	store ChainStore
+}
+
+// NewLightClient opens the light client database of a node, creating it if needed
+func NewLightClient(nodeID string) (*LightClient, error) {
+	return openLightClient(spvFile.path(nodeID))
+}
+
+func openLightClient(path string) (*LightClient, error) {
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLightClient(store)
+}
+
+// newLightClient returns the light client kept in store, which may be empty
+func newLightClient(store ChainStore) (*LightClient, error) {
+	var tip []byte
+	err := store.Update(func(tx StoreTx) error {
+		tip = tx.Tip()
+
+		// earlier versions kept the tip among the headers
+		if legacyTip := tx.Headers().Get([]byte(tipKey)); legacyTip != nil {
+			if tip == nil {
+				tip = append([]byte{}, legacyTip...)
+				if err := tx.SetTip(tip); err != nil {
+					return err
+				}
+			}
+			return tx.Headers().Delete([]byte(tipKey))
+		}
+		return nil
+	})
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+
+	return &LightClient{tip, store}, nil
+}
+
+func (lc *LightClient) Close() {
+	_ = lc.store.Close()
+}
+
+// BestHeight returns the height of the best known header, or -1 without headers
+func (lc *LightClient) BestHeight() int {
+	height := -1
+
+	_ = lc.store.View(func(tx StoreTx) error {
+		if _, h, err := getHeader(tx, lc.tip); err == nil {
+			height = h
+		}
+		return nil
+	})
+
+	return height
+}
+
+// Locator returns hashes of the best chain, dense near the tip and sparse further
+// back, so that a peer can find the last common block even after a fork
+func (lc *LightClient) Locator() [][]byte {
+	var locator [][]byte
+
+	_ = lc.store.View(func(tx StoreTx) error {
+		hash, step := lc.tip, 1
+		for len(hash) > 0 {
+			locator = append(locator, hash)
+			if len(locator) >= 10 {
+				step *= 2
+			}
+
+			for i := 0; i < step && len(hash) > 0; i++ {
+				header, _, err := getHeader(tx, hash)
+				if err != nil {
+					return err
+				}
+				hash = header.PrevBlockHash
+			}
+		}
+		return nil
+	})
+
+	return locator
+}
+
+// AddHeaders validates and stores a chain of headers, oldest first. Each header must
+// carry a valid proof of work and extend a known header, except for the genesis header
+// of an empty client. The best header moves to the highest one. It returns the number
+// of new headers.
+func (lc *LightClient) AddHeaders(chain []BlockHeader) (int, error) {
+	added := 0
+	tip := lc.tip
+
+	err := lc.store.Update(func(tx StoreTx) error {
+		b := tx.Headers()
+		_, bestHeight, err := getHeader(tx, tip)
+		if err != nil {
+			bestHeight = -1
+		}
+
+		for i := range chain {
+			header := &chain[i]
+			hash := header.Hash()
+
+			if b.Get(hash) != nil {
+				continue
+			}
+
+			height := 0
+			if len(header.PrevBlockHash) > 0 || tip != nil {
+				_, prevHeight, err := getHeader(tx, header.PrevBlockHash)
+				if err != nil {
+					return fmt.Errorf("%w: %x", ErrHeaderNotOnChain, hash)
+				}
+				height = prevHeight + 1
+			}
+
+			if !NewProofOfWork(header).Validate() {
+				return fmt.Errorf("%w: %x", ErrInvalidPoW, hash)
+			}
+
+			if err := b.Put(hash, encodeHeaderEntry(header, height)); err != nil {
+				return err
+			}
+			added++
+
+			if height > bestHeight {
+				if err := tx.SetTip(hash); err != nil {
+					return err
+				}
+				tip, bestHeight = hash, height
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	lc.tip = tip
+
+	return added, nil
+}
+
+// AddProvenTransaction stores tx after checking that proof places it in a known block
+func (lc *LightClient) AddProvenTransaction(tx *Transaction, proof TxProof) error {
+	if err := proof.VerifyTransaction(tx); err != nil {
+		return err
+	}
+
+	return lc.store.Update(func(dbTx StoreTx) error {
+		// the header hash commits to the Merkle root, a known hash is enough
+		blockHash := proof.Header.Hash()
+		if _, _, err := getHeader(dbTx, blockHash); err != nil {
+			return err
+		}
+
+		// the hash of the block comes first, followed by the transaction
+		return dbTx.Index(spvTxBucket).Put(tx.ID, append(blockHash, tx.Serialize()...))
+	})
+}
+
+// Transactions returns the proven transactions whose block is on the best header chain
+func (lc *LightClient) Transactions() []Transaction {
+	var txs []Transaction
+
+	_ = lc.store.View(func(dbTx StoreTx) error {
+		onChain := make(map[string]bool)
+		for hash := lc.tip; len(hash) > 0; {
+			header, _, err := getHeader(dbTx, hash)
+			if err != nil {
+				return err
+			}
+			onChain[string(hash)] = true
+			hash = header.PrevBlockHash
+		}
+
+		return dbTx.Index(spvTxBucket).ForEach(func(k, v []byte) error {
+			if len(v) > sha256.Size && onChain[string(v[:sha256.Size])] {
+				txs = append(txs, DeserializeTransaction(v[sha256.Size:]))
+			}
+			return nil
+		})
+	})
+
+	return txs
+}
+
+// Balance sums the outputs locked with pubKeyHash that no proven transaction spends
+func (lc *LightClient) Balance(pubKeyHash []byte) int {
+	txs := lc.Transactions()
+
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Vin {
+				spent[fmt.Sprintf("%x:%d", in.TxID, in.Vout)] = true
+			}
+		}
+	}
+
+	balance := 0
+	for _, tx := range txs {
+		for outIdx, out := range tx.Vout {
+			if out.IsLockedWithKey(pubKeyHash) && !spent[fmt.Sprintf("%x:%d", tx.ID, outIdx)] {
+				balance += out.Value
+			}
+		}
+	}
+
+	return balance
+}
+
+// Sync downloads the headers a full node at address has beyond ours, then loads a bloom
+// filter matching pubKeys into it and requests every block not scanned yet as
+// a filtered block. Transactions that match the filter but do not involve pubKeys
+// are false positives and are dropped. The session runs on one connection to the
+// node, which must offer ServiceSPV.
+func (lc *LightClient) Sync(address string, pubKeys [][]byte) error {
+	var pubKeyHashes [][]byte
+	for _, pubKey := range pubKeys {
+		pubKeyHashes = append(pubKeyHashes, HashPubKey(pubKey))
+	}
+
+	type message struct {
+		command string
+		payload []byte
+	}
+	received := make(chan message, peerSendQueue)
+	node, err := connectPeer(address, func(p *peer, command string, payload []byte) {
+		select {
+		case received <- message{command, payload}:
+		case <-p.done:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer node.disconnect()
+
+	timeout := time.After(spvSyncTimeout)
+	select {
+	case <-node.ready:
+	case <-node.done:
+		return fmt.Errorf("sync with %s: disconnected", address)
+	case <-timeout:
+		return fmt.Errorf("sync with %s: timed out", address)
+	}
+	if !node.remote.Services.Has(ServiceSPV) {
+		return fmt.Errorf("%w: %s", ErrNoSPVService, address)
+	}
+
+	sendGetHeaders(address, lc.Locator())
+	pending := make(map[string]bool)
+
+	for {
+		var request message
+		select {
+		case request = <-received:
+		case <-node.done:
+			return fmt.Errorf("sync with %s: disconnected", address)
+		case <-timeout:
+			return fmt.Errorf("sync with %s: timed out", address)
+		}
+
+		switch request.command {
+		case "headers":
+			var payload headers
+			if err := gob.NewDecoder(bytes.NewReader(request.payload)).Decode(&payload); err != nil {
+				return err
+			}
+
+			var chain []BlockHeader
+			for _, data := range payload.Headers {
+				header, err := DecodeHeader(data)
+				if err != nil {
+					return err
+				}
+				chain = append(chain, header)
+			}
+
+			added, err := lc.AddHeaders(chain)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Received %d headers, %d new, best height %d\n", len(chain), added, lc.BestHeight())
+
+			if len(chain) == maxHeadersPerMessage {
+				sendGetHeaders(address, lc.Locator())
+				continue
+			}
+			if len(lc.unscannedBlocks()) == 0 {
+				return nil
+			}
+			sendFilterLoad(address, lc.filter(pubKeys, pubKeyHashes))
+
+		case "filterack":
+			for _, hash := range lc.unscannedBlocks() {
+				pending[string(hash)] = true
+				sendGetData(address, "filtered_block", hash)
+			}
+
+		case "merkleblock":
+			var payload merkleblock
+			if err := gob.NewDecoder(bytes.NewReader(request.payload)).Decode(&payload); err != nil {
+				return err
+			}
+
+			hash, matched, err := lc.AddFilteredBlock(payload, pubKeyHashes)
+			if err != nil {
+				return err
+			}
+			if matched > 0 {
+				fmt.Printf("Block %x has %d of our transactions\n", hash, matched)
+			}
+
+			delete(pending, string(hash))
+			if len(pending) == 0 {
+				return nil
+			}
+
+		case "notfound":
+			// a pruned node does not have the older blocks
+			var payload notfound
+			if err := gob.NewDecoder(bytes.NewReader(request.payload)).Decode(&payload); err != nil {
+				return err
+			}
+
+			return fmt.Errorf("sync with %s: %w: %x", address, ErrBlockNotServed, payload.ID)
+		}
+	}
+}
+
+// unscannedBlocks returns the hashes of the best chain blocks not requested as filtered blocks yet, oldest first
+func (lc *LightClient) unscannedBlocks() [][]byte {
+	var hashes [][]byte
+
+	_ = lc.store.View(func(tx StoreTx) error {
+		scanned := tx.Index(spvScannedBucket)
+		for hash := lc.tip; len(hash) > 0; {
+			header, _, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			if scanned.Get(hash) == nil {
+				hashes = append([][]byte{hash}, hashes...)
+			}
+			hash = header.PrevBlockHash
+		}
+		return nil
+	})
+
+	return hashes
+}
+
+// filter builds a bloom filter matching the wallet's keys and its unspent outputs
+func (lc *LightClient) filter(pubKeys, pubKeyHashes [][]byte) *BloomFilter {
+	var outpoints [][]byte
+	for _, tx := range lc.Transactions() {
+		for i, out := range tx.Vout {
+			for _, pubKeyHash := range pubKeyHashes {
+				if out.IsLockedWithKey(pubKeyHash) {
+					outpoints = append(outpoints, outpointKey(tx.ID, i))
+				}
+			}
+		}
+	}
+
+	elements := append(append(append([][]byte{}, pubKeys...), pubKeyHashes...), outpoints...)
+	filter := NewBloomFilter(len(elements), spvFilterFPRate, rand.Uint32(), BloomUpdateAll)
+	for _, data := range elements {
+		filter.Add(data)
+	}
+
+	return filter
+}
+
+// AddFilteredBlock checks the transactions of a merkleblock against the header, which
+// must be known, stores those involving pubKeyHashes and marks the block as scanned.
+// It returns the block hash and the number of transactions stored.
+func (lc *LightClient) AddFilteredBlock(mb merkleblock, pubKeyHashes [][]byte) ([]byte, int, error) {
+	header, err := DecodeHeader(mb.Header)
+	if err != nil {
+		return nil, 0, err
+	}
+	hash := header.Hash()
+	if len(mb.Proofs) != len(mb.Transactions) {
+		return hash, 0, fmt.Errorf("%d proofs for %d transactions", len(mb.Proofs), len(mb.Transactions))
+	}
+
+	matched := 0
+	for i := range mb.Transactions {
+		tx, err := DecodeTransaction(mb.Transactions[i])
+		if err != nil {
+			return hash, matched, err
+		}
+		proof, err := DecodeMerkleProof(mb.Proofs[i])
+		if err != nil {
+			return hash, matched, err
+		}
+
+		if !tx.involvesAny(pubKeyHashes) {
+			continue
+		}
+		if err := lc.AddProvenTransaction(&tx, TxProof{header, proof}); err != nil {
+			return hash, matched, fmt.Errorf("transaction %s: %w", hex.EncodeToString(tx.ID), err)
+		}
+		matched++
+	}
+
+	err = lc.store.Update(func(tx StoreTx) error {
+		return tx.Index(spvScannedBucket).Put(hash, []byte{})
+	})
+
+	return hash, matched, err
+}
@@ -0,0 +1,163 @@
+package block
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// spvGenesisProof proves the coinbase of a mined genesis block, see spvGenesisTx
+const spvGenesisProof = "b1010020e6d961d1c3f8b9e87a03ee2a7f5ee0d341a144dc91b38a1c8105c2552f8df4f2f4eeb1ad0d18e6dfc03900010120f7e3063d7649b8562c31b77cb94ff0d3699a0636423f4efd7f34c3e45da0eb9c"
+
+func spvGenesisTx() *Transaction {
+	pubKeyHash, _ := hex.DecodeString("eba906d6e1ca0d267e6878e8e489da0d5e5ff238")
+	tx := &Transaction{nil, []TXInput{{[]byte{}, -1, nil, []byte(genesisCoinbaseData)}}, []TXOutput{{subsidy, pubKeyHash}}, txVersion}
+	tx.ID = tx.Hash()
+
+	return tx
+}
+
+func newTestLightClient(t *testing.T) *LightClient {
+	lc, err := openLightClient(filepath.Join(t.TempDir(), "spv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lc.Close)
+
+	return lc
+}
+
+func TestLightClientBalance(t *testing.T) {
+	lc := newTestLightClient(t)
+	data, _ := hex.DecodeString(spvGenesisProof)
+	proof, err := DecodeTxProof(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := spvGenesisTx()
+
+	// the block must be known before transactions can be proven in it
+	if err := lc.AddProvenTransaction(tx, proof); !errors.Is(err, ErrHeaderNotFound) {
+		t.Fatalf("got %v, want %v", err, ErrHeaderNotFound)
+	}
+
+	if added, err := lc.AddHeaders([]BlockHeader{proof.Header}); err != nil || added != 1 {
+		t.Fatalf("added %d headers: %v", added, err)
+	}
+	if height := lc.BestHeight(); height != 0 {
+		t.Fatalf("best height %d", height)
+	}
+
+	if err := lc.AddProvenTransaction(tx, proof); err != nil {
+		t.Fatal(err)
+	}
+	if balance := lc.Balance(tx.Vout[0].PubKeyHash); balance != subsidy {
+		t.Fatalf("balance %d, want %d", balance, subsidy)
+	}
+
+	forged := *tx
+	forged.Vout = []TXOutput{{1000, tx.Vout[0].PubKeyHash}}
+	forged.ID = forged.Hash()
+	if err := lc.AddProvenTransaction(&forged, proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidProof)
+	}
+}
+
+func TestLightClientRejectsHeaders(t *testing.T) {
+	lc := newTestLightClient(t)
+	data, _ := hex.DecodeString(spvGenesisProof)
+	proof, _ := DecodeTxProof(data)
+	genesis := proof.Header
+
+	unmined := genesis
+	unmined.Nonce++
+	if _, err := lc.AddHeaders([]BlockHeader{unmined}); !errors.Is(err, ErrInvalidPoW) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidPoW)
+	}
+
+	orphan := BlockHeader{Version: blockVersion, PrevBlockHash: []byte{1, 2, 3}, Bits: targetBits}
+	if _, err := lc.AddHeaders([]BlockHeader{genesis, orphan}); !errors.Is(err, ErrHeaderNotOnChain) {
+		t.Fatalf("got %v, want %v", err, ErrHeaderNotOnChain)
+	}
+
+	// a failed batch is not stored
+	if height := lc.BestHeight(); height != -1 {
+		t.Fatalf("best height %d after a rejected batch", height)
+	}
+}
+
+func TestLightClientFilteredBlock(t *testing.T) {
+	lc := newTestLightClient(t)
+	data, _ := hex.DecodeString(spvGenesisProof)
+	proof, _ := DecodeTxProof(data)
+	tx := spvGenesisTx()
+	if _, err := lc.AddHeaders([]BlockHeader{proof.Header}); err != nil {
+		t.Fatal(err)
+	}
+	if unscanned := lc.unscannedBlocks(); len(unscanned) != 1 {
+		t.Fatalf("%d unscanned blocks", len(unscanned))
+	}
+
+	// a false positive of the peer's filter is dropped before its proof is checked
+	falsePositive := NewCoinbaseTX(string(NewWallet().GetAddress()), "")
+	mb := merkleblock{
+		Header:       proof.Header.Serialize(),
+		Transactions: [][]byte{tx.Serialize(), falsePositive.Serialize()},
+		Proofs:       [][]byte{EncodeMerkleProof(&proof.Proof), EncodeMerkleProof(&proof.Proof)},
+	}
+
+	hash, matched, err := lc.AddFilteredBlock(mb, [][]byte{tx.Vout[0].PubKeyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched != 1 || len(lc.unscannedBlocks()) != 0 {
+		t.Fatalf("block %x: %d matched, %d unscanned", hash, matched, len(lc.unscannedBlocks()))
+	}
+	if balance := lc.Balance(tx.Vout[0].PubKeyHash); balance != subsidy {
+		t.Fatalf("balance %d, want %d", balance, subsidy)
+	}
+}
+
+func TestLightClientSyncFromPrunedNode(t *testing.T) {
+	data, _ := hex.DecodeString(spvGenesisProof)
+	proof, err := DecodeTxProof(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the node serves its headers but pruned the blocks
+	version := fakeVersion()
+	version.Services = ServicePruned | ServiceSPV
+	addr := listenFakeNode(t, version, func(conn net.Conn) {
+		for {
+			command, payload, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			switch command {
+			case "getheaders":
+				_ = writeMessage(conn, "headers", gobEncode(headers{Headers: [][]byte{proof.Header.Serialize()}}))
+			case "filterload":
+				_ = writeMessage(conn, "filterack", gobEncode(filterack{}))
+			case "getdata":
+				var request getdata
+				_ = gob.NewDecoder(bytes.NewReader(payload)).Decode(&request)
+				_ = writeMessage(conn, "notfound", gobEncode(notfound{"", request.Type, request.ID}))
+			}
+		}
+	})
+
+	lc := newTestLightClient(t)
+	start := time.Now()
+	if err := lc.Sync(addr, nil); !errors.Is(err, ErrBlockNotServed) {
+		t.Fatalf("syncing from a pruned node returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > spvSyncTimeout/2 {
+		t.Errorf("the sync failed after %v", elapsed)
+	}
+}
@@ -0,0 +1,86 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrReadOnlyTx    = errors.New("write in a read-only store transaction")
+	ErrBlockNotFound = errors.New("block is not found")
+)
+
+// ChainStore persists the chain: blocks, their headers, the tip, the UTXO set and
+// any number of named indexes. All reads and writes happen in transactions. An
+// Update is atomic: when fn returns an error nothing it wrote is kept, and readers
+// never see part of it.
+type ChainStore interface {
+	View(fn func(tx StoreTx) error) error
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx is a read-only or read-write transaction of a ChainStore.
+// Values it returns are only valid until the transaction ends and must not be modified.
+type StoreTx interface {
+	Blocks() StoreBucket  // serialized blocks by hash
+	Headers() StoreBucket // header entries, see encodeHeaderEntry, by hash
+	UTXO() StoreBucket    // serialized TXOutputs by transaction ID
+
+	// Index returns the named index, which is created on the first write
+	Index(name string) StoreBucket
+	// DeleteIndex removes the named index and everything in it
+	DeleteIndex(name string) error
+	// ClearUTXO removes every entry of the UTXO set
+	ClearUTXO() error
+
+	Tip() []byte // hash of the last block of the main chain, nil when empty
+	SetTip(hash []byte) error
+}
+
+// StoreBucket is a set of key-value pairs of a transaction, iterated in key order
+type StoreBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error
+}
+
+// putBlock stores a block and its header
+func putBlock(tx StoreTx, block *Block) error {
+	if err := tx.Blocks().Put(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+
+	return tx.Headers().Put(block.Hash, encodeHeaderEntry(&block.BlockHeader, block.Height))
+}
+
+// getBlock reads a stored block
+func getBlock(tx StoreTx, hash []byte) (*Block, error) {
+	data := tx.Blocks().Get(hash)
+	if data == nil {
+		if _, height, err := getHeader(tx, hash); err == nil && height < getPrunedHeight(tx) {
+			return nil, fmt.Errorf("%w: %x", ErrBlockPruned, hash)
+		}
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+
+	return DeserializeBlock(data), nil
+}
+
+// getHeader reads a stored header and the height of its block
+func getHeader(tx StoreTx, hash []byte) (BlockHeader, int, error) {
+	data := tx.Headers().Get(hash)
+	if data == nil {
+		return BlockHeader{}, 0, fmt.Errorf("%w: %x", ErrHeaderNotFound, hash)
+	}
+
+	return decodeHeaderEntry(data)
+}
+
+// isEmpty reports whether a bucket has no keys
+func isEmpty(b StoreBucket) bool {
+	errFound := errors.New("found")
+	return b.ForEach(func(k, v []byte) error { return errFound }) == nil
+}
@@ -0,0 +1,182 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// tipKey is the key of the tip hash in the blocks bucket
+const tipKey = "l"
+
+// boltStore is a ChainStore kept in a bolt database file. Every part of the chain
+// is a bucket, and so is every index.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the bolt database at path, creating the file and its buckets if needed
+func OpenBoltStore(path string) (ChainStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{blocksBucket, headersBucket, utxoBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Blocks() StoreBucket {
+	// the tip shares the blocks bucket with the blocks, as in databases of older versions
+	return boltBucket{t.tx, []byte(blocksBucket), []byte(tipKey)}
+}
+
+func (t boltTx) Headers() StoreBucket {
+	return boltBucket{t.tx, []byte(headersBucket), nil}
+}
+
+func (t boltTx) UTXO() StoreBucket {
+	return boltBucket{t.tx, []byte(utxoBucket), nil}
+}
+
+func (t boltTx) Index(name string) StoreBucket {
+	return boltBucket{t.tx, []byte(name), nil}
+}
+
+func (t boltTx) DeleteIndex(name string) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+
+	err := t.tx.DeleteBucket([]byte(name))
+	if errors.Is(err, bolt.ErrBucketNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func (t boltTx) ClearUTXO() error {
+	if err := t.DeleteIndex(utxoBucket); err != nil {
+		return err
+	}
+
+	_, err := t.tx.CreateBucket([]byte(utxoBucket))
+	return err
+}
+
+func (t boltTx) Tip() []byte {
+	tip := t.tx.Bucket([]byte(blocksBucket)).Get([]byte(tipKey))
+	if tip == nil {
+		return nil
+	}
+
+	return append([]byte{}, tip...)
+}
+
+func (t boltTx) SetTip(hash []byte) error {
+	if !t.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+
+	return t.tx.Bucket([]byte(blocksBucket)).Put([]byte(tipKey), hash)
+}
+
+// boltBucket is a bucket looked up on every access, so that an index missing from
+// the file reads as empty and is created by its first write
+type boltBucket struct {
+	tx   *bolt.Tx
+	name []byte
+	skip []byte // key stored in the same bucket but not part of it
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	bucket := b.tx.Bucket(b.name)
+	if bucket == nil || (b.skip != nil && bytes.Equal(key, b.skip)) {
+		return nil
+	}
+
+	return bucket.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	if !b.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+
+	bucket, err := b.tx.CreateBucketIfNotExists(b.name)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	if !b.tx.Writable() {
+		return ErrReadOnlyTx
+	}
+
+	bucket := b.tx.Bucket(b.name)
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete(key)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.ForEachPrefix(nil, fn)
+}
+
+func (b boltBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	bucket := b.tx.Bucket(b.name)
+	if bucket == nil {
+		return nil
+	}
+
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if b.skip != nil && bytes.Equal(k, b.skip) {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
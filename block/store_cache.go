@@ -0,0 +1,355 @@
+package block
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// defaultUTXOCacheSize is the number of bytes of chain state changes a node keeps in
+// memory before writing them to its database
+const defaultUTXOCacheSize = 32 << 20
+
+// cachedStore is a ChainStore keeping the chain state, that is the UTXO set, its undo
+// data and the block it is at, in memory over another ChainStore. The changes every
+// Update makes to it are written back together once they exceed a size, on Flush and
+// on Close, so that a long run of connected blocks writes each output once at most.
+// Everything else is written through. After a crash the chain state on disk is behind
+// the tip, and recoverChainState connects the blocks committed since it was written.
+type cachedStore struct {
+	inner   ChainStore
+	maxSize int
+
+	writer sync.Mutex                   // held for a whole Update or flush, one writer at a time
+	mu     sync.RWMutex                 // held while reading and while changing the cache
+	cache  map[string]map[string][]byte // changes by bucket and key, nil for a deletion
+	reset  map[string]bool              // buckets emptied before the changes
+	size   int                          // bytes of the changes
+}
+
+// NewCachedStore returns store with a write-back cache of up to maxSize bytes for the
+// chain state
+func NewCachedStore(store ChainStore, maxSize int) ChainStore {
+	return &cachedStore{
+		inner:   store,
+		maxSize: maxSize,
+		cache:   make(map[string]map[string][]byte),
+		reset:   make(map[string]bool),
+	}
+}
+
+// isChainState reports whether the key of a bucket belongs to the cached chain state
+func isChainState(bucket string, key []byte) bool {
+	switch bucket {
+	case utxoBucket, undoIndex:
+		return true
+	case metaBucket:
+		return string(key) == utxoTipKey
+	}
+
+	return false
+}
+
+func (s *cachedStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.inner.View(func(tx StoreTx) error {
+		return fn(&cachedTx{StoreTx: tx, store: s})
+	})
+}
+
+func (s *cachedStore) Update(fn func(tx StoreTx) error) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+
+	cached := &cachedTx{
+		store:  s,
+		writes: make(map[string]map[string][]byte),
+		reset:  make(map[string]bool),
+	}
+	locked := false
+	err := s.inner.Update(func(tx StoreTx) error {
+		cached.StoreTx = tx
+		if err := fn(cached); err != nil {
+			return err
+		}
+
+		// readers wait from before the inner store commits until the cache has the
+		// changes too, so that they never see one without the other
+		s.mu.Lock()
+		locked = true
+		return nil
+	})
+	if locked {
+		if err == nil {
+			s.apply(cached)
+		}
+		s.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.size > s.maxSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// apply adds the chain state changes of a committed transaction to the cache
+func (s *cachedStore) apply(tx *cachedTx) {
+	for name := range tx.reset {
+		s.reset[name] = true
+		for k, v := range s.cache[name] {
+			s.size -= len(k) + len(v)
+		}
+		delete(s.cache, name)
+	}
+
+	for name, writes := range tx.writes {
+		bucket := s.cache[name]
+		if bucket == nil {
+			bucket = make(map[string][]byte)
+			s.cache[name] = bucket
+		}
+		for k, v := range writes {
+			if old, ok := bucket[k]; ok {
+				s.size -= len(k) + len(old)
+			}
+			bucket[k] = v
+			s.size += len(k) + len(v)
+		}
+	}
+}
+
+// Flush writes the cached chain state to the inner store
+func (s *cachedStore) Flush() error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+
+	return s.flush()
+}
+
+func (s *cachedStore) flush() error {
+	if len(s.cache) == 0 && len(s.reset) == 0 {
+		return nil
+	}
+
+	err := s.inner.Update(func(tx StoreTx) error {
+		for name := range s.reset {
+			if err := tx.DeleteIndex(name); err != nil {
+				return err
+			}
+		}
+
+		for name, changes := range s.cache {
+			b := tx.Index(name)
+			for k, v := range changes {
+				var err error
+				if v == nil {
+					err = b.Delete([]byte(k))
+				} else {
+					err = b.Put([]byte(k), v)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = make(map[string]map[string][]byte)
+	s.reset = make(map[string]bool)
+	s.size = 0
+
+	return nil
+}
+
+// Close writes the cached chain state back and closes the inner store
+func (s *cachedStore) Close() error {
+	if err := s.Flush(); err != nil {
+		_ = s.inner.Close()
+		return err
+	}
+
+	return s.inner.Close()
+}
+
+// flushChainState writes the chain state cached over store, if any, to the database
+func flushChainState(store ChainStore) error {
+	if s, ok := store.(*cachedStore); ok {
+		return s.Flush()
+	}
+
+	return nil
+}
+
+// cachedTx reads the chain state from its own changes, then the cache, then the inner
+// transaction, and keeps its changes apart until it commits
+type cachedTx struct {
+	StoreTx
+	store  *cachedStore
+	writes map[string]map[string][]byte // nil for a read-only transaction
+	reset  map[string]bool
+}
+
+func (t *cachedTx) UTXO() StoreBucket {
+	return t.Index(utxoBucket)
+}
+
+func (t *cachedTx) Index(name string) StoreBucket {
+	switch name {
+	case utxoBucket, undoIndex, metaBucket:
+		return cachedBucket{t, name}
+	}
+
+	return t.StoreTx.Index(name)
+}
+
+func (t *cachedTx) DeleteIndex(name string) error {
+	if t.writes == nil {
+		return ErrReadOnlyTx
+	}
+
+	switch name {
+	case utxoBucket, undoIndex:
+		t.reset[name] = true
+		delete(t.writes, name)
+		return nil
+	case metaBucket:
+		if err := (cachedBucket{t, name}).Delete([]byte(utxoTipKey)); err != nil {
+			return err
+		}
+	}
+
+	return t.StoreTx.DeleteIndex(name)
+}
+
+func (t *cachedTx) ClearUTXO() error {
+	return t.DeleteIndex(utxoBucket)
+}
+
+// inner returns the bucket of the inner transaction
+func (t *cachedTx) inner(name string) StoreBucket {
+	if name == utxoBucket {
+		return t.StoreTx.UTXO()
+	}
+
+	return t.StoreTx.Index(name)
+}
+
+// cachedBucket is a bucket holding chain state, all of it or only some keys
+type cachedBucket struct {
+	tx   *cachedTx
+	name string
+}
+
+func (b cachedBucket) Get(key []byte) []byte {
+	if !isChainState(b.name, key) {
+		return b.tx.inner(b.name).Get(key)
+	}
+
+	if v, ok := b.tx.writes[b.name][string(key)]; ok {
+		return v
+	}
+	if b.tx.reset[b.name] {
+		return nil
+	}
+	if v, ok := b.tx.store.cache[b.name][string(key)]; ok {
+		return v
+	}
+	if b.tx.store.reset[b.name] {
+		return nil
+	}
+
+	return b.tx.inner(b.name).Get(key)
+}
+
+func (b cachedBucket) Put(key, value []byte) error {
+	if !isChainState(b.name, key) {
+		return b.tx.inner(b.name).Put(key, value)
+	}
+
+	return b.write(key, append([]byte{}, value...))
+}
+
+func (b cachedBucket) Delete(key []byte) error {
+	if !isChainState(b.name, key) {
+		return b.tx.inner(b.name).Delete(key)
+	}
+
+	return b.write(key, nil)
+}
+
+func (b cachedBucket) write(key, value []byte) error {
+	if b.tx.writes == nil {
+		return ErrReadOnlyTx
+	}
+
+	writes := b.tx.writes[b.name]
+	if writes == nil {
+		writes = make(map[string][]byte)
+		b.tx.writes[b.name] = writes
+	}
+	writes[string(key)] = value
+
+	return nil
+}
+
+func (b cachedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.ForEachPrefix(nil, fn)
+}
+
+func (b cachedBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	hidden := b.tx.reset[b.name] || b.tx.store.reset[b.name]
+	if !hidden && len(b.tx.writes[b.name]) == 0 && len(b.tx.store.cache[b.name]) == 0 {
+		return b.tx.inner(b.name).ForEachPrefix(prefix, fn)
+	}
+
+	// the keys of the inner bucket and of the changes, in order, each read through Get
+	seen := make(map[string]bool)
+	var keys []string
+	collect := func(changes map[string][]byte) {
+		for k := range changes {
+			if bytes.HasPrefix([]byte(k), prefix) && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	err := b.tx.inner(b.name).ForEachPrefix(prefix, func(k, v []byte) error {
+		if hidden && isChainState(b.name, k) {
+			return nil
+		}
+		seen[string(k)] = true
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !b.tx.reset[b.name] {
+		collect(b.tx.store.cache[b.name])
+	}
+	collect(b.tx.writes[b.name])
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := b.Get([]byte(k))
+		if v == nil {
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCachedStoreWritesBack(t *testing.T) {
+	inner := NewMemoryStore()
+	store := NewCachedStore(inner, defaultUTXOCacheSize)
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeTestChain(t, bc, 3)
+	want := utxoValues(t, bc)
+	if len(want) != 3 {
+		t.Fatalf("UTXO set of %d outputs through the cache, want 3", len(want))
+	}
+
+	// only the blocks reached the inner store, the chain state waits in memory
+	err = inner.View(func(tx StoreTx) error {
+		if tx.Tip() == nil || getUTXOTip(tx) != nil {
+			t.Error("the tip is not written through or the chain state is not cached")
+		}
+		return tx.UTXO().ForEach(func(k, v []byte) error {
+			t.Errorf("output %x was written through", k)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flushChainState(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := utxoValues(t, newBlockchain(blocks[2].Hash, inner)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set written back %v, want %v", got, want)
+	}
+	err = inner.View(func(tx StoreTx) error {
+		if !bytes.Equal(getUTXOTip(tx), blocks[2].Hash) {
+			t.Errorf("the chain state was written back at %x", getUTXOTip(tx))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedStoreFlushesWhenFull(t *testing.T) {
+	inner := NewMemoryStore()
+	bc, err := OpenBlockchain(NewCachedStore(inner, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeTestChain(t, bc, 2)
+
+	err = inner.View(func(tx StoreTx) error {
+		if !bytes.Equal(getUTXOTip(tx), blocks[1].Hash) {
+			t.Errorf("a full cache was not written back")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedStoreRecoversAfterCrash(t *testing.T) {
+	inner := NewMemoryStore()
+	bc, err := OpenBlockchain(NewCachedStore(inner, defaultUTXOCacheSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeTestChain(t, bc, 2)
+	if err := flushChainState(bc.store); err != nil {
+		t.Fatal(err)
+	}
+	prev := blocks[1]
+	for height := 2; height < 5; height++ {
+		block := testBlock(prev.Hash, height, fmt.Sprint(height))
+		if err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		prev = block
+	}
+	want := utxoValues(t, bc)
+
+	// the process stops without writing the cache back
+	reopened, err := OpenBlockchain(NewCachedStore(inner, defaultUTXOCacheSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := utxoValues(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Fatalf("UTXO set after the crash %v, want %v", got, want)
+	}
+	err = reopened.store.View(func(tx StoreTx) error {
+		if !bytes.Equal(getUTXOTip(tx), prev.Hash) {
+			t.Errorf("the chain state is at %x, want the tip", getUTXOTip(tx))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache[int](2)
+	cache.Add([]byte("a"), 1)
+	cache.Add([]byte("b"), 2)
+	cache.Get([]byte("a"))
+	cache.Add([]byte("c"), 3)
+
+	if _, ok := cache.Get([]byte("b")); ok {
+		t.Error("the least recently used value was kept")
+	}
+	if v, ok := cache.Get([]byte("a")); !ok || v != 1 {
+		t.Errorf("got %d, %v for a recently used value", v, ok)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("cache of %d values, want 2", cache.Len())
+	}
+
+	cache.Purge()
+	if _, ok := cache.Get([]byte("c")); ok || cache.Len() != 0 {
+		t.Error("values were kept after a purge")
+	}
+
+	var none *lruCache[int]
+	none.Add([]byte("a"), 1)
+	if _, ok := none.Get([]byte("a")); ok {
+		t.Error("a nil cache kept a value")
+	}
+}
+
+// benchmarkSync connects b.N blocks one by one to a chain stored in bolt, as a node
+// does during its initial sync
+func benchmarkSync(b *testing.B, cacheSize int) {
+	var store ChainStore
+	store, err := OpenBoltStore(filepath.Join(b.TempDir(), "chain.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if cacheSize > 0 {
+		store = NewCachedStore(store, cacheSize)
+	}
+	defer store.Close()
+
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		b.Fatal(err)
+	}
+	prev := storeTestChain(b, bc, 1)[0]
+	blocks := make([]*Block, b.N)
+	for i := range blocks {
+		blocks[i] = testBlock(prev.Hash, i+1, fmt.Sprint(i+1))
+		prev = blocks[i]
+	}
+
+	b.ResetTimer()
+	for _, block := range blocks {
+		if err := bc.AddBlock(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := flushChainState(store); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSync(b *testing.B) {
+	benchmarkSync(b, 0)
+}
+
+func BenchmarkSyncCached(b *testing.B) {
+	benchmarkSync(b, defaultUTXOCacheSize)
+}
+
+// benchmarkBestHeight reads the height of the tip of a chain stored in bolt
+func benchmarkBestHeight(b *testing.B, cached bool) {
+	store, err := OpenBoltStore(filepath.Join(b.TempDir(), "chain.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		b.Fatal(err)
+	}
+	storeTestChain(b, bc, 10)
+	if !cached {
+		bc.headers = nil
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bc.GetBestHeight()
+	}
+}
+
+func BenchmarkBestHeight(b *testing.B) {
+	benchmarkBestHeight(b, false)
+}
+
+func BenchmarkBestHeightCached(b *testing.B) {
+	benchmarkBestHeight(b, true)
+}
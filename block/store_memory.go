@@ -0,0 +1,221 @@
+package block
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore is a ChainStore kept in memory, for tests and chains that do not
+// outlive the process. An Update collects its writes apart and applies them when
+// it succeeds, so readers only ever see whole transactions.
+type memoryStore struct {
+	writer sync.Mutex   // held for a whole Update, one writer at a time
+	mu     sync.RWMutex // held while reading and while applying an Update
+	data   map[string]map[string][]byte
+	tip    []byte
+}
+
+// NewMemoryStore returns an empty in-memory ChainStore
+func NewMemoryStore() ChainStore {
+	return &memoryStore{data: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{store: s})
+}
+
+func (s *memoryStore) Update(fn func(tx StoreTx) error) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+
+	// only the writer changes the data, so the transaction reads it without s.mu
+	tx := &memoryTx{
+		store:    s,
+		writable: true,
+		writes:   make(map[string]map[string][]byte),
+		cleared:  make(map[string]bool),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx.commit()
+
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	store    *memoryStore
+	writable bool
+	writes   map[string]map[string][]byte // by bucket and key, nil for a deletion
+	cleared  map[string]bool              // buckets emptied before writes
+	tip      []byte                       // new tip, when set
+}
+
+func (t *memoryTx) commit() {
+	for name := range t.cleared {
+		delete(t.store.data, name)
+	}
+
+	for name, writes := range t.writes {
+		bucket := t.store.data[name]
+		if bucket == nil {
+			bucket = make(map[string][]byte)
+			t.store.data[name] = bucket
+		}
+
+		for k, v := range writes {
+			if v == nil {
+				delete(bucket, k)
+			} else {
+				bucket[k] = v
+			}
+		}
+	}
+
+	if t.tip != nil {
+		t.store.tip = t.tip
+	}
+}
+
+func (t *memoryTx) Blocks() StoreBucket {
+	return memoryBucket{t, blocksBucket}
+}
+
+func (t *memoryTx) Headers() StoreBucket {
+	return memoryBucket{t, headersBucket}
+}
+
+func (t *memoryTx) UTXO() StoreBucket {
+	return memoryBucket{t, utxoBucket}
+}
+
+func (t *memoryTx) Index(name string) StoreBucket {
+	return memoryBucket{t, name}
+}
+
+func (t *memoryTx) DeleteIndex(name string) error {
+	if !t.writable {
+		return ErrReadOnlyTx
+	}
+
+	t.cleared[name] = true
+	delete(t.writes, name)
+
+	return nil
+}
+
+func (t *memoryTx) ClearUTXO() error {
+	return t.DeleteIndex(utxoBucket)
+}
+
+func (t *memoryTx) Tip() []byte {
+	tip := t.tip
+	if tip == nil {
+		tip = t.store.tip
+	}
+	if tip == nil {
+		return nil
+	}
+
+	return append([]byte{}, tip...)
+}
+
+func (t *memoryTx) SetTip(hash []byte) error {
+	if !t.writable {
+		return ErrReadOnlyTx
+	}
+
+	t.tip = append([]byte{}, hash...)
+	return nil
+}
+
+type memoryBucket struct {
+	tx   *memoryTx
+	name string
+}
+
+func (b memoryBucket) Get(key []byte) []byte {
+	if v, ok := b.tx.writes[b.name][string(key)]; ok {
+		return v
+	}
+	if b.tx.cleared[b.name] {
+		return nil
+	}
+
+	return b.tx.store.data[b.name][string(key)]
+}
+
+func (b memoryBucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	writes := b.tx.writes[b.name]
+	if writes == nil {
+		writes = make(map[string][]byte)
+		b.tx.writes[b.name] = writes
+	}
+	writes[string(key)] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (b memoryBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	writes := b.tx.writes[b.name]
+	if writes == nil {
+		writes = make(map[string][]byte)
+		b.tx.writes[b.name] = writes
+	}
+	writes[string(key)] = nil
+
+	return nil
+}
+
+func (b memoryBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.ForEachPrefix(nil, fn)
+}
+
+func (b memoryBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	seen := make(map[string]bool)
+	var keys []string
+	collect := func(bucket map[string][]byte) {
+		for k := range bucket {
+			if strings.HasPrefix(k, string(prefix)) && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	if !b.tx.cleared[b.name] {
+		collect(b.tx.store.data[b.name])
+	}
+	collect(b.tx.writes[b.name])
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := b.Get([]byte(k))
+		if v == nil {
+			continue
+		}
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,445 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// storeBackends are the ChainStore implementations checked by TestChainStore
+var storeBackends = map[string]func(tb testing.TB) ChainStore{
+	"bolt": func(tb testing.TB) ChainStore {
+		store, err := OpenBoltStore(filepath.Join(tb.TempDir(), "chain.db"))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { _ = store.Close() })
+		return store
+	},
+	"memory": func(tb testing.TB) ChainStore {
+		return NewMemoryStore()
+	},
+	"cached": func(tb testing.TB) ChainStore {
+		return NewCachedStore(NewMemoryStore(), defaultUTXOCacheSize)
+	},
+}
+
+// storeConformance lists the behaviour every ChainStore must have
+var storeConformance = []struct {
+	name string
+	test func(t *testing.T, store ChainStore)
+}{
+	{"EmptyStore", testStoreEmpty},
+	{"PutGetDelete", testStorePutGetDelete},
+	{"Tip", testStoreTip},
+	{"OrderedIteration", testStoreOrderedIteration},
+	{"Prefix", testStorePrefix},
+	{"Indexes", testStoreIndexes},
+	{"ClearUTXO", testStoreClearUTXO},
+	{"ReadOnlyView", testStoreReadOnlyView},
+	{"FailedUpdateRollsBack", testStoreRollback},
+	{"UpdateSeesOwnWrites", testStoreOwnWrites},
+	{"Blockchain", testStoreBlockchain},
+}
+
+func TestChainStore(t *testing.T) {
+	for backend, open := range storeBackends {
+		for _, c := range storeConformance {
+			t.Run(backend+"/"+c.name, func(t *testing.T) {
+				c.test(t, open(t))
+			})
+		}
+	}
+}
+
+// storeBuckets returns every bucket of a transaction, named
+func storeBuckets(tx StoreTx) map[string]StoreBucket {
+	return map[string]StoreBucket{
+		"blocks":  tx.Blocks(),
+		"headers": tx.Headers(),
+		"utxo":    tx.UTXO(),
+		"index":   tx.Index("test"),
+	}
+}
+
+// storeKeys returns the keys of a bucket in iteration order
+func storeKeys(t *testing.T, b StoreBucket, prefix []byte) []string {
+	var keys []string
+	err := b.ForEachPrefix(prefix, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func mustUpdate(t *testing.T, store ChainStore, fn func(tx StoreTx) error) {
+	t.Helper()
+	if err := store.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustView(t *testing.T, store ChainStore, fn func(tx StoreTx) error) {
+	t.Helper()
+	if err := store.View(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStoreEmpty(t *testing.T, store ChainStore) {
+	mustView(t, store, func(tx StoreTx) error {
+		if tip := tx.Tip(); tip != nil {
+			t.Errorf("tip of an empty store is %x", tip)
+		}
+		for name, b := range storeBuckets(tx) {
+			if v := b.Get([]byte("missing")); v != nil {
+				t.Errorf("%s: missing key read as %x", name, v)
+			}
+			if keys := storeKeys(t, b, nil); len(keys) != 0 {
+				t.Errorf("%s: keys %q in an empty store", name, keys)
+			}
+		}
+		return nil
+	})
+}
+
+func testStorePutGetDelete(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		for name, b := range storeBuckets(tx) {
+			if err := b.Put([]byte("k"), []byte(name)); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("empty"), []byte{}); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("gone"), []byte("x")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustUpdate(t, store, func(tx StoreTx) error {
+		for _, b := range storeBuckets(tx) {
+			if err := b.Delete([]byte("gone")); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte("never stored")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		for name, b := range storeBuckets(tx) {
+			if v := b.Get([]byte("k")); string(v) != name {
+				t.Errorf("%s: read %q, want %q", name, v, name)
+			}
+			if v := b.Get([]byte("empty")); v == nil || len(v) != 0 {
+				t.Errorf("%s: empty value read as %v", name, v)
+			}
+			if v := b.Get([]byte("gone")); v != nil {
+				t.Errorf("%s: deleted key read as %q", name, v)
+			}
+			if keys := storeKeys(t, b, nil); fmt.Sprint(keys) != "[empty k]" {
+				t.Errorf("%s: keys %q", name, keys)
+			}
+		}
+		return nil
+	})
+}
+
+func testStoreTip(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		return tx.SetTip([]byte("tip 1"))
+	})
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.SetTip([]byte("tip 2")); err != nil {
+			return err
+		}
+		if tip := tx.Tip(); string(tip) != "tip 2" {
+			t.Errorf("tip %q inside the update that set it", tip)
+		}
+		return nil
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		if tip := tx.Tip(); string(tip) != "tip 2" {
+			t.Errorf("tip %q, want %q", tip, "tip 2")
+		}
+		// the tip is not a block
+		if keys := storeKeys(t, tx.Blocks(), nil); len(keys) != 0 {
+			t.Errorf("blocks %q", keys)
+		}
+		return nil
+	})
+}
+
+func testStoreOrderedIteration(t *testing.T, store ChainStore) {
+	keys := [][]byte{{0x02}, {0xff, 0x00}, {0x00, 0x01}, {0x01}, {0xff}, {0x00}}
+	mustUpdate(t, store, func(tx StoreTx) error {
+		for _, k := range keys {
+			if err := tx.UTXO().Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		var got [][]byte
+		err := tx.UTXO().ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, v) {
+				t.Errorf("key %x has value %x", k, v)
+			}
+			got = append(got, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		want := [][]byte{{0x00}, {0x00, 0x01}, {0x01}, {0x02}, {0xff}, {0xff, 0x00}}
+		if fmt.Sprintf("%x", got) != fmt.Sprintf("%x", want) {
+			t.Errorf("iterated %x, want %x", got, want)
+		}
+		return nil
+	})
+
+	// an error stops the iteration and is returned
+	errStop := errors.New("stop")
+	mustView(t, store, func(tx StoreTx) error {
+		count := 0
+		err := tx.UTXO().ForEach(func(k, v []byte) error {
+			count++
+			return errStop
+		})
+		if !errors.Is(err, errStop) || count != 1 {
+			t.Errorf("iteration returned %v after %d keys", err, count)
+		}
+		return nil
+	})
+}
+
+func testStorePrefix(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		for _, k := range []string{"a", "ab", "abc", "abd", "ac", "b"} {
+			if err := tx.Index("test").Put([]byte(k), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		for prefix, want := range map[string]string{
+			"ab": "[ab abc abd]",
+			"a":  "[a ab abc abd ac]",
+			"c":  "[]",
+			"":   "[a ab abc abd ac b]",
+		} {
+			if keys := storeKeys(t, tx.Index("test"), []byte(prefix)); fmt.Sprint(keys) != want {
+				t.Errorf("prefix %q: keys %q, want %s", prefix, keys, want)
+			}
+		}
+		return nil
+	})
+}
+
+func testStoreIndexes(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.Index("one").Put([]byte("k"), []byte("1")); err != nil {
+			return err
+		}
+		return tx.Index("two").Put([]byte("k"), []byte("2"))
+	})
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.DeleteIndex("one"); err != nil {
+			return err
+		}
+		return tx.DeleteIndex("never created")
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		if v := tx.Index("one").Get([]byte("k")); v != nil {
+			t.Errorf("deleted index still has %q", v)
+		}
+		if v := tx.Index("two").Get([]byte("k")); string(v) != "2" {
+			t.Errorf("index read %q, want %q", v, "2")
+		}
+		return nil
+	})
+
+	// a deleted index can be written again in the same transaction
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.DeleteIndex("two"); err != nil {
+			return err
+		}
+		return tx.Index("two").Put([]byte("new"), []byte("3"))
+	})
+	mustView(t, store, func(tx StoreTx) error {
+		if keys := storeKeys(t, tx.Index("two"), nil); fmt.Sprint(keys) != "[new]" {
+			t.Errorf("recreated index has keys %q", keys)
+		}
+		return nil
+	})
+}
+
+func testStoreClearUTXO(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.Blocks().Put([]byte("block"), []byte{1}); err != nil {
+			return err
+		}
+		return tx.UTXO().Put([]byte("old"), []byte{1})
+	})
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.ClearUTXO(); err != nil {
+			return err
+		}
+		if v := tx.UTXO().Get([]byte("old")); v != nil {
+			t.Errorf("cleared entry read as %x", v)
+		}
+		return tx.UTXO().Put([]byte("new"), []byte{2})
+	})
+
+	mustView(t, store, func(tx StoreTx) error {
+		if keys := storeKeys(t, tx.UTXO(), nil); fmt.Sprint(keys) != "[new]" {
+			t.Errorf("UTXO keys %q after clearing", keys)
+		}
+		if tx.Blocks().Get([]byte("block")) == nil {
+			t.Error("clearing the UTXO set removed a block")
+		}
+		return nil
+	})
+}
+
+func testStoreReadOnlyView(t *testing.T, store ChainStore) {
+	mustView(t, store, func(tx StoreTx) error {
+		for name, b := range storeBuckets(tx) {
+			if err := b.Put([]byte("k"), []byte("v")); err == nil {
+				t.Errorf("%s: put in a view", name)
+			}
+			if err := b.Delete([]byte("k")); err == nil {
+				t.Errorf("%s: delete in a view", name)
+			}
+		}
+		if err := tx.SetTip([]byte("tip")); err == nil {
+			t.Error("tip set in a view")
+		}
+		if err := tx.ClearUTXO(); err == nil {
+			t.Error("UTXO set cleared in a view")
+		}
+		return nil
+	})
+}
+
+func testStoreRollback(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		if err := tx.SetTip([]byte("kept")); err != nil {
+			return err
+		}
+		return tx.UTXO().Put([]byte("kept"), []byte{1})
+	})
+
+	errAbort := errors.New("abort")
+	err := store.Update(func(tx StoreTx) error {
+		for _, b := range storeBuckets(tx) {
+			if err := b.Put([]byte("lost"), []byte{1}); err != nil {
+				return err
+			}
+		}
+		if err := tx.UTXO().Delete([]byte("kept")); err != nil {
+			return err
+		}
+		if err := tx.SetTip([]byte("lost")); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("update returned %v, want %v", err, errAbort)
+	}
+
+	mustView(t, store, func(tx StoreTx) error {
+		for name, b := range storeBuckets(tx) {
+			if v := b.Get([]byte("lost")); v != nil {
+				t.Errorf("%s: write of a failed update is visible", name)
+			}
+		}
+		if tx.UTXO().Get([]byte("kept")) == nil {
+			t.Error("delete of a failed update is visible")
+		}
+		if tip := tx.Tip(); string(tip) != "kept" {
+			t.Errorf("tip %q after a failed update", tip)
+		}
+		return nil
+	})
+}
+
+func testStoreOwnWrites(t *testing.T, store ChainStore) {
+	mustUpdate(t, store, func(tx StoreTx) error {
+		return tx.Headers().Put([]byte("a"), []byte("old"))
+	})
+
+	mustUpdate(t, store, func(tx StoreTx) error {
+		b := tx.Headers()
+		if err := b.Put([]byte("a"), []byte("new")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("b"), []byte("added")); err != nil {
+			return err
+		}
+		if v := b.Get([]byte("a")); string(v) != "new" {
+			t.Errorf("overwritten value read as %q", v)
+		}
+		if keys := storeKeys(t, b, nil); fmt.Sprint(keys) != "[a b]" {
+			t.Errorf("keys %q inside the update", keys)
+		}
+		if err := b.Delete([]byte("a")); err != nil {
+			return err
+		}
+		if keys := storeKeys(t, b, nil); fmt.Sprint(keys) != "[b]" {
+			t.Errorf("keys %q after a delete inside the update", keys)
+		}
+		return nil
+	})
+}
+
+// testStoreBlockchain runs a Blockchain on the store
+func testStoreBlockchain(t *testing.T, store ChainStore) {
+	bc, err := OpenBlockchain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := storeTestChain(t, bc, 3)
+	UTXOSet{bc}.Reindex()
+
+	reopened, err := OpenBlockchain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.tip, blocks[2].Hash) || reopened.GetBestHeight() != 2 {
+		t.Fatalf("reopened at %x height %d, want %x height 2", reopened.tip, reopened.GetBestHeight(), blocks[2].Hash)
+	}
+
+	block, err := reopened.GetBlock(blocks[1].Hash)
+	if err != nil || !bytes.Equal(block.Hash, blocks[1].Hash) {
+		t.Fatalf("GetBlock returned %x, %v", block.Hash, err)
+	}
+	if _, err := reopened.GetBlock([]byte("missing")); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("GetBlock of a missing block returned %v", err)
+	}
+
+	if n := (UTXOSet{reopened}).CountTransactions(); n != 3 {
+		t.Fatalf("%d transactions in the UTXO set, want 3", n)
+	}
+	if hashes := reopened.GetBlockHashes(); len(hashes) != 3 {
+		t.Fatalf("iterated %d blocks, want 3", len(hashes))
+	}
+}
@@ -2,33 +2,49 @@ package block
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/big"
 )
 
 const subsidy = 10 // rewards
 
+// txVersion is the version of new transactions. Version 0 transactions were
+// hashed over their gob encoding, later versions over the canonical encoding.
+const txVersion = 1
+
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID      []byte
+	Vin     []TXInput
+	Vout    []TXOutput
+	Version int
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].TxID) == 0 && tx.Vin[0].Vout == -1
 }
 
+// Serialize returns the canonical encoding of the transaction
 func (tx *Transaction) Serialize() []byte {
+	return EncodeTransaction(tx)
+}
+
+// legacySerialize reproduces the gob encoding that version 0 transaction IDs
+// and Merkle roots were computed from
+func (tx *Transaction) legacySerialize() []byte {
+	// gob describes types by name, so the legacy layout has to be called Transaction
+	type Transaction struct {
+		ID   []byte
+		Vin  []TXInput
+		Vout []TXOutput
+	}
+
 	var encode bytes.Buffer
 	enc := gob.NewEncoder(&encode)
-	err := enc.Encode(tx)
+	err := enc.Encode(Transaction{tx.ID, tx.Vin, tx.Vout})
 	if err != nil {
 		log.Panic(err)
 	}
@@ -42,25 +58,35 @@ func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	if tx.Version == 0 {
+		hash = sha256.Sum256(txCopy.legacySerialize())
+	} else {
+		hash = sha256.Sum256(txCopy.Serialize())
+	}
 	return hash[:]
 }
 
+// NewCoinbaseTX returns a transaction rewarding to. Without data, the coinbase holds a
+// random nonce so that two rewards to the same address have different IDs.
 func NewCoinbaseTX(to, data string) *Transaction {
 	if data == "" {
-		data = fmt.Sprintf("Reward to %s", to)
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			log.Panic(err)
+		}
+		data = fmt.Sprintf("Reward to %s, nonce %x", to, nonce)
 	}
 
 	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
 	txout := NewTXOutput(subsidy, to)
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, txVersion}
 	tx.ID = tx.Hash()
 
 	return &tx
 }
 
 // NewUTXOTransaction creates a new transaction
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet, hashType SigHashType) *Transaction {
 	var inputs []TXInput
 	var outputs []TXOutput
 
@@ -91,64 +117,116 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, txVersion}
+	tx.ID = tx.Hash()
+	err := UTXOSet.Blockchain.SignTransaction(&tx, wallet, hashType)
+	if err != nil {
+		log.Panic(err)
+	}
+	// the ID commits to the signatures
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wallet.PrivateKey)
 
 	return &tx
 }
 
-func (tx *Transaction) Sign(priKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign signs each input of a Transaction with the wallet owning the referenced outputs,
+// appending hashType to every signature
+func (tx *Transaction) Sign(wallet *Wallet, prevTXs map[string]Transaction, hashType SigHashType) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
-	// we need to access the outputs referenced in the inputs of the transaction
-	txCopy := tx.TrimmedCopy()
+	for inID, vin := range tx.Vin {
+		prevOut, err := prevOutput(vin, prevTXs)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
+		}
+		if !bytes.Equal(HashPubKey(wallet.PublicKey), prevOut.PubKeyHash) {
+			return fmt.Errorf("input %d: %w", inID, ErrPubKeyMismatch)
+		}
+
+		sigHash, err := tx.signatureHash(inID, prevOut, hashType)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
+		}
 
-	for inID, vin := range txCopy.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.TxID)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubKeyHash
-		txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
+		signature, err := wallet.Sign(sigHash)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
+		}
 
-		r, s, _ := ecdsa.Sign(rand.Reader, &priKey, txCopy.ID)
-		signature := append(r.Bytes(), s.Bytes()...)
-		txCopy.Vin[inID].Signature = signature
+		tx.Vin[inID].Signature = append(signature, byte(hashType))
+		tx.Vin[inID].PubKey = wallet.PublicKey
 	}
+
+	return nil
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+// Verify checks the signature of every input against the outputs it spends
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
 
 	for inID, vin := range tx.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.TxID)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubKeyHash
-		txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)]) // first half
-		s.SetBytes(vin.Signature[(sigLen / 2):]) // second half
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.Signature[:(keyLen / 2)]) // first half
-		y.SetBytes(vin.Signature[(keyLen / 2):]) // second half
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
-			return false
+		prevOut, err := prevOutput(vin, prevTXs)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
+		}
+
+		if err := tx.verifyInput(inID, prevOut, nil); err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
 		}
 	}
 
-	return true
+	return nil
+}
+
+// verifyInput checks the signature of input inID against the output it spends.
+// Checks found in cache are skipped and successful ones are added to it; cache may be nil.
+func (tx *Transaction) verifyInput(inID int, prevOut *TXOutput, cache *SigCache) error {
+	vin := tx.Vin[inID]
+
+	// the input must carry the key that the spent output is locked to
+	if !vin.UsesKey(prevOut.PubKeyHash) {
+		return ErrPubKeyMismatch
+	}
+
+	if len(vin.Signature) == 0 {
+		return ErrInvalidSignature
+	}
+	sig, hashType := vin.Signature[:len(vin.Signature)-1], SigHashType(vin.Signature[len(vin.Signature)-1])
+
+	sigHash, err := tx.signatureHash(inID, prevOut, hashType)
+	if err != nil {
+		return err
+	}
+
+	key := newSigCacheKey(tx.ID, inID, sigHash)
+	if cache.Contains(key, vin.Signature, vin.PubKey) {
+		return nil
+	}
+
+	// the public key prefix selects the signature scheme
+	if err := verifySignature(vin.PubKey, sigHash, sig); err != nil {
+		return err
+	}
+	cache.Add(key, vin.Signature, vin.PubKey)
+
+	return nil
+}
+
+// prevOutput returns the output referenced by an input
+func prevOutput(vin TXInput, prevTXs map[string]Transaction) (*TXOutput, error) {
+	prevTX, ok := prevTXs[hex.EncodeToString(vin.TxID)]
+	if !ok || prevTX.ID == nil {
+		return nil, fmt.Errorf("%w: %x", ErrMissingPrevTx, vin.TxID)
+	}
+	if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+		return nil, fmt.Errorf("%w: %x:%d", ErrBadOutputIndex, vin.TxID, vin.Vout)
+	}
+
+	return &prevTX.Vout[vin.Vout], nil
 }
 
 // return parts of a transaction that need to be signed
@@ -166,13 +244,23 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, output)
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.Version}
 
 	return txCopy
 }
 
-// DeserializeTransaction deserializes a transaction
+// DeserializeTransaction deserializes a transaction in the canonical or the legacy gob
+// encoding. It is meant for data read from the database of the node and panics on
+// malformed data, transactions received from peers are decoded with DecodeTransaction.
 func DeserializeTransaction(data []byte) Transaction {
+	if isCanonical(data) {
+		transaction, err := DecodeTransaction(data)
+		if err != nil {
+			log.Panic(err)
+		}
+		return transaction
+	}
+
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
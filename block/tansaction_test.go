@@ -0,0 +1,189 @@
+package block
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// newSignedSpend returns a transaction spending the coinbase output of owner, signed by owner
+func newSignedSpend(t *testing.T, owner, receiver *Wallet) (*Transaction, map[string]Transaction) {
+	prevTX := NewCoinbaseTX(string(owner.GetAddress()), "")
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}
+
+	input := TXInput{prevTX.ID, 0, nil, owner.PublicKey}
+	output := NewTXOutput(subsidy, string(receiver.GetAddress()))
+	tx := &Transaction{nil, []TXInput{input}, []TXOutput{*output}, txVersion}
+	tx.ID = tx.Hash()
+
+	if err := tx.Sign(owner, prevTXs, SigHashAll); err != nil {
+		t.Fatalf("sign: %s", err)
+	}
+
+	return tx, prevTXs
+}
+
+func TestVerifyValidTransaction(t *testing.T) {
+	tx, prevTXs := newSignedSpend(t, NewWallet(), NewWallet())
+
+	if err := tx.Verify(prevTXs); err != nil {
+		t.Fatalf("valid transaction rejected: %s", err)
+	}
+	if len(tx.Vin[0].Signature) != signatureLen+1 {
+		t.Fatalf("signature length %d, want %d", len(tx.Vin[0].Signature), signatureLen+1)
+	}
+}
+
+func TestCoinbaseIDsDiffer(t *testing.T) {
+	address := string(NewWallet().GetAddress())
+	if a, b := NewCoinbaseTX(address, ""), NewCoinbaseTX(address, ""); bytes.Equal(a.ID, b.ID) {
+		t.Fatalf("two rewards to the same address have the ID %x", a.ID)
+	}
+}
+
+func TestSignRejectsForeignOutput(t *testing.T) {
+	owner, thief := NewWallet(), NewWallet()
+	prevTX := NewCoinbaseTX(string(owner.GetAddress()), "")
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}
+
+	tx := &Transaction{nil, []TXInput{{prevTX.ID, 0, nil, thief.PublicKey}}, []TXOutput{*NewTXOutput(subsidy, string(thief.GetAddress()))}, txVersion}
+	if err := tx.Sign(thief, prevTXs, SigHashAll); !errors.Is(err, ErrPubKeyMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrPubKeyMismatch)
+	}
+}
+
+func TestVerifyRejectsForgedInputs(t *testing.T) {
+	owner, receiver, thief := NewWallet(), NewWallet(), NewWallet()
+
+	tests := []struct {
+		name   string
+		forge  func(tx *Transaction, prevTXs map[string]Transaction)
+		expect error
+	}{
+		{
+			name: "tampered output value",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				tx.Vout[0].Value++
+			},
+			expect: ErrSignatureMismatch,
+		},
+		{
+			name: "redirected output",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				tx.Vout[0].PubKeyHash = HashPubKey(thief.PublicKey)
+			},
+			expect: ErrSignatureMismatch,
+		},
+		{
+			name: "thief key and signature",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				sig, _ := thief.Sign(tx.Hash())
+				tx.Vin[0].Signature = append(sig, byte(SigHashAll))
+				tx.Vin[0].PubKey = thief.PublicKey
+			},
+			expect: ErrPubKeyMismatch,
+		},
+		{
+			name: "signature used as public key",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				tx.Vin[0].PubKey = tx.Vin[0].Signature
+			},
+			expect: ErrPubKeyMismatch,
+		},
+		{
+			name: "high S",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				sig := tx.Vin[0].Signature
+				s := new(big.Int).SetBytes(sig[coordinateLen:signatureLen])
+				s.Sub(elliptic.P256().Params().N, s)
+				highS := append(sig[:coordinateLen:coordinateLen], padBytes(s.Bytes(), coordinateLen)...)
+				tx.Vin[0].Signature = append(highS, byte(SigHashAll))
+			},
+			expect: ErrHighS,
+		},
+		{
+			name: "truncated signature",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				sig := tx.Vin[0].Signature
+				tx.Vin[0].Signature = append(sig[:signatureLen-1:signatureLen-1], byte(SigHashAll))
+			},
+			expect: ErrInvalidSignature,
+		},
+		{
+			name: "zero signature",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				tx.Vin[0].Signature = append(make([]byte, signatureLen), byte(SigHashAll))
+			},
+			expect: ErrInvalidSignature,
+		},
+		{
+			name: "missing previous transaction",
+			forge: func(tx *Transaction, prevTXs map[string]Transaction) {
+				delete(prevTXs, hex.EncodeToString(tx.Vin[0].TxID))
+			},
+			expect: ErrMissingPrevTx,
+		},
+		{
+			name: "output index out of range",
+			forge: func(tx *Transaction, _ map[string]Transaction) {
+				tx.Vin[0].Vout = 1
+			},
+			expect: ErrBadOutputIndex,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx, prevTXs := newSignedSpend(t, owner, receiver)
+			test.forge(tx, prevTXs)
+
+			if err := tx.Verify(prevTXs); !errors.Is(err, test.expect) {
+				t.Fatalf("got %v, want %v", err, test.expect)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsPointOffCurve(t *testing.T) {
+	pubKey := make([]byte, pubKeyLen)
+	pubKey[pubKeyLen-1] = 1
+
+	if _, err := decodePubKey(pubKey); !errors.Is(err, ErrInvalidPubKey) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidPubKey)
+	}
+}
+
+func TestVerifyAcrossSchemes(t *testing.T) {
+	for _, scheme := range []SigScheme{SchemeP256, SchemeSecp256k1, SchemeSchnorr} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			owner, err := NewWalletWithScheme(scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, prevTXs := newSignedSpend(t, owner, NewWallet())
+
+			if err := tx.Verify(prevTXs); err != nil {
+				t.Fatalf("valid transaction rejected: %s", err)
+			}
+
+			tx.Vout[0].Value++
+			if err := tx.Verify(prevTXs); !errors.Is(err, ErrSignatureMismatch) {
+				t.Fatalf("got %v, want %v", err, ErrSignatureMismatch)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsSchemeSwap(t *testing.T) {
+	owner, _ := NewWalletWithScheme(SchemeSchnorr)
+	tx, prevTXs := newSignedSpend(t, owner, NewWallet())
+
+	// re-tagging the key changes its hash, so it no longer unlocks the output
+	tx.Vin[0].PubKey = append([]byte{byte(SchemeSecp256k1)}, tx.Vin[0].PubKey[1:]...)
+	if err := tx.Verify(prevTXs); !errors.Is(err, ErrPubKeyMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrPubKeyMismatch)
+	}
+}
@@ -32,26 +32,69 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
-// TXOutputs collects TXOutput
+// TXOutputs collects the unspent outputs of a transaction
 type TXOutputs struct {
 	Outputs []TXOutput
+	Indexes []int // index of each output in its transaction, nil if none has been spent
 }
 
-// Serialize serializes TXOutputs
-func (outs TXOutputs) Serialize() []byte {
-	var buff bytes.Buffer
+// Index returns the transaction output index of the i-th entry
+func (outs TXOutputs) Index(i int) int {
+	if outs.Indexes == nil {
+		return i
+	}
 
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
-	if err != nil {
-		log.Panic(err)
+	return outs.Indexes[i]
+}
+
+// Find returns the output with the given transaction output index, if it is unspent
+func (outs TXOutputs) Find(vout int) (TXOutput, bool) {
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == vout {
+			return out, true
+		}
 	}
 
-	return buff.Bytes()
+	return TXOutput{}, false
 }
 
-// DeserializeOutputs deserializes TXOutputs
+// insert returns outs with out added at the transaction output index vout
+func (outs TXOutputs) insert(vout int, out TXOutput) TXOutputs {
+	var result TXOutputs
+	inserted := false
+
+	for i := range outs.Outputs {
+		if !inserted && outs.Index(i) > vout {
+			result.Outputs = append(result.Outputs, out)
+			result.Indexes = append(result.Indexes, vout)
+			inserted = true
+		}
+		result.Outputs = append(result.Outputs, outs.Outputs[i])
+		result.Indexes = append(result.Indexes, outs.Index(i))
+	}
+	if !inserted {
+		result.Outputs = append(result.Outputs, out)
+		result.Indexes = append(result.Indexes, vout)
+	}
+
+	return result
+}
+
+// Serialize returns the canonical encoding of TXOutputs
+func (outs TXOutputs) Serialize() []byte {
+	return EncodeOutputs(outs)
+}
+
+// DeserializeOutputs deserializes TXOutputs in the canonical or the legacy gob encoding
 func DeserializeOutputs(data []byte) TXOutputs {
+	if isCanonical(data) {
+		outputs, err := DecodeOutputs(data)
+		if err != nil {
+			log.Panic(err)
+		}
+		return outputs
+	}
+
 	var outputs TXOutputs
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
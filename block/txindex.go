@@ -0,0 +1,165 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// txIndex maps the ID of every main chain transaction to its TxLocation
+const txIndex = "txindex"
+
+var (
+	ErrTxNotFound      = errors.New("transaction is not found")
+	ErrTxIndexDisabled = errors.New("transaction index is disabled, build it with reindextx")
+)
+
+// TxLocation is where a transaction is stored: its block and its position in it
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func connectTxIndex(tx StoreTx, block *Block) error {
+	for i, transaction := range block.Transactions {
+		if err := tx.Index(txIndex).Put(transaction.ID, encodeTxLocation(TxLocation{block.Hash, i})); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func disconnectTxIndex(tx StoreTx, block *Block) error {
+	for _, transaction := range block.Transactions {
+		// the same transaction can be in another block of the main chain
+		data := tx.Index(txIndex).Get(transaction.ID)
+		if data == nil {
+			continue
+		}
+		if loc, err := decodeTxLocation(data); err != nil || !bytes.Equal(loc.BlockHash, block.Hash) {
+			continue
+		}
+
+		if err := tx.Index(txIndex).Delete(transaction.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TxIndexEnabled reports whether the transaction index is kept
+func (bc *Blockchain) TxIndexEnabled() bool {
+	enabled := false
+	_ = bc.store.View(func(tx StoreTx) error {
+		enabled = indexEnabled(tx, txIndex)
+		return nil
+	})
+
+	return enabled
+}
+
+// ReindexTransactions builds the transaction index from the main chain and keeps
+// it up to date from then on. It returns the number of blocks indexed.
+func (bc *Blockchain) ReindexTransactions() (int, error) {
+	var count int
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		var err error
+		count, err = rebuildIndex(tx, txIndex)
+		return err
+	})
+
+	return count, err
+}
+
+// GetTransaction looks a main chain transaction up in the transaction index and
+// returns it with its location
+func (bc *Blockchain) GetTransaction(ID []byte) (Transaction, TxLocation, error) {
+	var transaction Transaction
+	var loc TxLocation
+
+	err := bc.store.View(func(tx StoreTx) error {
+		if !indexEnabled(tx, txIndex) {
+			return ErrTxIndexDisabled
+		}
+
+		block, pos, err := findIndexedTransaction(tx, ID)
+		if err != nil {
+			return err
+		}
+		transaction = *block.Transactions[pos]
+		loc = TxLocation{block.Hash, pos}
+
+		return nil
+	})
+
+	return transaction, loc, err
+}
+
+// findIndexedTransaction returns a transaction's block and position from the transaction index
+func findIndexedTransaction(tx StoreTx, ID []byte) (*Block, int, error) {
+	data := tx.Index(txIndex).Get(ID)
+	if data == nil {
+		return nil, 0, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+
+	loc, err := decodeTxLocation(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	block, err := getBlock(tx, loc.BlockHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if loc.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[loc.Position].ID, ID) {
+		return nil, 0, fmt.Errorf("transaction index entry of %x does not match block %x", ID, loc.BlockHash)
+	}
+
+	return block, loc.Position, nil
+}
+
+// findTransactionBlock returns the main chain block holding a transaction and its
+// position, from the transaction index when it is kept and by scanning the chain
+// from the tip otherwise
+func (bc *Blockchain) findTransactionBlock(ID []byte) (*Block, int, error) {
+	var block *Block
+	var pos int
+	indexed := false
+
+	err := bc.store.View(func(tx StoreTx) error {
+		if !indexEnabled(tx, txIndex) {
+			return nil
+		}
+
+		indexed = true
+		var err error
+		block, pos, err = findIndexedTransaction(tx, ID)
+		return err
+	})
+	if indexed || err != nil {
+		return block, pos, err
+	}
+
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		if block == nil {
+			// the rest of the chain is pruned
+			break
+		}
+		for i, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, i, nil
+			}
+		}
+
+		// genesis block
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return nil, 0, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+}
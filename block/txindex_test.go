@@ -0,0 +1,78 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTxIndex(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+	coinbase := blocks[1].Transactions[0]
+
+	if _, _, err := bc.GetTransaction(coinbase.ID); !errors.Is(err, ErrTxIndexDisabled) {
+		t.Fatalf("GetTransaction without the index returned %v", err)
+	}
+	// without the index the chain is scanned
+	if tx, err := bc.FindTransaction(coinbase.ID); err != nil || !bytes.Equal(tx.ID, coinbase.ID) {
+		t.Fatalf("FindTransaction returned %x, %v", tx.ID, err)
+	}
+
+	count, err := bc.ReindexTransactions()
+	if err != nil || count != 3 {
+		t.Fatalf("indexed %d blocks, %v", count, err)
+	}
+	if !bc.TxIndexEnabled() {
+		t.Fatal("index is not enabled after reindexing")
+	}
+
+	tx, loc, err := bc.GetTransaction(coinbase.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.ID, coinbase.ID) || !bytes.Equal(loc.BlockHash, blocks[1].Hash) || loc.Position != 0 {
+		t.Fatalf("found %x in block %x at %d", tx.ID, loc.BlockHash, loc.Position)
+	}
+
+	// blocks joining the main chain are indexed as they are added
+	next := testBlock(blocks[2].Hash, 3, "next")
+	if err := bc.AddBlock(next); err != nil {
+		t.Fatal(err)
+	}
+	if _, loc, err := bc.GetTransaction(next.Transactions[0].ID); err != nil || !bytes.Equal(loc.BlockHash, next.Hash) {
+		t.Fatalf("transaction of a new block: %x, %v", loc.BlockHash, err)
+	}
+
+	if _, err := bc.FindTransaction([]byte("missing")); !errors.Is(err, ErrTxNotFound) {
+		t.Fatalf("FindTransaction of a missing transaction returned %v", err)
+	}
+}
+
+func TestTxIndexFollowsReorg(t *testing.T) {
+	bc := newTestChain(t)
+	blocks := storeTestChain(t, bc, 3)
+	if _, err := bc.ReindexTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	fork := []*Block{blocks[0]}
+	for height := 1; height <= 3; height++ {
+		block := testBlock(fork[height-1].Hash, height, "fork")
+		if err := bc.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		fork = append(fork, block)
+	}
+
+	for _, block := range blocks[1:] {
+		if _, _, err := bc.GetTransaction(block.Transactions[0].ID); !errors.Is(err, ErrTxNotFound) {
+			t.Fatalf("transaction of a block off the main chain: %v", err)
+		}
+	}
+	for _, block := range fork {
+		if _, loc, err := bc.GetTransaction(block.Transactions[0].ID); err != nil || !bytes.Equal(loc.BlockHash, block.Hash) {
+			t.Fatalf("transaction of block %x found in %x, %v", block.Hash, loc.BlockHash, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var ErrLegacyBlock = errors.New("transactions of version 0 blocks cannot be proven by ID")
+
+// TxProof shows that a transaction is included in the block with the given header.
+// It can be checked without access to the chain: the header carries its own proof
+// of work, and whether the block is on the main chain is left to the verifier.
+type TxProof struct {
+	Header BlockHeader
+	Proof  MerkleProof
+}
+
+// Serialize returns the canonical encoding of the proof
+func (p *TxProof) Serialize() []byte {
+	return EncodeTxProof(p)
+}
+
+// Verify checks the proof of work of the header and that txID is in its Merkle tree.
+// The leaves of version 0 blocks are not transaction IDs, use VerifyTransaction for them.
+func (p *TxProof) Verify(txID []byte) error {
+	if !NewProofOfWork(&p.Header).Validate() {
+		return fmt.Errorf("%w: %x", ErrInvalidPoW, p.Header.Hash())
+	}
+	if p.Header.Version == 0 {
+		return ErrLegacyBlock
+	}
+
+	return VerifyMerkleProof(p.Header.MerkleRoot, txID, p.Proof)
+}
+
+// VerifyTransaction checks the proof of work of the header and that tx is in its Merkle tree
+func (p *TxProof) VerifyTransaction(tx *Transaction) error {
+	if !NewProofOfWork(&p.Header).Validate() {
+		return fmt.Errorf("%w: %x", ErrInvalidPoW, p.Header.Hash())
+	}
+
+	leaf := sha256.Sum256(merkleLeafData(tx, p.Header.Version))
+	return VerifyMerkleProof(p.Header.MerkleRoot, leaf[:], p.Proof)
+}
+
+// TxProof returns the proof that the transaction with the given ID is in the block
+func (b *Block) TxProof(txID []byte) (TxProof, error) {
+	for _, tx := range b.Transactions {
+		if !bytes.Equal(tx.ID, txID) {
+			continue
+		}
+
+		leaf := sha256.Sum256(merkleLeafData(tx, b.Version))
+		proof, err := b.merkleTree().Proof(leaf[:])
+		if err != nil {
+			return TxProof{}, err
+		}
+
+		return TxProof{b.BlockHeader, proof}, nil
+	}
+
+	return TxProof{}, fmt.Errorf("%w: %x", ErrTxNotInTree, txID)
+}
+
+// GetTxProof finds the main chain block containing a transaction and returns the proof of its inclusion
+func (bc *Blockchain) GetTxProof(txID []byte) (TxProof, error) {
+	block, _, err := bc.findTransactionBlock(txID)
+	if errors.Is(err, ErrTxNotFound) {
+		return TxProof{}, fmt.Errorf("%w: %x", ErrTxNotInTree, txID)
+	}
+	if err != nil {
+		return TxProof{}, err
+	}
+
+	return block.TxProof(txID)
+}
+
+// involvesAny reports whether tx pays to or spends from any of the public key hashes
+func (tx *Transaction) involvesAny(pubKeyHashes [][]byte) bool {
+	for _, pubKeyHash := range pubKeyHashes {
+		for i := range tx.Vout {
+			if tx.Vout[i].IsLockedWithKey(pubKeyHash) {
+				return true
+			}
+		}
+
+		if !tx.IsCoinbase() {
+			for i := range tx.Vin {
+				if tx.Vin[i].UsesKey(pubKeyHash) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -3,75 +3,65 @@ package block
 import (
 	"encoding/hex"
 	"errors"
-	"github.com/boltdb/bolt"
+	"fmt"
 	"log"
 )
 
 const utxoBucket = "utxoBucket"
 
+// undoIndex holds the outputs spent by each block, by block hash, so that the block
+// can be disconnected from the UTXO set
+const undoIndex = "undo"
+
+var ErrNoUndoData = errors.New("no undo data for block")
+
+// spentOutput is an output spent by a block, as recorded in its undo data
+type spentOutput struct {
+	TxID   []byte
+	Vout   int
+	Output TXOutput
+}
+
 // cache of blocks
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
+// Reindex rebuilds the UTXO set and its undo data from the main chain in one transaction
 func (u UTXOSet) Reindex() {
-	db := u.Blockchain.db
-	bucketName := []byte(utxoBucket)
+	if height := u.Blockchain.PrunedHeight(); height > 0 {
+		log.Panicf("ERROR: The UTXO set cannot be rebuilt, blocks below height %d are pruned", height)
+	}
+	if height, pending := u.Blockchain.SnapshotPending(); pending {
+		log.Panicf("ERROR: The UTXO set cannot be rebuilt before the blocks below the snapshot at height %d are validated", height)
+	}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		err1 := tx.DeleteBucket(bucketName)
-		if err1 != nil && !errors.Is(err1, bolt.ErrBucketNotFound) {
-			log.Fatal(err1)
-		}
-		_, err1 = tx.CreateBucket(bucketName)
-		if err1 != nil {
-			log.Fatal(err1)
-		}
-		return nil
+	err := u.Blockchain.store.Update(func(tx StoreTx) error {
+		return rebuildUTXO(tx)
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	UTXO := u.Blockchain.FindUTXO()
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-
-		for id, outs := range UTXO {
-			key, _ := hex.DecodeString(id)
-			err2 := b.Put(key, outs.Serialize())
-			if err2 != nil {
-				log.Fatal(err2)
-			}
-		}
-
-		return nil
-	})
 }
 
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	upspendableOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
 
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
 		// iterate the utxo bucket
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+		return tx.UTXO().ForEach(func(k, v []byte) error {
 			txID := hex.EncodeToString(k)
 			outputs := DeserializeOutputs(v)
 
 			for idx, out := range outputs.Outputs {
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					upspendableOutputs[txID] = append(upspendableOutputs[txID], idx)
+					upspendableOutputs[txID] = append(upspendableOutputs[txID], outputs.Index(idx))
 				}
 			}
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -82,13 +72,9 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	UTXOs := make([]TXOutput, 0)
-	db := u.Blockchain.db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		return tx.UTXO().ForEach(func(k, v []byte) error {
 			outputs := DeserializeOutputs(v)
 
 			for _, output := range outputs.Outputs {
@@ -96,9 +82,9 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 					UTXOs = append(UTXOs, output)
 				}
 			}
-		}
 
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -108,77 +94,152 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.db
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+// connectUTXO spends the outputs used by block and adds the outputs it creates,
+// recording the spent outputs as the block's undo data
+func connectUTXO(tx StoreTx, block *Block) error {
+	spent, err := spendOutputs(tx.UTXO(), block)
+	if err != nil {
+		return err
+	}
 
-		for _, transaction := range block.Transactions {
-			if !transaction.IsCoinbase() {
-				for _, input := range transaction.Vin {
-					data := b.Get(input.TxID)
-					outputs := DeserializeOutputs(data)
-					updateOutputs := TXOutputs{}
+	return tx.Index(undoIndex).Put(block.Hash, encodeUndo(spent))
+}
 
-					// find unspent outputs
-					for outIdx, output := range outputs.Outputs {
-						if input.Vout != outIdx {
-							updateOutputs.Outputs = append(updateOutputs.Outputs, output)
-						}
+// spendOutputs applies block to the UTXO set in b and returns the outputs it spent
+func spendOutputs(b StoreBucket, block *Block) ([]spentOutput, error) {
+	var spent []spentOutput
+
+	for _, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			for _, input := range transaction.Vin {
+				data := b.Get(input.TxID)
+				outputs := DeserializeOutputs(data)
+				updateOutputs := TXOutputs{}
+
+				// find unspent outputs, keeping their original indexes
+				for idx, output := range outputs.Outputs {
+					if outIdx := outputs.Index(idx); input.Vout != outIdx {
+						updateOutputs.Outputs = append(updateOutputs.Outputs, output)
+						updateOutputs.Indexes = append(updateOutputs.Indexes, outIdx)
+					} else {
+						spent = append(spent, spentOutput{input.TxID, outIdx, output})
 					}
+				}
 
-					if len(updateOutputs.Outputs) == 0 {
-						err1 := b.Delete(input.TxID)
-						if err1 != nil {
-							log.Fatal(err1)
-						}
-					} else {
-						// update UTXO set
-						err2 := b.Put(input.TxID, updateOutputs.Serialize())
-						if err2 != nil {
-							log.Fatal(err2)
-						}
+				if len(updateOutputs.Outputs) == 0 {
+					if err := b.Delete(input.TxID); err != nil {
+						return nil, err
+					}
+				} else {
+					// update UTXO set
+					if err := b.Put(input.TxID, updateOutputs.Serialize()); err != nil {
+						return nil, err
 					}
 				}
 			}
+		}
 
-			newOutputs := TXOutputs{}
-			for _, output := range transaction.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, output)
-			}
-			err3 := b.Put(transaction.ID, newOutputs.Serialize())
-			if err3 != nil {
-				log.Fatal(err3)
-			}
+		newOutputs := TXOutputs{}
+		for _, output := range transaction.Vout {
+			newOutputs.Outputs = append(newOutputs.Outputs, output)
+		}
+		if err := b.Put(transaction.ID, newOutputs.Serialize()); err != nil {
+			return nil, err
 		}
+	}
 
-		return nil
+	return spent, nil
+}
+
+// CountTransactions returns the number of transactions in the UTXO set
+func (u UTXOSet) CountTransactions() int {
+	counter := 0
+
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		return tx.UTXO().ForEach(func(k, v []byte) error {
+			counter++
+			return nil
+		})
 	})
+	if err != nil {
+		log.Panic(err)
+	}
 
+	return counter
+}
+
+// disconnectUTXO reverses connectUTXO for the last connected block: its outputs are
+// removed and the outputs it spent are restored from its undo data
+func disconnectUTXO(tx StoreTx, block *Block) error {
+	data := tx.Index(undoIndex).Get(block.Hash)
+	if data == nil {
+		return fmt.Errorf("%w %x", ErrNoUndoData, block.Hash)
+	}
+	spent, err := decodeUndo(data)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	if err := restoreOutputs(tx.UTXO(), block, spent); err != nil {
+		return err
 	}
+
+	return tx.Index(undoIndex).Delete(block.Hash)
 }
 
-// CountTransactions returns the number of transactions in the UTXO set
-func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.db
-	counter := 0
+// restoreOutputs reverses spendOutputs: the outputs of block are removed from the
+// UTXO set in b and the outputs it spent are put back
+func restoreOutputs(b StoreBucket, block *Block, spent []spentOutput) error {
+	created := make(map[string]bool)
+	for _, transaction := range block.Transactions {
+		created[string(transaction.ID)] = true
+		if err := b.Delete(transaction.ID); err != nil {
+			return err
+		}
+	}
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+	// outputs both created and spent by the block are gone with it
+	for i := len(spent) - 1; i >= 0; i-- {
+		if created[string(spent[i].TxID)] {
+			continue
+		}
 
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
+		var outputs TXOutputs
+		if data := b.Get(spent[i].TxID); data != nil {
+			outputs = DeserializeOutputs(data)
 		}
+		if err := b.Put(spent[i].TxID, outputs.insert(spent[i].Vout, spent[i].Output).Serialize()); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// transaction returns a transaction holding only the unspent outputs of txID, at
+// their original indexes, which is enough to sign inputs spending them
+func (u UTXOSet) transaction(txID []byte) (Transaction, error) {
+	var outputs TXOutputs
+
+	err := u.Blockchain.store.View(func(tx StoreTx) error {
+		data := tx.UTXO().Get(txID)
+		if data == nil {
+			return fmt.Errorf("%w: %x", ErrMissingPrevTx, txID)
+		}
+		outputs = DeserializeOutputs(data)
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, err
 	}
 
-	return counter
+	prevTX := Transaction{ID: txID}
+	for i, out := range outputs.Outputs {
+		for len(prevTX.Vout) <= outputs.Index(i) {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
+		}
+		prevTX.Vout[outputs.Index(i)] = out
+	}
+
+	return prevTX, nil
 }
@@ -0,0 +1,230 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+var (
+	ErrUnknownOutput = errors.New("referenced output is spent or does not exist")
+	ErrDoubleSpend   = errors.New("output is spent more than once")
+	ErrDuplicateTx   = errors.New("transaction appears more than once")
+	ErrBadMerkleRoot = errors.New("Merkle root does not match the transactions")
+)
+
+// inputCheck is a single signature check: one input and the output it spends
+type inputCheck struct {
+	tx      *Transaction
+	inID    int
+	prevOut TXOutput
+}
+
+// CheckBlock checks what a block commits to without the chain: its proof of work and
+// its Merkle root. Its link to its parent is checked when it is added, its inputs when
+// it joins the main chain.
+func CheckBlock(block *Block) error {
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) || !NewProofOfWork(&block.BlockHeader).Validate() {
+		return fmt.Errorf("%w: %x", ErrInvalidPoW, block.Hash)
+	}
+	if len(block.Transactions) == 0 || !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return fmt.Errorf("%w: block %x", ErrBadMerkleRoot, block.Hash)
+	}
+
+	return nil
+}
+
+// verifyConnecting checks the inputs and signatures of a block against the UTXO set of
+// tx, which is at the parent of the block
+func (bc *Blockchain) verifyConnecting(tx StoreTx, block *Block) error {
+	checks, err := inputChecks(tx.UTXO(), block.Transactions)
+	if err == nil {
+		err = runInputChecks(checks, runtime.NumCPU(), bc.sigCache)
+	}
+	if err != nil {
+		return fmt.Errorf("block %x: %w", block.Hash, err)
+	}
+
+	return nil
+}
+
+// VerifyBlock checks every input signature of a block extending the current tip.
+// The spent outputs are resolved from the UTXO set in a single pass and the
+// signature checks are spread over a pool of workers, stopping at the first failure.
+func (bc *Blockchain) VerifyBlock(block *Block) error {
+	return bc.verifyTransactions(block.Transactions)
+}
+
+// verifyTransactions checks the inputs of a list of transactions as if they formed the next block
+func (bc *Blockchain) verifyTransactions(txs []*Transaction) error {
+	checks, err := bc.collectInputChecks(txs)
+	if err != nil {
+		return err
+	}
+
+	return runInputChecks(checks, runtime.NumCPU(), bc.sigCache)
+}
+
+// selectTransactions picks the transactions of a new block among candidates. They are
+// checked one at a time after those already picked, so that a transaction spending an
+// output spent by an earlier one, or failing its checks, is rejected alone. Candidates
+// are checked again while others are picked, as they may spend their outputs.
+func (bc *Blockchain) selectTransactions(candidates []*Transaction) (selected, rejected []*Transaction, err error) {
+	err = bc.store.View(func(dbTx StoreTx) error {
+		utxo := dbTx.UTXO()
+		errs := make(map[*Transaction]error)
+
+		for picked := true; picked; {
+			picked = false
+			rejected = nil
+			for _, tx := range candidates {
+				next := append(selected[:len(selected):len(selected)], tx)
+				checks, err := inputChecks(utxo, next)
+				if err == nil {
+					// the checks of the transactions already picked passed
+					var own []inputCheck
+					for _, check := range checks {
+						if check.tx == tx {
+							own = append(own, check)
+						}
+					}
+					err = runInputChecks(own, runtime.NumCPU(), bc.sigCache)
+				}
+				if err != nil {
+					errs[tx] = err
+					rejected = append(rejected, tx)
+					continue
+				}
+				selected = next
+				picked = true
+			}
+			candidates = rejected
+		}
+
+		for _, tx := range rejected {
+			fmt.Printf("Transaction %x is invalid: %s\n", tx.ID, errs[tx])
+		}
+
+		return nil
+	})
+
+	return selected, rejected, err
+}
+
+// collectInputChecks resolves the output spent by every input, either from the UTXO set
+// or from an earlier transaction of the same list
+func (bc *Blockchain) collectInputChecks(txs []*Transaction) ([]inputCheck, error) {
+	var checks []inputCheck
+
+	err := bc.store.View(func(dbTx StoreTx) error {
+		var err error
+		checks, err = inputChecks(dbTx.UTXO(), txs)
+		return err
+	})
+
+	return checks, err
+}
+
+// inputChecks resolves the output spent by every input from the given UTXO bucket
+// or from an earlier transaction of the same list
+func inputChecks(utxo StoreBucket, txs []*Transaction) ([]inputCheck, error) {
+	var checks []inputCheck
+	created := make(map[string]*Transaction)
+	spent := make(map[string]bool)
+
+	for _, tx := range txs {
+		// a repeated transaction can leave the Merkle root unchanged, see VerifyMerkleProof
+		if created[hex.EncodeToString(tx.ID)] != nil {
+			return nil, fmt.Errorf("transaction %x: %w", tx.ID, ErrDuplicateTx)
+		}
+		// the outputs of the earlier transaction would be overwritten, and removed when
+		// either block is disconnected
+		if utxo.Get(tx.ID) != nil {
+			return nil, fmt.Errorf("transaction %x: %w with unspent outputs", tx.ID, ErrDuplicateTx)
+		}
+
+		if !tx.IsCoinbase() {
+			for inID, vin := range tx.Vin {
+				outpoint := fmt.Sprintf("%x:%d", vin.TxID, vin.Vout)
+				if spent[outpoint] {
+					return nil, fmt.Errorf("transaction %x input %d: %w: %s", tx.ID, inID, ErrDoubleSpend, outpoint)
+				}
+				spent[outpoint] = true
+
+				prevOut, err := lookupOutput(utxo, created, vin)
+				if err != nil {
+					return nil, fmt.Errorf("transaction %x input %d: %w", tx.ID, inID, err)
+				}
+				checks = append(checks, inputCheck{tx, inID, prevOut})
+			}
+		}
+
+		created[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	return checks, nil
+}
+
+// lookupOutput finds the output spent by vin among the earlier transactions of a block, then in the UTXO set
+func lookupOutput(utxo StoreBucket, created map[string]*Transaction, vin TXInput) (TXOutput, error) {
+	if tx, ok := created[hex.EncodeToString(vin.TxID)]; ok {
+		if vin.Vout < 0 || vin.Vout >= len(tx.Vout) {
+			return TXOutput{}, fmt.Errorf("%w: %x:%d", ErrBadOutputIndex, vin.TxID, vin.Vout)
+		}
+		return tx.Vout[vin.Vout], nil
+	}
+
+	if data := utxo.Get(vin.TxID); data != nil {
+		if out, ok := DeserializeOutputs(data).Find(vin.Vout); ok {
+			return out, nil
+		}
+	}
+
+	return TXOutput{}, fmt.Errorf("%w: %x:%d", ErrUnknownOutput, vin.TxID, vin.Vout)
+}
+
+// runInputChecks verifies checks on the given number of workers and returns the first failure.
+// Checks already present in cache are not repeated.
+func runInputChecks(checks []inputCheck, workers int, cache *SigCache) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *inputCheck)
+	done := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for check := range jobs {
+				if err := check.tx.verifyInput(check.inID, &check.prevOut, cache); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("transaction %x input %d: %w", check.tx.ID, check.inID, err)
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+
+Feed:
+	for i := range checks {
+		select {
+		case jobs <- &checks[i]:
+		case <-done:
+			break Feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,256 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// newTestChain returns an empty Blockchain kept in memory
+func newTestChain(tb testing.TB) *Blockchain {
+	bc, err := OpenBlockchain(NewMemoryStore())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return bc
+}
+
+// syntheticBlock funds owner with one UTXO per input in bc and returns a block of txCount
+// transactions, each spending inputsPerTx of those outputs
+func syntheticBlock(tb testing.TB, bc *Blockchain, owner *Wallet, txCount, inputsPerTx int) *Block {
+	address := string(owner.GetAddress())
+	var txs []*Transaction
+
+	err := bc.store.Update(func(dbTx StoreTx) error {
+		b := dbTx.UTXO()
+
+		for i := 0; i < txCount; i++ {
+			prevTXs := make(map[string]Transaction)
+			var inputs []TXInput
+
+			for j := 0; j < inputsPerTx; j++ {
+				prevTX := NewCoinbaseTX(address, fmt.Sprintf("funding %d/%d", i, j))
+				prevTXs[fmt.Sprintf("%x", prevTX.ID)] = *prevTX
+				inputs = append(inputs, TXInput{prevTX.ID, 0, nil, owner.PublicKey})
+
+				if err := b.Put(prevTX.ID, TXOutputs{Outputs: prevTX.Vout}.Serialize()); err != nil {
+					return err
+				}
+			}
+
+			tx := &Transaction{nil, inputs, []TXOutput{*NewTXOutput(subsidy*inputsPerTx, address)}, txVersion}
+			if err := tx.Sign(owner, prevTXs, SigHashAll); err != nil {
+				return err
+			}
+			tx.ID = tx.Hash()
+			txs = append(txs, tx)
+		}
+
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return &Block{Transactions: append([]*Transaction{NewCoinbaseTX(address, "")}, txs...)}
+}
+
+func TestVerifyBlock(t *testing.T) {
+	bc := newTestChain(t)
+	owner := NewWallet()
+	block := syntheticBlock(t, bc, owner, 8, 2)
+
+	if err := bc.VerifyBlock(block); err != nil {
+		t.Fatalf("valid block rejected: %s", err)
+	}
+
+	// spending an output created earlier in the same block
+	last := block.Transactions[len(block.Transactions)-1]
+	child := &Transaction{nil, []TXInput{{last.ID, 0, nil, owner.PublicKey}}, []TXOutput{*NewTXOutput(1, string(owner.GetAddress()))}, txVersion}
+	if err := child.Sign(owner, map[string]Transaction{fmt.Sprintf("%x", last.ID): *last}, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	child.ID = child.Hash()
+	block.Transactions = append(block.Transactions, child)
+	if err := bc.VerifyBlock(block); err != nil {
+		t.Fatalf("in-block spend rejected: %s", err)
+	}
+}
+
+func TestVerifyBlockRejects(t *testing.T) {
+	bc := newTestChain(t)
+	owner := NewWallet()
+
+	tests := []struct {
+		name   string
+		forge  func(block *Block)
+		expect error
+	}{
+		{"forged signature", func(block *Block) { block.Transactions[3].Vout[0].Value++ }, ErrSignatureMismatch},
+		{"double spend", func(block *Block) {
+			conflict := *block.Transactions[1]
+			conflict.Vout = []TXOutput{*NewTXOutput(1, string(owner.GetAddress()))}
+			conflict.ID = conflict.Hash()
+			block.Transactions = append(block.Transactions, &conflict)
+		}, ErrDoubleSpend},
+		{"unknown output", func(block *Block) { block.Transactions[2].Vin[1].Vout = 7 }, ErrUnknownOutput},
+		{"repeated coinbase", func(block *Block) {
+			block.Transactions[0] = NewCoinbaseTX(string(owner.GetAddress()), "funding 0/0")
+		}, ErrDuplicateTx},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := syntheticBlock(t, bc, owner, 4, 2)
+			test.forge(block)
+
+			if err := bc.VerifyBlock(block); !errors.Is(err, test.expect) {
+				t.Fatalf("got %v, want %v", err, test.expect)
+			}
+		})
+	}
+}
+
+func TestCheckBlock(t *testing.T) {
+	bc := importTestChain(t, 2)
+	mined, err := bc.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckBlock(&mined); err != nil {
+		t.Fatalf("a mined block was rejected: %v", err)
+	}
+
+	unmined := testBlock(mined.Hash, 2, "unmined")
+	if err := CheckBlock(unmined); !errors.Is(err, ErrInvalidPoW) {
+		t.Errorf("a block without proof of work returned %v", err)
+	}
+
+	// transactions swapped for others under the same header
+	swapped := mined
+	swapped.Transactions = []*Transaction{NewCoinbaseTX(string(NewWallet().GetAddress()), "swapped")}
+	if err := CheckBlock(&swapped); !errors.Is(err, ErrBadMerkleRoot) {
+		t.Errorf("a block whose transactions differ from its Merkle root returned %v", err)
+	}
+}
+
+func TestReorganizeRejectsInvalidBranch(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	bc := newTestChain(t)
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	genesis := addTestBlock(t, bc, nil, cbAlice)
+	tip := addTestBlock(t, bc, genesis, NewCoinbaseTX(string(bob.GetAddress()), "main"))
+	before := utxoValues(t, bc)
+
+	// a longer branch holding a payment of alice whose recipient was changed after signing
+	theft := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(alice.GetAddress()))}, txVersion}
+	signTestTx(t, theft, alice, cbAlice)
+	theft.Vout[0] = *NewTXOutput(subsidy, string(bob.GetAddress()))
+	theft.ID = theft.Hash()
+	fork := testBlock(genesis.Hash, 1, "fork")
+	if err := bc.AddBlock(fork); err != nil {
+		t.Fatal(err)
+	}
+	invalid := testBlock(fork.Hash, 2, "invalid")
+	invalid.Transactions = append(invalid.Transactions, theft)
+	invalid.MerkleRoot = invalid.HashTransactions()
+	invalid.Hash = invalid.BlockHeader.Hash()
+
+	if err := bc.AddBlock(invalid); !errors.Is(err, ErrSignatureMismatch) {
+		t.Fatalf("switching to an invalid branch returned %v", err)
+	}
+	if !bytes.Equal(bc.tip, tip.Hash) {
+		t.Fatalf("tip %x, want the previous tip %x", bc.tip, tip.Hash)
+	}
+	if after := utxoValues(t, bc); !reflect.DeepEqual(after, before) {
+		t.Fatalf("UTXO set %v, want %v", after, before)
+	}
+}
+
+func TestSelectTransactions(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	bc := newTestChain(t)
+
+	cbAlice := NewCoinbaseTX(string(alice.GetAddress()), "alice")
+	addTestBlock(t, bc, nil, cbAlice)
+
+	pay := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(bob.GetAddress()))}, txVersion}
+	signTestTx(t, pay, alice, cbAlice)
+	conflict := &Transaction{nil, []TXInput{{cbAlice.ID, 0, nil, alice.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(alice.GetAddress()))}, txVersion}
+	signTestTx(t, conflict, alice, cbAlice)
+	child := &Transaction{nil, []TXInput{{pay.ID, 0, nil, bob.PublicKey}},
+		[]TXOutput{*NewTXOutput(subsidy, string(alice.GetAddress()))}, txVersion}
+	signTestTx(t, child, bob, pay)
+
+	if _, err := bc.MineBlock([]*Transaction{pay, conflict}); !errors.Is(err, ErrDoubleSpend) {
+		t.Fatalf("mining a double spend returned %v", err)
+	}
+
+	selected, rejected, err := bc.selectTransactions([]*Transaction{child, pay, conflict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selected, []*Transaction{pay, child}) || !reflect.DeepEqual(rejected, []*Transaction{conflict}) {
+		t.Errorf("selected %d and rejected %d transactions", len(selected), len(rejected))
+	}
+}
+
+func benchmarkInputChecks(b *testing.B, workers int) {
+	bc := newTestChain(b)
+	block := syntheticBlock(b, bc, NewWallet(), 500, 2)
+	checks, err := bc.collectInputChecks(block.Transactions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := runInputChecks(checks, workers, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(checks)*b.N)/b.Elapsed().Seconds(), "inputs/s")
+}
+
+func BenchmarkInputChecksSequential(b *testing.B) {
+	benchmarkInputChecks(b, 1)
+}
+
+func BenchmarkInputChecksParallel(b *testing.B) {
+	benchmarkInputChecks(b, runtime.NumCPU())
+}
+
+func benchmarkVerifyBlock(b *testing.B, cache *SigCache) {
+	bc := newTestChain(b)
+	bc.sigCache = cache
+	block := syntheticBlock(b, bc, NewWallet(), 500, 2)
+	if err := bc.VerifyBlock(block); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := bc.VerifyBlock(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(block.Transactions)*b.N)/b.Elapsed().Seconds(), "txs/s")
+}
+
+// BenchmarkVerifyBlock includes resolving the spent outputs from the UTXO set
+func BenchmarkVerifyBlock(b *testing.B) {
+	benchmarkVerifyBlock(b, nil)
+}
+
+// BenchmarkVerifyBlockCached verifies a block whose transactions were all seen before
+func BenchmarkVerifyBlockCached(b *testing.B) {
+	benchmarkVerifyBlock(b, NewSigCache(defaultSigCacheSize))
+}
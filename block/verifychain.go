@@ -0,0 +1,389 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Verification levels of VerifyChain, each including the checks of the levels below
+const (
+	VerifyStored     = 0 // headers, height index and block bodies are present and readable
+	VerifyBlocks     = 1 // proof of work, Merkle roots and the linkage of the main chain
+	VerifyUTXO       = 2 // the UTXO set matches the set re-derived from the main chain
+	VerifySignatures = 3 // input signatures of the checked blocks
+)
+
+var ErrUTXONotVerifiable = errors.New("the UTXO set cannot be re-derived")
+
+// ChainIssue is an inconsistency found by VerifyChain
+type ChainIssue struct {
+	Height  int    // height of the block concerned, -1 when unknown
+	Hash    []byte // hash of the block concerned, if any
+	Problem string
+}
+
+func (i ChainIssue) String() string {
+	if i.Hash == nil {
+		return fmt.Sprintf("height %d: %s", i.Height, i.Problem)
+	}
+	return fmt.Sprintf("height %d, block %x: %s", i.Height, i.Hash, i.Problem)
+}
+
+// decodeStoredBlock decodes a stored block without panicking on corrupt data
+func decodeStoredBlock(data []byte) (*Block, error) {
+	if isCanonical(data) {
+		return DecodeBlock(data)
+	}
+
+	return DeserializeBlock(data), nil
+}
+
+// VerifyChain checks the main chain down to the given depth, or entirely when depth
+// is 0, and returns every inconsistency found. At VerifyUTXO and above the whole
+// main chain is replayed to re-derive the UTXO set, whatever the depth, which is not
+// possible on a pruned node or one loaded from a snapshot still being validated.
+func (bc *Blockchain) VerifyChain(level, depth int) ([]ChainIssue, error) {
+	var issues []ChainIssue
+	var tipHeight int
+
+	err := bc.store.View(func(tx StoreTx) error {
+		tip := tx.Tip()
+		if tip == nil {
+			return nil
+		}
+		_, height, err := getHeader(tx, tip)
+		if err != nil {
+			return fmt.Errorf("tip %x: %w", tip, err)
+		}
+		tipHeight = height
+
+		from := 0
+		if depth > 0 {
+			from = max(tipHeight-depth+1, 0)
+		}
+		issues = verifyMainChain(tx, tip, tipHeight, from, level)
+		return nil
+	})
+	if err != nil || level < VerifyUTXO || bc.tip == nil {
+		return issues, err
+	}
+
+	if pruned := bc.PrunedHeight(); pruned > 0 {
+		return issues, fmt.Errorf("%w: blocks below height %d are pruned", ErrUTXONotVerifiable, pruned)
+	}
+	if height, pending := bc.SnapshotPending(); pending {
+		return issues, fmt.Errorf("%w: blocks below the snapshot at height %d are not validated", ErrUTXONotVerifiable, height)
+	}
+
+	checkSigsFrom := tipHeight + 1
+	if level >= VerifySignatures {
+		checkSigsFrom = 0
+		if depth > 0 {
+			checkSigsFrom = tipHeight - depth + 1
+		}
+	}
+	utxoIssues, err := bc.verifyUTXO(checkSigsFrom)
+
+	return append(issues, utxoIssues...), err
+}
+
+// verifyMainChain walks the main chain from the tip down to height from
+func verifyMainChain(tx StoreTx, tip []byte, tipHeight, from, level int) []ChainIssue {
+	var issues []ChainIssue
+	report := func(height int, hash []byte, format string, a ...interface{}) {
+		issues = append(issues, ChainIssue{height, hash, fmt.Sprintf(format, a...)})
+	}
+
+	prunedHeight := getPrunedHeight(tx)
+	snapshotHeight, _, _, pending := getSnapshotState(tx)
+
+	// blocks above the tip are left in the height index by an interrupted switch
+	if hash := tx.Index(heightIndex).Get(heightKey(tipHeight + 1)); hash != nil {
+		report(tipHeight+1, append([]byte{}, hash...), "height index has a block above the tip")
+	}
+
+	hash := tip
+	for height := tipHeight; height >= from; height-- {
+		header, headerHeight, err := getHeader(tx, hash)
+		if err != nil {
+			report(height, hash, "header is missing, the chain below cannot be followed")
+			break
+		}
+		if headerHeight != height {
+			report(height, hash, "header records height %d", headerHeight)
+		}
+		if indexed := tx.Index(heightIndex).Get(heightKey(height)); !bytes.Equal(indexed, hash) {
+			report(height, hash, "height index has block %x", indexed)
+		}
+
+		if level >= VerifyBlocks {
+			if !NewProofOfWork(&header).Validate() {
+				report(height, hash, "proof of work is invalid")
+			}
+			if !bytes.Equal(header.Hash(), hash) {
+				report(height, hash, "header hashes to %x", header.Hash())
+			}
+			if height == 0 && len(header.PrevBlockHash) != 0 {
+				report(height, hash, "genesis block has previous block %x", header.PrevBlockHash)
+			}
+		}
+
+		data := tx.Blocks().Get(hash)
+		switch {
+		case data == nil && (height < prunedHeight || pending && height <= snapshotHeight):
+			// pruned or not downloaded yet
+		case data == nil:
+			report(height, hash, "block body is missing")
+		default:
+			block, err := decodeStoredBlock(data)
+			if err != nil {
+				report(height, hash, "block body is corrupt: %s", err)
+				break
+			}
+			if !bytes.Equal(block.Hash, hash) {
+				report(height, hash, "block body hashes to %x", block.Hash)
+			}
+			if level >= VerifyBlocks {
+				if !bytes.Equal(block.MerkleRoot, header.MerkleRoot) {
+					report(height, hash, "Merkle root of the transactions is %x, header has %x", block.MerkleRoot, header.MerkleRoot)
+				}
+				if !bytes.Equal(block.PrevBlockHash, header.PrevBlockHash) {
+					report(height, hash, "block body links to %x, header to %x", block.PrevBlockHash, header.PrevBlockHash)
+				}
+				if block.Height != height {
+					report(height, hash, "block body records height %d", block.Height)
+				}
+			}
+		}
+
+		if height > 0 {
+			if _, prevHeight, err := getHeader(tx, header.PrevBlockHash); err == nil && prevHeight != height-1 {
+				report(height, hash, "previous block %x is at height %d", header.PrevBlockHash, prevHeight)
+			}
+		}
+		hash = header.PrevBlockHash
+	}
+
+	return issues
+}
+
+// verifyUTXO replays the main chain into a scratch UTXO set and compares it with
+// the UTXO set of the node. Input signatures are checked from height checkSigsFrom.
+func (bc *Blockchain) verifyUTXO(checkSigsFrom int) ([]ChainIssue, error) {
+	var issues []ChainIssue
+	scratch := NewMemoryStore()
+	created := make(map[string]int) // height of the block of every transaction replayed
+
+	for height := 0; ; height++ {
+		var block *Block
+		err := bc.store.View(func(tx StoreTx) error {
+			hash, err := getHashAtHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			data := tx.Blocks().Get(hash)
+			if data == nil {
+				return fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+			}
+			block, err = decodeStoredBlock(data)
+			return err
+		})
+		if errors.Is(err, ErrHeightOutOfRange) {
+			break
+		}
+		if err != nil {
+			return issues, fmt.Errorf("%w: height %d: %s", ErrUTXONotVerifiable, height, err)
+		}
+
+		err = scratch.Update(func(tx StoreTx) error {
+			checks, err := inputChecks(tx.UTXO(), block.Transactions)
+			if err == nil && height >= checkSigsFrom {
+				err = runInputChecks(checks, runtime.NumCPU(), nil)
+			}
+			if err != nil {
+				issues = append(issues, ChainIssue{height, block.Hash, err.Error()})
+			}
+
+			for _, transaction := range block.Transactions {
+				created[string(transaction.ID)] = height
+			}
+			_, err = spendOutputs(tx.UTXO(), block)
+			return err
+		})
+		if err != nil {
+			return issues, err
+		}
+	}
+
+	derived, err := collectOutputs(scratch)
+	if err != nil {
+		return issues, err
+	}
+	stored, err := collectOutputs(bc.store)
+	if err != nil {
+		return issues, err
+	}
+
+	var outpoints []outpoint
+	for op := range derived {
+		outpoints = append(outpoints, op)
+	}
+	for op := range stored {
+		if _, ok := derived[op]; !ok {
+			outpoints = append(outpoints, op)
+		}
+	}
+	sort.Slice(outpoints, func(i, j int) bool {
+		if outpoints[i].txID != outpoints[j].txID {
+			return outpoints[i].txID < outpoints[j].txID
+		}
+		return outpoints[i].vout < outpoints[j].vout
+	})
+
+	for _, op := range outpoints {
+		want, inDerived := derived[op]
+		got, inStored := stored[op]
+		height, ok := created[op.txID]
+		if !ok {
+			height = -1
+		}
+
+		switch {
+		case !inStored:
+			issues = append(issues, ChainIssue{height, nil, fmt.Sprintf("unspent output %s is missing from the UTXO set", op)})
+		case !inDerived:
+			issues = append(issues, ChainIssue{height, nil, fmt.Sprintf("UTXO set has output %s, which is spent or does not exist", op)})
+		case got.Value != want.Value || !bytes.Equal(got.PubKeyHash, want.PubKeyHash):
+			issues = append(issues, ChainIssue{height, nil, fmt.Sprintf("UTXO set has output %s with value %d, want %d", op, got.Value, want.Value)})
+		}
+	}
+
+	return issues, nil
+}
+
+// outpoint identifies an output by transaction ID and index
+type outpoint struct {
+	txID string
+	vout int
+}
+
+func (op outpoint) String() string {
+	return fmt.Sprintf("%x:%d", op.txID, op.vout)
+}
+
+// collectOutputs returns the outputs of the UTXO set of store
+func collectOutputs(store ChainStore) (map[outpoint]TXOutput, error) {
+	outputs := make(map[outpoint]TXOutput)
+
+	err := store.View(func(tx StoreTx) error {
+		return tx.UTXO().ForEach(func(k, v []byte) error {
+			outs := DeserializeOutputs(v)
+			for i, out := range outs.Outputs {
+				outputs[outpoint{string(k), outs.Index(i)}] = out
+			}
+			return nil
+		})
+	})
+
+	return outputs, err
+}
+
+// RepairChain rebuilds the data derived from the stored blocks in one transaction:
+// the headers, the height index from the tip, the UTXO set with its undo data and
+// the enabled optional indexes. Blocks that cannot be read are deleted and must be
+// downloaded again, and until they are the UTXO set is kept as it is and an error
+// wrapping ErrBlockNotFound is returned after the rest is repaired. The UTXO set of
+// a pruned node, or one loaded from a snapshot still being validated, is kept too.
+func (bc *Blockchain) RepairChain() error {
+	missing := -1
+
+	err := bc.store.Update(func(tx StoreTx) error {
+		var corrupt [][]byte
+		err := tx.Blocks().ForEach(func(k, v []byte) error {
+			block, err := decodeStoredBlock(v)
+			if err != nil || !bytes.Equal(block.Hash, k) {
+				corrupt = append(corrupt, append([]byte{}, k...))
+				return nil
+			}
+			return tx.Headers().Put(k, encodeHeaderEntry(&block.BlockHeader, block.Height))
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range corrupt {
+			if err := tx.Blocks().Delete(hash); err != nil {
+				return err
+			}
+		}
+
+		tip := tx.Tip()
+		if tip == nil {
+			return nil
+		}
+		_, tipHeight, err := getHeader(tx, tip)
+		if err != nil {
+			return err
+		}
+		// the UTXO set is left as it is until it is known whether it can be rebuilt
+		utxoTip := getUTXOTip(tx)
+		if err := tx.Index(metaBucket).Delete([]byte(utxoTipKey)); err != nil {
+			return err
+		}
+		if err := tx.DeleteIndex(heightIndex); err != nil {
+			return err
+		}
+		if err := setTip(tx, tip, tipHeight); err != nil {
+			return err
+		}
+
+		// blocks below the pruned height or a snapshot being validated may be missing
+		lowest := getPrunedHeight(tx)
+		snapshotHeight, _, _, pending := getSnapshotState(tx)
+		if pending {
+			lowest = snapshotHeight + 1
+		}
+		for height := tipHeight; height >= lowest && missing < 0; height-- {
+			hash, err := getHashAtHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			if tx.Blocks().Get(hash) == nil {
+				missing = height
+			}
+		}
+
+		if missing < 0 && getPrunedHeight(tx) == 0 && !pending {
+			if err := rebuildUTXO(tx); err != nil {
+				return err
+			}
+		} else if utxoTip != nil {
+			if err := tx.Index(metaBucket).Put([]byte(utxoTipKey), utxoTip); err != nil {
+				return err
+			}
+		}
+
+		for _, index := range optionalIndexes {
+			if indexEnabled(tx, index.name) && missing < 0 {
+				if _, err := rebuildIndex(tx, index.name); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.blocks.Purge()
+	bc.headers.Purge()
+	if missing >= 0 {
+		return fmt.Errorf("%w at height %d, the UTXO set is not rebuilt", ErrBlockNotFound, missing)
+	}
+
+	return nil
+}
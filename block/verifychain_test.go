@@ -0,0 +1,163 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// formatIssues renders issues one per line
+func formatIssues(issues []ChainIssue) string {
+	var lines []string
+	for _, issue := range issues {
+		lines = append(lines, issue.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestVerifyChain(t *testing.T) {
+	bc := importTestChain(t, 3)
+
+	for level := VerifyStored; level <= VerifySignatures; level++ {
+		issues, err := bc.VerifyChain(level, 0)
+		if err != nil || len(issues) > 0 {
+			t.Fatalf("level %d found:\n%s\n%v", level, formatIssues(issues), err)
+		}
+	}
+
+	if issues, err := newTestChain(t).VerifyChain(VerifySignatures, 0); err != nil || len(issues) > 0 {
+		t.Fatalf("an empty chain has issues:\n%s\n%v", formatIssues(issues), err)
+	}
+}
+
+func TestVerifyChainBlocks(t *testing.T) {
+	bc := newTestChain(t)
+	chain := storeTestChain(t, bc, 10)
+
+	// test blocks are not mined
+	issues, err := bc.VerifyChain(VerifyBlocks, 3)
+	if err != nil || len(issues) != 3 || issues[0].Height != 9 || !strings.Contains(issues[0].Problem, "proof of work") {
+		t.Fatalf("level 1 at depth 3 found:\n%s\n%v", formatIssues(issues), err)
+	}
+	if issues, _ = bc.VerifyChain(VerifyStored, 0); len(issues) > 0 {
+		t.Fatalf("level 0 found:\n%s", formatIssues(issues))
+	}
+
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := tx.Index(heightIndex).Put(heightKey(4), chain[3].Hash); err != nil {
+			return err
+		}
+		if err := tx.Blocks().Put(chain[6].Hash, []byte{encodingV1, 0xff}); err != nil {
+			return err
+		}
+		return tx.Blocks().Delete(chain[7].Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err = bc.VerifyChain(VerifyUTXO, 0)
+	if !errors.Is(err, ErrUTXONotVerifiable) {
+		t.Fatalf("re-deriving the UTXO set of a corrupt chain returned %v", err)
+	}
+	want := []string{"height 7", "block body is missing", "height 6", "corrupt", "height 4", "height index has block"}
+	for _, s := range want {
+		if !strings.Contains(formatIssues(issues), s) {
+			t.Errorf("issues do not mention %q:\n%s", s, formatIssues(issues))
+		}
+	}
+
+	// the height index is rebuilt, the missing and corrupt blocks must be downloaded again
+	if err := bc.RepairChain(); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("repairing without all blocks returned %v", err)
+	}
+	issues, _ = bc.VerifyChain(VerifyStored, 0)
+	if got := formatIssues(issues); len(issues) != 2 || !strings.Contains(got, "height 7") || !strings.Contains(got, "height 6") {
+		t.Fatalf("after the repair found:\n%s", got)
+	}
+}
+
+func TestVerifyChainUTXO(t *testing.T) {
+	bc := importTestChain(t, 3)
+	block, err := bc.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := block.Transactions[0]
+
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := tx.UTXO().Delete(coinbase.ID); err != nil {
+			return err
+		}
+		return tx.UTXO().Put([]byte("bogus"), TXOutputs{Outputs: coinbase.Vout}.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := bc.VerifyChain(VerifyUTXO, 1)
+	if err != nil || len(issues) != 2 {
+		t.Fatalf("found:\n%s\n%v", formatIssues(issues), err)
+	}
+	if got := formatIssues(issues); !strings.Contains(got, "height 1: unspent output") || !strings.Contains(got, "height -1: UTXO set has output 626f677573:0") {
+		t.Fatalf("found:\n%s", got)
+	}
+
+	if err := bc.RepairChain(); err != nil {
+		t.Fatal(err)
+	}
+	if issues, err := bc.VerifyChain(VerifySignatures, 0); err != nil || len(issues) > 0 {
+		t.Fatalf("after the repair found:\n%s\n%v", formatIssues(issues), err)
+	}
+}
+
+func TestVerifyChainAfterCrash(t *testing.T) {
+	bc := importTestChain(t, 3)
+
+	// the node stopped with the UTXO set one block behind the tip, as a database
+	// written before blocks were connected atomically may be
+	block, err := bc.GetBlockByHeight(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.store.Update(func(tx StoreTx) error {
+		if err := disconnectUTXO(tx, &block); err != nil {
+			return err
+		}
+		return tx.Index(metaBucket).Put([]byte(utxoTipKey), block.PrevBlockHash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := bc.VerifyChain(VerifyUTXO, 0)
+	if err != nil || len(issues) == 0 {
+		t.Fatalf("the UTXO set behind the tip was not noticed: %v", err)
+	}
+	for _, issue := range issues {
+		if issue.Height != 2 && !strings.Contains(issue.Problem, "which is spent") {
+			t.Errorf("unexpected issue %s", issue)
+		}
+	}
+
+	if err := bc.RepairChain(); err != nil {
+		t.Fatal(err)
+	}
+	if issues, err := bc.VerifyChain(VerifySignatures, 0); err != nil || len(issues) > 0 {
+		t.Fatalf("after the repair found:\n%s\n%v", formatIssues(issues), err)
+	}
+	err = bc.store.View(func(tx StoreTx) error {
+		if tx.Index(undoIndex).Get(block.Hash) == nil {
+			t.Error("the repair did not rebuild the undo data")
+		}
+		if !bytes.Equal(getUTXOTip(tx), block.Hash) {
+			t.Errorf("the repaired UTXO set is at %x, want the tip", getUTXOTip(tx))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,39 +3,103 @@ package block
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const addressChecksumLen = 4
-const version1 = 0x00
 
 // A wallet is nothing but a key pair
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
+	PrivateKey ecdsa.PrivateKey // P256 key, zero for other schemes
 	PublicKey  []byte
+	Scheme     SigScheme
+	SecretKey  []byte // secp256k1 secret scalar, nil for P256
 }
 
 func NewWallet() *Wallet {
-	priKey, pubKey := newKeyPair()
-	wallet := &Wallet{priKey, pubKey}
+	wallet, err := NewWalletWithScheme(SchemeP256)
+	if err != nil {
+		panic(err)
+	}
+
 	return wallet
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-	priKey, _ := ecdsa.GenerateKey(curve, rand.Reader)
-	pubKey := append(priKey.X.Bytes(), priKey.Y.Bytes()...)
+// NewWalletWithScheme creates a wallet whose key uses the given signature scheme
+func NewWalletWithScheme(scheme SigScheme) (*Wallet, error) {
+	impl, err := schemeFor(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	wallet := &Wallet{Scheme: scheme}
+	if err := impl.NewKey(wallet); err != nil {
+		return nil, err
+	}
+
+	return wallet, nil
+}
+
+// Sign signs a 32-byte hash with the wallet key
+func (w *Wallet) Sign(hash []byte) ([]byte, error) {
+	impl, err := schemeFor(w.Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	return impl.Sign(w, hash)
+}
+
+// walletRecord is the stored form of a Wallet; curve types can't be gob-encoded
+type walletRecord struct {
+	Scheme    SigScheme
+	SecretKey []byte
+	PublicKey []byte
+}
+
+// GobEncode implements gob.GobEncoder
+func (w *Wallet) GobEncode() ([]byte, error) {
+	record := walletRecord{w.Scheme, w.SecretKey, w.PublicKey}
+	if w.Scheme == SchemeP256 {
+		record.SecretKey = padBytes(w.PrivateKey.D.Bytes(), coordinateLen)
+	}
+
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(record)
 
-	return *priKey, pubKey
+	return buff.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder
+func (w *Wallet) GobDecode(data []byte) error {
+	var record walletRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+		return err
+	}
+
+	w.Scheme = record.Scheme
+	w.PublicKey = record.PublicKey
+	if record.Scheme != SchemeP256 {
+		w.SecretKey = record.SecretKey
+		return nil
+	}
+
+	pubKey, err := decodePubKey(record.PublicKey)
+	if err != nil {
+		return err
+	}
+	w.PrivateKey = ecdsa.PrivateKey{PublicKey: *pubKey, D: new(big.Int).SetBytes(record.SecretKey)}
+
+	return nil
 }
 
 func (w Wallet) GetAddress() []byte {
 	pushKeyHash := HashPubKey(w.PublicKey)
-	versionedPayload := append([]byte{version1}, pushKeyHash...)
+	versionedPayload := append([]byte{byte(w.Scheme)}, pushKeyHash...)
 	checksum := checksum(versionedPayload)
 
 	fullPayload := append(versionedPayload, checksum...)
@@ -64,10 +128,17 @@ func checksum(payload []byte) []byte {
 // ValidateAddress check if address is valid
 func ValidateAddress(address string) bool {
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
 
+	if _, err := schemeFor(SigScheme(version)); err != nil {
+		return false
+	}
+
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
 }
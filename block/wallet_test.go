@@ -2,6 +2,7 @@ package block
 
 import (
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -10,3 +11,33 @@ func TestGenerateAddr(t *testing.T) {
 	addrBytes := wallet.GetAddress()
 	fmt.Println(string(addrBytes))
 }
+
+func TestWalletsFileKeepsSchemes(t *testing.T) {
+	nodeID := "scheme_test"
+	defer os.Remove(walletsFile.path(nodeID))
+
+	wallets := &Wallets{Wallets: make(map[string]*Wallet)}
+	var addresses []string
+	for _, scheme := range []SigScheme{SchemeP256, SchemeSecp256k1, SchemeSchnorr} {
+		address, err := wallets.CreateWallet(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, address)
+	}
+	wallets.SaveToFile(nodeID)
+
+	loaded, err := NewWallets(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range addresses {
+		wallet := loaded.GetWallet(address)
+		if string(wallet.GetAddress()) != address {
+			t.Errorf("reloaded wallet has address %s, want %s", wallet.GetAddress(), address)
+		}
+		if _, err := wallet.Sign(make([]byte, 32)); err != nil {
+			t.Errorf("%s: reloaded wallet cannot sign: %s", wallet.Scheme, err)
+		}
+	}
+}
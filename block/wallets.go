@@ -2,15 +2,12 @@ package block
 
 import (
 	"bytes"
-	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"os"
 )
 
-const walletFile = "wallet_%s.dat"
-
 // Wallets stores a collection of wallets
 type Wallets struct {
 	Wallets map[string]*Wallet
@@ -26,14 +23,17 @@ func NewWallets(nodeID string) (*Wallets, error) {
 	return &wallets, err
 }
 
-// CreateWallet adds a Wallet to Wallets
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+// CreateWallet adds a Wallet using the given signature scheme to Wallets
+func (ws *Wallets) CreateWallet(scheme SigScheme) (string, error) {
+	wallet, err := NewWalletWithScheme(scheme)
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 // GetAddresses returns an array of addresses stored in the wallet file
@@ -54,7 +54,7 @@ func (ws *Wallets) GetWallet(address string) Wallet {
 
 // LoadFromFile loads wallets from the file
 func (ws *Wallets) LoadFromFile(nodeID string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeID)
+	walletFile := walletsFile.path(nodeID)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -65,7 +65,6 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	}
 
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
@@ -80,9 +79,7 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 // SaveToFile saves wallets to a file
 func (ws *Wallets) SaveToFile(nodeID string) {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeID)
-
-	gob.Register(elliptic.P256())
+	walletFile := walletsFile.path(nodeID)
 
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)